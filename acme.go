@@ -0,0 +1,350 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+// ACMEState is what ACMEFetcher persists in an ACMEStore. Keys and the certificate are PEM.
+type ACMEState struct {
+	AccountKey  []byte `json:"accountKey"`
+	AccountURL  string `json:"accountURL"`
+	Certificate []byte `json:"certificate"`
+	PrivateKey  []byte `json:"privateKey"`
+}
+
+// ACMEStore persists the ACME account and the issued certificate between restarts.
+// Load returns an empty state if nothing is stored yet.
+type ACMEStore interface {
+	Load(ctx context.Context) (*ACMEState, error)
+	Save(ctx context.Context, state *ACMEState) error
+}
+
+// ACMESolver fulfills a challenge type for an authorization.
+type ACMESolver interface {
+	ChallengeType() string
+	Present(ctx context.Context, client *acme.Client, domain string, chal *acme.Challenge) error
+	CleanUp(ctx context.Context, client *acme.Client, domain string, chal *acme.Challenge) error
+}
+
+// ACMEFetcher obtains a certificate for domains from an ACME CA such as Let's Encrypt,
+// and obtains a new one when the stored certificate expires within renewBefore.
+type ACMEFetcher struct {
+	directoryURL string
+	email        string
+	domains      []string
+	solver       ACMESolver
+	store        ACMEStore
+	renewBefore  time.Duration
+	now          func() time.Time
+}
+
+func NewACMEFetcher(directoryURL string, email string, domains []string, solver ACMESolver, store ACMEStore, renewBefore time.Duration) *ACMEFetcher {
+	return &ACMEFetcher{
+		directoryURL: directoryURL,
+		email:        email,
+		domains:      domains,
+		solver:       solver,
+		store:        store,
+		renewBefore:  renewBefore,
+		now:          time.Now,
+	}
+}
+
+func (f *ACMEFetcher) Fetch(ctx context.Context) ([]byte, []byte, error) {
+	state, err := f.store.Load(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("load acme state: %w", err)
+	}
+	if f.valid(state) {
+		return state.Certificate, state.PrivateKey, nil
+	}
+
+	client, err := f.register(ctx, state)
+	if err != nil {
+		return nil, nil, err
+	}
+	tlsCert, tlsKey, err := f.obtain(ctx, client)
+	if err != nil {
+		return nil, nil, err
+	}
+	state.Certificate = tlsCert
+	state.PrivateKey = tlsKey
+	if err := f.store.Save(ctx, state); err != nil {
+		return nil, nil, fmt.Errorf("save acme state: %w", err)
+	}
+	return tlsCert, tlsKey, nil
+}
+
+// valid reports whether the stored certificate covers the domains and is not due for renewal.
+func (f *ACMEFetcher) valid(state *ACMEState) bool {
+	if state.Certificate == nil || state.PrivateKey == nil {
+		return false
+	}
+	leaf, err := parseLeafCertificate(state.Certificate)
+	if err != nil {
+		log.Print("failed to parse stored acme certificate: ", err)
+		return false
+	}
+	for _, domain := range f.domains {
+		if err := leaf.VerifyHostname(domain); err != nil && !containsString(leaf.DNSNames, domain) {
+			log.Printf("stored acme certificate does not cover %s", domain)
+			return false
+		}
+	}
+	if f.now().Add(f.renewBefore).After(leaf.NotAfter) {
+		log.Printf("stored acme certificate expires at %s", leaf.NotAfter.Format(time.RFC3339))
+		return false
+	}
+	return true
+}
+
+// register returns a client for the account in state, creating the account key and the account if needed.
+func (f *ACMEFetcher) register(ctx context.Context, state *ACMEState) (*acme.Client, error) {
+	if state.AccountKey == nil {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		state.AccountKey = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+		state.AccountURL = ""
+	}
+	key, err := parsePrivateKey(state.AccountKey)
+	if err != nil {
+		return nil, fmt.Errorf("parse acme account key: %w", err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("acme account key is not a signer")
+	}
+	client := &acme.Client{
+		Key:          signer,
+		DirectoryURL: f.directoryURL,
+		UserAgent:    "tls-secrets-sync",
+	}
+	if state.AccountURL != "" {
+		client.KID = acme.KeyID(state.AccountURL)
+		return client, nil
+	}
+
+	log.Printf("Start registering acme account")
+	account := &acme.Account{}
+	if f.email != "" {
+		account.Contact = []string{"mailto:" + f.email}
+	}
+	if _, err := client.Register(ctx, account, acme.AcceptTOS); err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) {
+		return nil, fmt.Errorf("register acme account: %w", err)
+	}
+	state.AccountURL = string(client.KID)
+	// Save the account now so that it is reused even if the order fails.
+	if err := f.store.Save(ctx, state); err != nil {
+		return nil, fmt.Errorf("save acme state: %w", err)
+	}
+	log.Printf("Complete registering acme account %s", state.AccountURL)
+	return client, nil
+}
+
+func (f *ACMEFetcher) obtain(ctx context.Context, client *acme.Client) ([]byte, []byte, error) {
+	log.Printf("Start ordering acme certificate for %s", strings.Join(f.domains, ","))
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs(f.domains...))
+	if err != nil {
+		return nil, nil, fmt.Errorf("order acme certificate: %w", err)
+	}
+	for _, u := range order.AuthzURLs {
+		if err := f.authorize(ctx, client, u); err != nil {
+			return nil, nil, err
+		}
+	}
+	order, err = client.WaitOrder(ctx, order.URI)
+	if err != nil {
+		return nil, nil, fmt.Errorf("wait for acme order: %w", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: f.domains[0]},
+		DNSNames: f.domains,
+	}, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	chain, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return nil, nil, fmt.Errorf("finalize acme order: %w", err)
+	}
+	var tlsCert []byte
+	for _, der := range chain {
+		tlsCert = append(tlsCert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	log.Printf("Complete ordering acme certificate for %s", strings.Join(f.domains, ","))
+	return tlsCert, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+func (f *ACMEFetcher) authorize(ctx context.Context, client *acme.Client, authzURL string) error {
+	authz, err := client.GetAuthorization(ctx, authzURL)
+	if err != nil {
+		return fmt.Errorf("get acme authorization: %w", err)
+	}
+	if authz.Status == acme.StatusValid {
+		return nil
+	}
+	var chal *acme.Challenge
+	for _, c := range authz.Challenges {
+		if c.Type == f.solver.ChallengeType() {
+			chal = c
+			break
+		}
+	}
+	if chal == nil {
+		return fmt.Errorf("no %s challenge offered for %s", f.solver.ChallengeType(), authz.Identifier.Value)
+	}
+	domain := authz.Identifier.Value
+	if authz.Wildcard {
+		domain = "*." + domain
+	}
+	log.Printf("Start solving %s challenge for %s", chal.Type, domain)
+	if err := f.solver.Present(ctx, client, domain, chal); err != nil {
+		return fmt.Errorf("present %s challenge for %s: %w", chal.Type, domain, err)
+	}
+	defer func() {
+		if err := f.solver.CleanUp(ctx, client, domain, chal); err != nil {
+			log.Printf("failed to clean up %s challenge for %s: %v", chal.Type, domain, err)
+		}
+	}()
+	if _, err := client.Accept(ctx, chal); err != nil {
+		return fmt.Errorf("accept %s challenge for %s: %w", chal.Type, domain, err)
+	}
+	if _, err := client.WaitAuthorization(ctx, authz.URI); err != nil {
+		return fmt.Errorf("wait for acme authorization of %s: %w", domain, err)
+	}
+	log.Printf("Complete solving %s challenge for %s", chal.Type, domain)
+	return nil
+}
+
+// HTTP01Solver answers HTTP-01 challenges. It must be served on port 80 of the domains,
+// typically through a Service and an Ingress path for /.well-known/acme-challenge/.
+type HTTP01Solver struct {
+	mu     sync.Mutex
+	tokens map[string]string
+}
+
+func NewHTTP01Solver() *HTTP01Solver {
+	return &HTTP01Solver{tokens: make(map[string]string)}
+}
+
+func (s *HTTP01Solver) ChallengeType() string {
+	return "http-01"
+}
+
+func (s *HTTP01Solver) Present(_ context.Context, client *acme.Client, _ string, chal *acme.Challenge) error {
+	response, err := client.HTTP01ChallengeResponse(chal.Token)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokens[chal.Token] = response
+	return nil
+}
+
+func (s *HTTP01Solver) CleanUp(_ context.Context, _ *acme.Client, _ string, chal *acme.Challenge) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.tokens, chal.Token)
+	return nil
+}
+
+func (s *HTTP01Solver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.URL.Path, "/.well-known/acme-challenge/")
+	s.mu.Lock()
+	response, ok := s.tokens[token]
+	s.mu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	_, _ = w.Write([]byte(response))
+}
+
+// DNS01Provider manages TXT records for DNS-01 challenges. fqdn ends with a dot.
+// A record may have several values at once, such as for example.com and *.example.com,
+// so Present and CleanUp must add and remove only value.
+type DNS01Provider interface {
+	Present(ctx context.Context, fqdn string, value string) error
+	CleanUp(ctx context.Context, fqdn string, value string) error
+}
+
+// DNS01Solver answers DNS-01 challenges through a DNS01Provider,
+// waiting propagationDelay after the record is presented.
+type DNS01Solver struct {
+	provider         DNS01Provider
+	propagationDelay time.Duration
+}
+
+func NewDNS01Solver(provider DNS01Provider, propagationDelay time.Duration) *DNS01Solver {
+	return &DNS01Solver{
+		provider:         provider,
+		propagationDelay: propagationDelay,
+	}
+}
+
+func (s *DNS01Solver) ChallengeType() string {
+	return "dns-01"
+}
+
+func dns01FQDN(domain string) string {
+	return "_acme-challenge." + strings.TrimSuffix(strings.TrimPrefix(domain, "*."), ".") + "."
+}
+
+func (s *DNS01Solver) Present(ctx context.Context, client *acme.Client, domain string, chal *acme.Challenge) error {
+	value, err := client.DNS01ChallengeRecord(chal.Token)
+	if err != nil {
+		return err
+	}
+	if err := s.provider.Present(ctx, dns01FQDN(domain), value); err != nil {
+		return err
+	}
+	if s.propagationDelay > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(s.propagationDelay):
+		}
+	}
+	return nil
+}
+
+func (s *DNS01Solver) CleanUp(ctx context.Context, client *acme.Client, domain string, chal *acme.Challenge) error {
+	value, err := client.DNS01ChallengeRecord(chal.Token)
+	if err != nil {
+		return err
+	}
+	return s.provider.CleanUp(ctx, dns01FQDN(domain), value)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os/exec"
+	"time"
+
+	dns "google.golang.org/api/dns/v1"
+)
+
+const acmeDNSRecordTTL = 60
+
+// CloudDNSProvider manages DNS-01 TXT records in a Cloud DNS managed zone.
+type CloudDNSProvider struct {
+	s            *dns.Service
+	projectId    string
+	managedZone  string
+	pollInterval time.Duration
+}
+
+func NewCloudDNSProvider(service *dns.Service, projectId string, managedZone string) *CloudDNSProvider {
+	return &CloudDNSProvider{
+		s:            service,
+		projectId:    projectId,
+		managedZone:  managedZone,
+		pollInterval: 5 * time.Second,
+	}
+}
+
+func (p *CloudDNSProvider) current(ctx context.Context, fqdn string) (*dns.ResourceRecordSet, error) {
+	res, err := p.s.ResourceRecordSets.List(p.projectId, p.managedZone).Name(fqdn).Type("TXT").Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("list record sets: %w", err)
+	}
+	if len(res.Rrsets) == 0 {
+		return nil, nil
+	}
+	return res.Rrsets[0], nil
+}
+
+// change replaces the TXT values of fqdn with values, deleting the record set if values is empty.
+func (p *CloudDNSProvider) change(ctx context.Context, current *dns.ResourceRecordSet, fqdn string, values []string) error {
+	change := &dns.Change{}
+	if current != nil {
+		change.Deletions = []*dns.ResourceRecordSet{current}
+	}
+	if len(values) > 0 {
+		change.Additions = []*dns.ResourceRecordSet{{
+			Name:    fqdn,
+			Type:    "TXT",
+			Ttl:     acmeDNSRecordTTL,
+			Rrdatas: values,
+		}}
+	}
+	c, err := p.s.Changes.Create(p.projectId, p.managedZone, change).Context(ctx).Do()
+	if err != nil {
+		return fmt.Errorf("create change: %w", err)
+	}
+	for c.Status != "done" {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(p.pollInterval):
+		}
+		c, err = p.s.Changes.Get(p.projectId, p.managedZone, c.Id).Context(ctx).Do()
+		if err != nil {
+			return fmt.Errorf("get change: %w", err)
+		}
+	}
+	return nil
+}
+
+func (p *CloudDNSProvider) Present(ctx context.Context, fqdn string, value string) error {
+	current, err := p.current(ctx, fqdn)
+	if err != nil {
+		return err
+	}
+	quoted := fmt.Sprintf("%q", value)
+	var values []string
+	if current != nil {
+		for _, v := range current.Rrdatas {
+			if v == quoted {
+				return nil
+			}
+		}
+		values = append(values, current.Rrdatas...)
+	}
+	log.Printf("add TXT record %s to managed zone %s", fqdn, p.managedZone)
+	return p.change(ctx, current, fqdn, append(values, quoted))
+}
+
+func (p *CloudDNSProvider) CleanUp(ctx context.Context, fqdn string, value string) error {
+	current, err := p.current(ctx, fqdn)
+	if err != nil || current == nil {
+		return err
+	}
+	quoted := fmt.Sprintf("%q", value)
+	var values []string
+	for _, v := range current.Rrdatas {
+		if v != quoted {
+			values = append(values, v)
+		}
+	}
+	if len(values) == len(current.Rrdatas) {
+		return nil
+	}
+	log.Printf("remove TXT record %s from managed zone %s", fqdn, p.managedZone)
+	return p.change(ctx, current, fqdn, values)
+}
+
+// ExecDNSProvider runs a command to manage DNS-01 TXT records in any DNS service,
+// as "command present <fqdn> <value>" and "command cleanup <fqdn> <value>".
+type ExecDNSProvider struct {
+	command []string
+}
+
+func NewExecDNSProvider(command []string) *ExecDNSProvider {
+	return &ExecDNSProvider{command: command}
+}
+
+func (p *ExecDNSProvider) run(ctx context.Context, action string, fqdn string, value string) error {
+	args := append(append([]string{}, p.command[1:]...), action, fqdn, value)
+	log.Printf("run dns command %s %s %s", p.command[0], action, fqdn)
+	out, err := exec.CommandContext(ctx, p.command[0], args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("dns command: %w: %s", err, out)
+	}
+	return nil
+}
+
+func (p *ExecDNSProvider) Present(ctx context.Context, fqdn string, value string) error {
+	return p.run(ctx, "present", fqdn, value)
+}
+
+func (p *ExecDNSProvider) CleanUp(ctx context.Context, fqdn string, value string) error {
+	return p.run(ctx, "cleanup", fqdn, value)
+}
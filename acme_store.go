@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+
+	secretmanager "cloud.google.com/go/secretmanager/apiv1"
+	"cloud.google.com/go/secretmanager/apiv1/secretmanagerpb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	acmeAccountKeyField = "acme-account.key"
+	acmeAccountURLField = "acme-account-url"
+)
+
+// KubernetesACMEStore stores the ACME state in an Opaque Secret,
+// with the certificate in tls.crt and tls.key so that it can be read as usual.
+type KubernetesACMEStore struct {
+	k          kubernetes.Interface
+	namespace  string
+	secretName string
+}
+
+func NewKubernetesACMEStore(k kubernetes.Interface, namespace string, secretName string) *KubernetesACMEStore {
+	return &KubernetesACMEStore{
+		k:          k,
+		namespace:  namespace,
+		secretName: secretName,
+	}
+}
+
+func (s *KubernetesACMEStore) Load(ctx context.Context) (*ACMEState, error) {
+	secret, err := s.k.CoreV1().Secrets(s.namespace).Get(ctx, s.secretName, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return &ACMEState{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &ACMEState{
+		AccountKey:  secret.Data[acmeAccountKeyField],
+		AccountURL:  string(secret.Data[acmeAccountURLField]),
+		Certificate: secret.Data["tls.crt"],
+		PrivateKey:  secret.Data["tls.key"],
+	}, nil
+}
+
+func (s *KubernetesACMEStore) Save(ctx context.Context, state *ACMEState) error {
+	data := map[string][]byte{
+		acmeAccountKeyField: state.AccountKey,
+		acmeAccountURLField: []byte(state.AccountURL),
+	}
+	if state.Certificate != nil {
+		data["tls.crt"] = state.Certificate
+		data["tls.key"] = state.PrivateKey
+	}
+	secret, err := s.k.CoreV1().Secrets(s.namespace).Get(ctx, s.secretName, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		log.Printf("create acme secret for namespace=%s,name=%s", s.namespace, s.secretName)
+		_, err := s.k.CoreV1().Secrets(s.namespace).Create(ctx, &apiv1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: s.secretName,
+				Labels: map[string]string{
+					managedByLabel: managedByValue,
+				},
+			},
+			Type: apiv1.SecretTypeOpaque,
+			Data: data,
+		}, metav1.CreateOptions{})
+		return err
+	} else if err != nil {
+		return err
+	}
+	log.Printf("update acme secret for namespace=%s,name=%s", s.namespace, s.secretName)
+	secret.Data = data
+	_, err = s.k.CoreV1().Secrets(s.namespace).Update(ctx, secret, metav1.UpdateOptions{})
+	return err
+}
+
+// SecretManagerACMEStore stores the ACME state as JSON in versions of an existing secret.
+type SecretManagerACMEStore struct {
+	k          *secretmanager.Client
+	projectId  string
+	secretName string
+}
+
+func NewSecretManagerACMEStore(client *secretmanager.Client, projectId string, secretName string) *SecretManagerACMEStore {
+	return &SecretManagerACMEStore{
+		k:          client,
+		projectId:  projectId,
+		secretName: secretName,
+	}
+}
+
+func (s *SecretManagerACMEStore) secretFullName() string {
+	return fmt.Sprintf("projects/%s/secrets/%s", s.projectId, s.secretName)
+}
+
+func (s *SecretManagerACMEStore) Load(ctx context.Context) (*ACMEState, error) {
+	v, err := s.k.AccessSecretVersion(ctx, &secretmanagerpb.AccessSecretVersionRequest{
+		Name: s.secretFullName() + "/versions/latest",
+	})
+	if status.Code(err) == codes.NotFound {
+		return &ACMEState{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	state := &ACMEState{}
+	if err := json.Unmarshal(v.Payload.Data, state); err != nil {
+		return nil, fmt.Errorf("decode acme state in %s: %w", s.secretName, err)
+	}
+	return state, nil
+}
+
+func (s *SecretManagerACMEStore) Save(ctx context.Context, state *ACMEState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	log.Printf("add secret version to %s", s.secretName)
+	_, err = s.k.AddSecretVersion(ctx, &secretmanagerpb.AddSecretVersionRequest{
+		Parent: s.secretFullName(),
+		Payload: &secretmanagerpb.SecretPayload{
+			Data: data,
+		},
+	})
+	return err
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+type fakeACMEAuthz struct {
+	Domain   string
+	Wildcard bool
+	Token    string
+	Status   string
+}
+
+type fakeACMEOrder struct {
+	Status      string
+	Domains     []string
+	Authzs      []int
+	Certificate []byte
+}
+
+// fakeACMEServer is a Pebble-like ACME server. It does not verify JWS signatures,
+// validates challenges synchronously through http01 and dns01, and issues certificates with its own CA.
+type fakeACMEServer struct {
+	url        string
+	mu         sync.Mutex
+	thumbprint string
+	accounts   int
+	orders     []*fakeACMEOrder
+	authzs     []*fakeACMEAuthz
+	caCert     *x509.Certificate
+	caKey      *ecdsa.PrivateKey
+	notAfter   time.Duration
+	http01     http.Handler
+	dns01      *fakeDNS01Provider
+}
+
+func (s *fakeACMEServer) writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func (s *fakeACMEServer) authzJSON(i int) map[string]interface{} {
+	a := s.authzs[i]
+	return map[string]interface{}{
+		"status":     a.Status,
+		"identifier": map[string]string{"type": "dns", "value": a.Domain},
+		"wildcard":   a.Wildcard,
+		"challenges": []map[string]string{
+			{"type": "http-01", "url": fmt.Sprintf("%s/chal/%d/http-01", s.url, i), "token": a.Token, "status": a.Status},
+			{"type": "dns-01", "url": fmt.Sprintf("%s/chal/%d/dns-01", s.url, i), "token": a.Token, "status": a.Status},
+		},
+	}
+}
+
+func (s *fakeACMEServer) orderJSON(w http.ResponseWriter, status int, i int) {
+	o := s.orders[i]
+	if o.Status == "pending" {
+		ready := true
+		for _, a := range o.Authzs {
+			ready = ready && s.authzs[a].Status == "valid"
+		}
+		if ready {
+			o.Status = "ready"
+		}
+	}
+	var identifiers []map[string]string
+	for _, d := range o.Domains {
+		identifiers = append(identifiers, map[string]string{"type": "dns", "value": d})
+	}
+	var authzURLs []string
+	for _, a := range o.Authzs {
+		authzURLs = append(authzURLs, fmt.Sprintf("%s/authz/%d", s.url, a))
+	}
+	body := map[string]interface{}{
+		"status":         o.Status,
+		"identifiers":    identifiers,
+		"authorizations": authzURLs,
+		"finalize":       fmt.Sprintf("%s/finalize/%d", s.url, i),
+	}
+	if o.Certificate != nil {
+		body["certificate"] = fmt.Sprintf("%s/cert/%d", s.url, i)
+	}
+	w.Header().Set("Location", fmt.Sprintf("%s/order/%d", s.url, i))
+	s.writeJSON(w, status, body)
+}
+
+// validate checks the challenge response the way a CA would.
+func (s *fakeACMEServer) validate(a *fakeACMEAuthz, typ string) bool {
+	keyAuth := a.Token + "." + s.thumbprint
+	if typ == "http-01" {
+		rec := httptest.NewRecorder()
+		s.http01.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://"+a.Domain+"/.well-known/acme-challenge/"+a.Token, nil))
+		return rec.Code == http.StatusOK && rec.Body.String() == keyAuth
+	}
+	sum := sha256.Sum256([]byte(keyAuth))
+	return s.dns01.has("_acme-challenge."+a.Domain+".", base64.RawURLEncoding.EncodeToString(sum[:]))
+}
+
+func (s *fakeACMEServer) issue(csrDER []byte) ([]byte, error) {
+	csr, err := x509.ParseCertificateRequest(csrDER)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: csr.Subject.CommonName},
+		DNSNames:     csr.DNSNames,
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(s.notAfter),
+	}, s.caCert, csr.PublicKey, s.caKey)
+	if err != nil {
+		return nil, err
+	}
+	return append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.caCert.Raw})...), nil
+}
+
+func (s *fakeACMEServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	w.Header().Set("Replay-Nonce", fmt.Sprintf("nonce-%d", time.Now().UnixNano()))
+	if r.URL.Path == "/directory" {
+		s.writeJSON(w, http.StatusOK, map[string]string{
+			"newNonce":   s.url + "/new-nonce",
+			"newAccount": s.url + "/new-account",
+			"newOrder":   s.url + "/new-order",
+			"revokeCert": s.url + "/revoke-cert",
+			"keyChange":  s.url + "/key-change",
+		})
+		return
+	}
+	if r.URL.Path == "/new-nonce" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	var jws struct {
+		Protected string `json:"protected"`
+		Payload   string `json:"payload"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&jws); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	protected, _ := base64.RawURLEncoding.DecodeString(jws.Protected)
+	payload, _ := base64.RawURLEncoding.DecodeString(jws.Payload)
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	index := func(n int) int {
+		var i int
+		_, _ = fmt.Sscanf(parts[n], "%d", &i)
+		return i
+	}
+	switch parts[0] {
+	case "new-account":
+		var header struct {
+			JWK struct {
+				Crv string `json:"crv"`
+				Kty string `json:"kty"`
+				X   string `json:"x"`
+				Y   string `json:"y"`
+			} `json:"jwk"`
+		}
+		_ = json.Unmarshal(protected, &header)
+		sum := sha256.Sum256([]byte(fmt.Sprintf(`{"crv":"%s","kty":"%s","x":"%s","y":"%s"}`, header.JWK.Crv, header.JWK.Kty, header.JWK.X, header.JWK.Y)))
+		s.thumbprint = base64.RawURLEncoding.EncodeToString(sum[:])
+		s.accounts++
+		w.Header().Set("Location", fmt.Sprintf("%s/account/%d", s.url, s.accounts))
+		s.writeJSON(w, http.StatusCreated, map[string]interface{}{"status": "valid"})
+	case "new-order":
+		var req struct {
+			Identifiers []struct{ Value string } `json:"identifiers"`
+		}
+		_ = json.Unmarshal(payload, &req)
+		order := &fakeACMEOrder{Status: "pending"}
+		for _, id := range req.Identifiers {
+			order.Domains = append(order.Domains, id.Value)
+			s.authzs = append(s.authzs, &fakeACMEAuthz{
+				Domain:   strings.TrimPrefix(id.Value, "*."),
+				Wildcard: strings.HasPrefix(id.Value, "*."),
+				Token:    fmt.Sprintf("token-%d", len(s.authzs)),
+				Status:   "pending",
+			})
+			order.Authzs = append(order.Authzs, len(s.authzs)-1)
+		}
+		s.orders = append(s.orders, order)
+		s.orderJSON(w, http.StatusCreated, len(s.orders)-1)
+	case "authz":
+		s.writeJSON(w, http.StatusOK, s.authzJSON(index(1)))
+	case "chal":
+		a := s.authzs[index(1)]
+		if s.validate(a, parts[2]) {
+			a.Status = "valid"
+		} else {
+			a.Status = "invalid"
+		}
+		s.writeJSON(w, http.StatusOK, map[string]string{"type": parts[2], "url": s.url + r.URL.Path, "token": a.Token, "status": a.Status})
+	case "order":
+		s.orderJSON(w, http.StatusOK, index(1))
+	case "finalize":
+		var req struct {
+			CSR string `json:"csr"`
+		}
+		_ = json.Unmarshal(payload, &req)
+		csr, _ := base64.RawURLEncoding.DecodeString(req.CSR)
+		cert, err := s.issue(csr)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		o := s.orders[index(1)]
+		o.Certificate = cert
+		o.Status = "valid"
+		s.orderJSON(w, http.StatusOK, index(1))
+	case "cert":
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		_, _ = w.Write(s.orders[index(1)].Certificate)
+	default:
+		http.Error(w, "unexpected path "+r.URL.Path, http.StatusNotFound)
+	}
+}
+
+func fakeServerForACME(t *testing.T, solver ACMESolver) *fakeACMEServer {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Fake ACME CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fakeServer := &fakeACMEServer{caCert: caCert, caKey: caKey, notAfter: 90 * 24 * time.Hour}
+	switch s := solver.(type) {
+	case *HTTP01Solver:
+		fakeServer.http01 = s
+	case *DNS01Solver:
+		fakeServer.dns01 = s.provider.(*fakeDNS01Provider)
+	}
+	srv := httptest.NewServer(fakeServer)
+	t.Cleanup(srv.Close)
+	fakeServer.url = srv.URL
+	return fakeServer
+}
+
+type fakeDNS01Provider struct {
+	records map[string][]string
+	cleaned int
+}
+
+func (p *fakeDNS01Provider) has(fqdn string, value string) bool {
+	return containsString(p.records[fqdn], value)
+}
+
+func (p *fakeDNS01Provider) Present(_ context.Context, fqdn string, value string) error {
+	p.records[fqdn] = append(p.records[fqdn], value)
+	return nil
+}
+
+func (p *fakeDNS01Provider) CleanUp(_ context.Context, fqdn string, value string) error {
+	var values []string
+	for _, v := range p.records[fqdn] {
+		if v != value {
+			values = append(values, v)
+		}
+	}
+	p.records[fqdn] = values
+	p.cleaned++
+	return nil
+}
+
+func TestACMEFetcherHTTP01(t *testing.T) {
+	ctx := context.Background()
+	k := fake.NewSimpleClientset()
+	solver := NewHTTP01Solver()
+	fs := fakeServerForACME(t, solver)
+	store := NewKubernetesACMEStore(k, "certs", "acme")
+	fetcher := NewACMEFetcher(fs.url+"/directory", "admin@example.com", []string{"example.com", "www.example.com"}, solver, store, 30*24*time.Hour)
+
+	tlsCert, tlsKey, err := fetcher.Fetch(ctx)
+	if !assert.NoError(t, err) {
+		return
+	}
+	leaf, err := parseLeafCertificate(tlsCert)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"example.com", "www.example.com"}, leaf.DNSNames)
+	}
+	_, chain := splitCertificateChain(tlsCert)
+	assert.NotEmpty(t, chain)
+	assert.Empty(t, solver.tokens)
+	secret, err := k.CoreV1().Secrets("certs").Get(ctx, "acme", metav1.GetOptions{})
+	if assert.NoError(t, err) {
+		assert.Equal(t, tlsCert, secret.Data["tls.crt"])
+		assert.Equal(t, tlsKey, secret.Data["tls.key"])
+		assert.Equal(t, fs.url+"/account/1", string(secret.Data[acmeAccountURLField]))
+	}
+
+	// The stored certificate is used until it is due for renewal, with the same account.
+	fetcher = NewACMEFetcher(fs.url+"/directory", "admin@example.com", []string{"example.com", "www.example.com"}, solver, store, 30*24*time.Hour)
+	cachedCert, _, err := fetcher.Fetch(ctx)
+	if assert.NoError(t, err) {
+		assert.Equal(t, tlsCert, cachedCert)
+	}
+	fetcher.now = func() time.Time { return time.Now().Add(61 * 24 * time.Hour) }
+	renewedCert, _, err := fetcher.Fetch(ctx)
+	if assert.NoError(t, err) {
+		assert.NotEqual(t, tlsCert, renewedCert)
+	}
+	assert.Equal(t, 1, fs.accounts)
+	assert.Len(t, fs.orders, 2)
+}
+
+func TestACMEFetcherDNS01(t *testing.T) {
+	ctx := context.Background()
+	client, smFake := fakeServerForSecretManager(t)
+	provider := &fakeDNS01Provider{records: make(map[string][]string)}
+	solver := NewDNS01Solver(provider, 0)
+	fs := fakeServerForACME(t, solver)
+	store := NewSecretManagerACMEStore(client, "test-project", "acme")
+	fetcher := NewACMEFetcher(fs.url+"/directory", "", []string{"*.example.com", "example.com"}, solver, store, 30*24*time.Hour)
+
+	tlsCert, tlsKey, err := fetcher.Fetch(ctx)
+	if !assert.NoError(t, err) {
+		return
+	}
+	leaf, err := parseLeafCertificate(tlsCert)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"*.example.com", "example.com"}, leaf.DNSNames)
+	}
+	assert.Equal(t, 2, provider.cleaned)
+	assert.Empty(t, provider.records["_acme-challenge.example.com."])
+	// The account is saved before the order, then with the certificate.
+	assert.Equal(t, 2, smFake.addCount)
+
+	state, err := store.Load(ctx)
+	if assert.NoError(t, err) {
+		assert.Equal(t, tlsCert, state.Certificate)
+		assert.Equal(t, tlsKey, state.PrivateKey)
+	}
+}
+
+func TestDNS01FQDN(t *testing.T) {
+	assert.Equal(t, "_acme-challenge.example.com.", dns01FQDN("*.example.com"))
+	assert.Equal(t, "_acme-challenge.www.example.com.", dns01FQDN("www.example.com."))
+}
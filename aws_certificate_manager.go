@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/acm"
+	"github.com/aws/aws-sdk-go-v2/service/acm/types"
+)
+
+// awsCertificateNameTag is the tag to find the certificate imported by this tool.
+const awsCertificateNameTag = "Name"
+
+// AwsCertificateManagerSyncer imports the certificate to AWS Certificate Manager in a region.
+// The certificate is found by managed-by and Name tags and re-imported in place so that its ARN is kept.
+type AwsCertificateManagerSyncer struct {
+	client          *acm.Client
+	region          string
+	certificateName string
+	certificateArn  string
+}
+
+func NewAwsCertificateManagerSyncer(client *acm.Client, region string, certificateName string) *AwsCertificateManagerSyncer {
+	return &AwsCertificateManagerSyncer{
+		client:          client,
+		region:          region,
+		certificateName: certificateName,
+	}
+}
+
+func (s *AwsCertificateManagerSyncer) Sync(ctx context.Context, tlsCert []byte, tlsKey []byte) error {
+	leaf, chain := splitCertificateChain(tlsCert)
+	parsed, err := parseLeafCertificate(leaf)
+	if err != nil {
+		return fmt.Errorf("parse certificate: %w", err)
+	}
+	if s.certificateArn == "" {
+		arn, err := s.findCertificate(ctx)
+		if err != nil {
+			return err
+		}
+		s.certificateArn = arn
+	}
+	if s.certificateArn != "" {
+		res, err := s.client.DescribeCertificate(ctx, &acm.DescribeCertificateInput{
+			CertificateArn: aws.String(s.certificateArn),
+		})
+		var notFound *types.ResourceNotFoundException
+		if errors.As(err, &notFound) {
+			log.Printf("ACM certificate \"%s\" in %s is not found", s.certificateArn, s.region)
+			s.certificateArn = ""
+		} else if err != nil {
+			return fmt.Errorf("describe acm certificate: %w", err)
+		} else if normalizeSerial(aws.ToString(res.Certificate.Serial)) == normalizeSerial(fmt.Sprintf("%x", parsed.SerialNumber)) {
+			return nil
+		}
+	}
+
+	input := &acm.ImportCertificateInput{
+		Certificate: leaf,
+		PrivateKey:  tlsKey,
+	}
+	if len(chain) > 0 {
+		input.CertificateChain = chain
+	}
+	if s.certificateArn != "" {
+		// Tags cannot be specified on re-import, and the ones of the first import are kept.
+		input.CertificateArn = aws.String(s.certificateArn)
+		log.Printf("Start re-importing acm certificate \"%s\" in %s", s.certificateArn, s.region)
+	} else {
+		input.Tags = []types.Tag{
+			{Key: aws.String(managedByLabel), Value: aws.String(managedByValue)},
+			{Key: aws.String(awsCertificateNameTag), Value: aws.String(s.certificateName)},
+		}
+		log.Printf("Start importing acm certificate \"%s\" in %s", s.certificateName, s.region)
+	}
+	res, err := s.client.ImportCertificate(ctx, input)
+	if err != nil {
+		return fmt.Errorf("import acm certificate: %w", err)
+	}
+	s.certificateArn = aws.ToString(res.CertificateArn)
+	log.Printf("Complete importing acm certificate \"%s\" in %s", s.certificateArn, s.region)
+	return nil
+}
+
+// findCertificate returns the ARN of the certificate tagged by this tool with certificateName, or "" if none.
+func (s *AwsCertificateManagerSyncer) findCertificate(ctx context.Context) (string, error) {
+	// Without Includes, only RSA_1024 and RSA_2048 certificates are listed.
+	paginator := acm.NewListCertificatesPaginator(s.client, &acm.ListCertificatesInput{
+		Includes: &types.Filters{KeyTypes: types.KeyAlgorithm("").Values()},
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return "", fmt.Errorf("list acm certificates: %w", err)
+		}
+		for _, summary := range page.CertificateSummaryList {
+			if summary.Type != "" && summary.Type != types.CertificateTypeImported {
+				continue
+			}
+			tags, err := s.client.ListTagsForCertificate(ctx, &acm.ListTagsForCertificateInput{
+				CertificateArn: summary.CertificateArn,
+			})
+			if err != nil {
+				return "", fmt.Errorf("list tags for acm certificate: %w", err)
+			}
+			values := make(map[string]string, len(tags.Tags))
+			for _, tag := range tags.Tags {
+				values[aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+			}
+			if values[managedByLabel] == managedByValue && values[awsCertificateNameTag] == s.certificateName {
+				return aws.ToString(summary.CertificateArn), nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// normalizeSerial normalizes a hex serial number such as "0a:1b:2c" so that it can be compared.
+func normalizeSerial(serial string) string {
+	serial = strings.TrimLeft(strings.ToLower(strings.ReplaceAll(serial, ":", "")), "0")
+	if serial == "" {
+		return "0"
+	}
+	return serial
+}
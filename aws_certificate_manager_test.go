@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/acm"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeAcmCertificate struct {
+	Certificate      []byte
+	CertificateChain []byte
+	PrivateKey       []byte
+	Tags             map[string]string
+	Imported         bool
+}
+
+type fakeAcmServer struct {
+	certificates map[string]*fakeAcmCertificate
+	importCount  int
+}
+
+func (s *fakeAcmServer) writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func (s *fakeAcmServer) notFound(w http.ResponseWriter, arn string) {
+	s.writeJSON(w, http.StatusBadRequest, map[string]string{
+		"__type":  "ResourceNotFoundException",
+		"message": fmt.Sprintf("Could not find certificate %s.", arn),
+	})
+}
+
+func (s *fakeAcmServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		CertificateArn   string
+		Certificate      []byte
+		CertificateChain []byte
+		PrivateKey       []byte
+		Tags             []struct{ Key, Value string }
+	}
+	_ = json.NewDecoder(r.Body).Decode(&body)
+	switch strings.TrimPrefix(r.Header.Get("X-Amz-Target"), "CertificateManager.") {
+	case "ListCertificates":
+		var summaries []map[string]string
+		for arn, cert := range s.certificates {
+			certificateType := "AMAZON_ISSUED"
+			if cert.Imported {
+				certificateType = "IMPORTED"
+			}
+			summaries = append(summaries, map[string]string{"CertificateArn": arn, "Type": certificateType})
+		}
+		s.writeJSON(w, http.StatusOK, map[string]interface{}{"CertificateSummaryList": summaries})
+	case "ListTagsForCertificate":
+		cert, ok := s.certificates[body.CertificateArn]
+		if !ok {
+			s.notFound(w, body.CertificateArn)
+			return
+		}
+		var tags []map[string]string
+		for k, v := range cert.Tags {
+			tags = append(tags, map[string]string{"Key": k, "Value": v})
+		}
+		s.writeJSON(w, http.StatusOK, map[string]interface{}{"Tags": tags})
+	case "DescribeCertificate":
+		cert, ok := s.certificates[body.CertificateArn]
+		if !ok {
+			s.notFound(w, body.CertificateArn)
+			return
+		}
+		parsed, err := parseLeafCertificate(cert.Certificate)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// ACM shows the serial number as colon separated hex bytes.
+		serial := hex.EncodeToString(parsed.SerialNumber.Bytes())
+		var octets []string
+		for i := 0; i < len(serial); i += 2 {
+			octets = append(octets, serial[i:i+2])
+		}
+		s.writeJSON(w, http.StatusOK, map[string]interface{}{
+			"Certificate": map[string]string{"CertificateArn": body.CertificateArn, "Serial": strings.Join(octets, ":")},
+		})
+	case "ImportCertificate":
+		s.importCount++
+		arn := body.CertificateArn
+		if arn == "" {
+			arn = fmt.Sprintf("arn:aws:acm:us-east-1:123456789012:certificate/%d", len(s.certificates)+1)
+			tags := make(map[string]string)
+			for _, tag := range body.Tags {
+				tags[tag.Key] = tag.Value
+			}
+			s.certificates[arn] = &fakeAcmCertificate{Tags: tags, Imported: true}
+		} else if len(body.Tags) > 0 {
+			s.writeJSON(w, http.StatusBadRequest, map[string]string{"__type": "ValidationException", "message": "tags cannot be specified on re-import"})
+			return
+		}
+		cert, ok := s.certificates[arn]
+		if !ok {
+			s.notFound(w, arn)
+			return
+		}
+		cert.Certificate = body.Certificate
+		cert.CertificateChain = body.CertificateChain
+		cert.PrivateKey = body.PrivateKey
+		s.writeJSON(w, http.StatusOK, map[string]string{"CertificateArn": arn})
+	default:
+		http.Error(w, "unexpected target "+r.Header.Get("X-Amz-Target"), http.StatusBadRequest)
+	}
+}
+
+func fakeServerForAwsCertificateManager(t *testing.T) (*acm.Client, *fakeAcmServer) {
+	fakeServer := &fakeAcmServer{
+		certificates: map[string]*fakeAcmCertificate{
+			"arn:aws:acm:us-east-1:123456789012:certificate/other": {Tags: map[string]string{awsCertificateNameTag: "example"}},
+		},
+	}
+	srv := httptest.NewServer(fakeServer)
+	t.Cleanup(srv.Close)
+	client := acm.New(acm.Options{
+		Region:       "us-east-1",
+		BaseEndpoint: aws.String(srv.URL),
+		Credentials:  credentials.NewStaticCredentialsProvider("test", "test", ""),
+	})
+	return client, fakeServer
+}
+
+func TestAwsCertificateManagerSyncer(t *testing.T) {
+	ctx := context.Background()
+	client, fs := fakeServerForAwsCertificateManager(t)
+	syncer := NewAwsCertificateManagerSyncer(client, "us-east-1", "example")
+	leaf, tlsKey := newTestCertificate(t, "*.example.com", time.Now().Add(time.Hour))
+	intermediate, _ := newTestCertificate(t, "Test CA", time.Now().Add(time.Hour))
+	tlsCert := append(append([]byte{}, leaf...), intermediate...)
+
+	for i := 0; i < 2; i++ {
+		if err := syncer.Sync(ctx, tlsCert, tlsKey); err != nil {
+			t.Fatalf("unexpected error in sync: %+v", err)
+		}
+	}
+	assert.Equal(t, 1, fs.importCount)
+	assert.Len(t, fs.certificates, 2)
+	arn := syncer.certificateArn
+	if assert.Contains(t, fs.certificates, arn) {
+		assert.Equal(t, leaf, fs.certificates[arn].Certificate)
+		assert.Equal(t, intermediate, fs.certificates[arn].CertificateChain)
+		assert.Equal(t, tlsKey, fs.certificates[arn].PrivateKey)
+		assert.Equal(t, map[string]string{managedByLabel: managedByValue, awsCertificateNameTag: "example"}, fs.certificates[arn].Tags)
+	}
+
+	// A new process finds the imported certificate by the tags and re-imports it in place.
+	renewed, renewedKey := newTestCertificate(t, "*.example.com", time.Now().Add(2*time.Hour))
+	syncer = NewAwsCertificateManagerSyncer(client, "us-east-1", "example")
+	if err := syncer.Sync(ctx, renewed, renewedKey); err != nil {
+		t.Fatalf("unexpected error in sync: %+v", err)
+	}
+	assert.Equal(t, arn, syncer.certificateArn)
+	assert.Equal(t, 2, fs.importCount)
+	assert.Len(t, fs.certificates, 2)
+	assert.Equal(t, renewed, fs.certificates[arn].Certificate)
+	assert.Empty(t, fs.certificates[arn].CertificateChain)
+}
+
+func TestAwsCertificateManagerSyncerDeleted(t *testing.T) {
+	ctx := context.Background()
+	client, fs := fakeServerForAwsCertificateManager(t)
+	syncer := NewAwsCertificateManagerSyncer(client, "us-east-1", "example")
+	tlsCert, tlsKey := newTestCertificate(t, "*.example.com", time.Now().Add(time.Hour))
+	if err := syncer.Sync(ctx, tlsCert, tlsKey); err != nil {
+		t.Fatalf("unexpected error in sync: %+v", err)
+	}
+	delete(fs.certificates, syncer.certificateArn)
+	if err := syncer.Sync(ctx, tlsCert, tlsKey); err != nil {
+		t.Fatalf("unexpected error in sync: %+v", err)
+	}
+	assert.Equal(t, 2, fs.importCount)
+	assert.Contains(t, fs.certificates, syncer.certificateArn)
+}
+
+func TestNormalizeSerial(t *testing.T) {
+	assert.Equal(t, normalizeSerial("0a:1B:2c"), normalizeSerial("a1b2c"))
+	assert.Equal(t, "0", normalizeSerial("00"))
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager/types"
+	"github.com/aws/smithy-go"
+)
+
+const awsCurrentVersionStage = "AWSCURRENT"
+
+// Tag keys recording the fingerprint of the current version of AWS secrets and parameters.
+const (
+	awsFingerprintTag = "tls-secrets-sync-sha256"
+	awsVersionTag     = "tls-secrets-sync-version"
+)
+
+// isAwsAccessDenied reports whether err is an AWS API error for a missing permission.
+func isAwsAccessDenied(err error) bool {
+	var apiErr smithy.APIError
+	return errors.As(err, &apiErr) && apiErr.ErrorCode() == "AccessDeniedException"
+}
+
+type AwsSecretsManagerFetcher struct {
+	client   *secretsmanager.Client
+	certName string
+	keyName  string
+}
+
+func NewAwsSecretsManagerFetcher(client *secretsmanager.Client, certName string, keyName string) *AwsSecretsManagerFetcher {
+	return &AwsSecretsManagerFetcher{
+		client:   client,
+		certName: certName,
+		keyName:  keyName,
+	}
+}
+
+func (f *AwsSecretsManagerFetcher) Fetch(ctx context.Context) ([]byte, []byte, error) {
+	tlsCert, err := f.getSecretValue(ctx, f.certName)
+	if err != nil {
+		return nil, nil, err
+	}
+	tlsKey, err := f.getSecretValue(ctx, f.keyName)
+	if err != nil {
+		return nil, nil, err
+	}
+	return tlsCert, tlsKey, nil
+}
+
+func (f *AwsSecretsManagerFetcher) getSecretValue(ctx context.Context, name string) ([]byte, error) {
+	v, err := f.client.GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(name),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if v.SecretString != nil {
+		return []byte(*v.SecretString), nil
+	}
+	return v.SecretBinary, nil
+}
+
+// AwsSecretsManagerSyncer writes the certificate and the key to AWS Secrets Manager secrets.
+// Missing secrets are created with kmsKeyId, or the AWS managed key if it is empty.
+// Without secretsmanager:TagResource, values are compared on every sync instead of the recorded fingerprint.
+type AwsSecretsManagerSyncer struct {
+	client   *secretsmanager.Client
+	certName string
+	keyName  string
+	kmsKeyId string
+	// fingerprintDenied is set once recording the fingerprint is denied.
+	fingerprintDenied bool
+}
+
+func NewAwsSecretsManagerSyncer(client *secretsmanager.Client, certName string, keyName string, kmsKeyId string) *AwsSecretsManagerSyncer {
+	return &AwsSecretsManagerSyncer{
+		client:   client,
+		certName: certName,
+		keyName:  keyName,
+		kmsKeyId: kmsKeyId,
+	}
+}
+
+func (s *AwsSecretsManagerSyncer) Sync(ctx context.Context, tlsCert []byte, tlsKey []byte) error {
+	if err := s.reconcileSecret(ctx, s.certName, tlsCert); err != nil {
+		return err
+	}
+	if err := s.reconcileSecret(ctx, s.keyName, tlsKey); err != nil {
+		return err
+	}
+	return nil
+}
+
+// reconcileSecret puts a new value when data differs from the current one.
+// As with SecretManagerSyncer, the fingerprint of the current version is recorded in the secret tags
+// so that the value is only read when that record is missing or stale.
+func (s *AwsSecretsManagerSyncer) reconcileSecret(ctx context.Context, secretName string, data []byte) error {
+	fingerprint := fmt.Sprintf("%x", sha256.Sum256(data))
+
+	secret, err := s.client.DescribeSecret(ctx, &secretsmanager.DescribeSecretInput{
+		SecretId: aws.String(secretName),
+	})
+	var notFound *types.ResourceNotFoundException
+	if errors.As(err, &notFound) {
+		return s.createSecret(ctx, secretName, data, fingerprint)
+	} else if err != nil {
+		return fmt.Errorf("describe secret: %w", err)
+	}
+
+	currentVersion := ""
+	for versionId, stages := range secret.VersionIdsToStages {
+		for _, stage := range stages {
+			if stage == awsCurrentVersionStage {
+				currentVersion = versionId
+			}
+		}
+	}
+	if currentVersion != "" {
+		tags := make(map[string]string, len(secret.Tags))
+		for _, tag := range secret.Tags {
+			tags[aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+		}
+		if !s.fingerprintDenied && tags[awsVersionTag] == currentVersion && tags[awsFingerprintTag] != "" {
+			if tags[awsFingerprintTag] == fingerprint {
+				return nil
+			}
+		} else {
+			v, err := s.client.GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{
+				SecretId:  secret.ARN,
+				VersionId: aws.String(currentVersion),
+			})
+			if err != nil {
+				return fmt.Errorf("get secret value: %w", err)
+			}
+			if bytes.Equal([]byte(aws.ToString(v.SecretString)), data) {
+				return s.recordFingerprint(ctx, aws.ToString(secret.ARN), currentVersion, fingerprint)
+			}
+		}
+	}
+
+	log.Printf("Start putting secret value to \"%s\"", secretName)
+	put, err := s.client.PutSecretValue(ctx, &secretsmanager.PutSecretValueInput{
+		SecretId:     secret.ARN,
+		SecretString: aws.String(string(data)),
+	})
+	if err != nil {
+		return fmt.Errorf("put secret value: %w", err)
+	}
+	log.Printf("Complete putting secret value to \"%s\"", secretName)
+	return s.recordFingerprint(ctx, aws.ToString(secret.ARN), aws.ToString(put.VersionId), fingerprint)
+}
+
+func (s *AwsSecretsManagerSyncer) createSecret(ctx context.Context, secretName string, data []byte, fingerprint string) error {
+	log.Printf("Start creating secret \"%s\"", secretName)
+	input := &secretsmanager.CreateSecretInput{
+		Name:         aws.String(secretName),
+		SecretString: aws.String(string(data)),
+		Tags: []types.Tag{
+			{Key: aws.String(managedByLabel), Value: aws.String(managedByValue)},
+		},
+	}
+	if s.kmsKeyId != "" {
+		input.KmsKeyId = aws.String(s.kmsKeyId)
+	}
+	created, err := s.client.CreateSecret(ctx, input)
+	if err != nil {
+		return fmt.Errorf("create secret: %w", err)
+	}
+	log.Printf("Complete creating secret \"%s\"", secretName)
+	return s.recordFingerprint(ctx, aws.ToString(created.ARN), aws.ToString(created.VersionId), fingerprint)
+}
+
+func (s *AwsSecretsManagerSyncer) recordFingerprint(ctx context.Context, arn string, version string, fingerprint string) error {
+	if s.fingerprintDenied {
+		return nil
+	}
+	_, err := s.client.TagResource(ctx, &secretsmanager.TagResourceInput{
+		SecretId: aws.String(arn),
+		Tags: []types.Tag{
+			{Key: aws.String(awsVersionTag), Value: aws.String(version)},
+			{Key: aws.String(awsFingerprintTag), Value: aws.String(fingerprint)},
+		},
+	})
+	if isAwsAccessDenied(err) {
+		log.Printf("failed to record fingerprint of %s, comparing values instead: %v", arn, err)
+		s.fingerprintDenied = true
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("record fingerprint of %s: %w", arn, err)
+	}
+	return nil
+}
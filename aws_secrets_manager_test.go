@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeAwsSecret struct {
+	Name     string
+	KmsKeyId string
+	Tags     map[string]string
+	Versions []string
+}
+
+type fakeAwsSecretsManagerServer struct {
+	secrets        map[string]*fakeAwsSecret
+	getValueCount  int
+	putValueCount  int
+	createdKmsKeys []string
+	denyTagging    bool
+}
+
+func (s *fakeAwsSecretsManagerServer) writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func (s *fakeAwsSecretsManagerServer) arn(name string) string {
+	return "arn:aws:secretsmanager:us-east-1:123456789012:secret:" + name
+}
+
+// find looks up a secret by name or ARN.
+func (s *fakeAwsSecretsManagerServer) find(id string) *fakeAwsSecret {
+	return s.secrets[strings.TrimPrefix(id, s.arn(""))]
+}
+
+func (s *fakeAwsSecretsManagerServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Name         string
+		SecretId     string
+		SecretString string
+		VersionId    string
+		KmsKeyId     string
+		Tags         []struct{ Key, Value string }
+	}
+	_ = json.NewDecoder(r.Body).Decode(&body)
+	target := strings.TrimPrefix(r.Header.Get("X-Amz-Target"), "secretsmanager.")
+	if target == "CreateSecret" {
+		s.createdKmsKeys = append(s.createdKmsKeys, body.KmsKeyId)
+		secret := &fakeAwsSecret{Name: body.Name, KmsKeyId: body.KmsKeyId, Tags: make(map[string]string), Versions: []string{body.SecretString}}
+		for _, tag := range body.Tags {
+			secret.Tags[tag.Key] = tag.Value
+		}
+		s.secrets[body.Name] = secret
+		s.writeJSON(w, http.StatusOK, map[string]string{"ARN": s.arn(body.Name), "Name": body.Name, "VersionId": "v1"})
+		return
+	}
+	secret := s.find(body.SecretId)
+	if secret == nil {
+		s.writeJSON(w, http.StatusBadRequest, map[string]string{"__type": "ResourceNotFoundException", "message": "Secrets Manager can't find the specified secret."})
+		return
+	}
+	currentVersion := fmt.Sprintf("v%d", len(secret.Versions))
+	switch target {
+	case "DescribeSecret":
+		var tags []map[string]string
+		for k, v := range secret.Tags {
+			tags = append(tags, map[string]string{"Key": k, "Value": v})
+		}
+		s.writeJSON(w, http.StatusOK, map[string]interface{}{
+			"ARN":                s.arn(secret.Name),
+			"Name":               secret.Name,
+			"Tags":               tags,
+			"VersionIdsToStages": map[string][]string{currentVersion: {"AWSCURRENT"}},
+		})
+	case "GetSecretValue":
+		s.getValueCount++
+		version := len(secret.Versions)
+		if body.VersionId != "" {
+			_, _ = fmt.Sscanf(body.VersionId, "v%d", &version)
+		}
+		s.writeJSON(w, http.StatusOK, map[string]string{"ARN": s.arn(secret.Name), "SecretString": secret.Versions[version-1], "VersionId": fmt.Sprintf("v%d", version)})
+	case "PutSecretValue":
+		s.putValueCount++
+		secret.Versions = append(secret.Versions, body.SecretString)
+		s.writeJSON(w, http.StatusOK, map[string]string{"ARN": s.arn(secret.Name), "VersionId": fmt.Sprintf("v%d", len(secret.Versions))})
+	case "TagResource":
+		if s.denyTagging {
+			s.writeJSON(w, http.StatusBadRequest, map[string]string{"__type": "AccessDeniedException"})
+			return
+		}
+		for _, tag := range body.Tags {
+			secret.Tags[tag.Key] = tag.Value
+		}
+		s.writeJSON(w, http.StatusOK, map[string]string{})
+	default:
+		http.Error(w, "unexpected target "+target, http.StatusBadRequest)
+	}
+}
+
+func fakeServerForAwsSecretsManager(t *testing.T) (*secretsmanager.Client, *fakeAwsSecretsManagerServer) {
+	fakeServer := &fakeAwsSecretsManagerServer{
+		secrets: map[string]*fakeAwsSecret{
+			"tls-crt": {Name: "tls-crt", Tags: map[string]string{}, Versions: []string{"hoge"}},
+		},
+	}
+	srv := httptest.NewServer(fakeServer)
+	t.Cleanup(srv.Close)
+	client := secretsmanager.New(secretsmanager.Options{
+		Region:       "us-east-1",
+		BaseEndpoint: aws.String(srv.URL),
+		Credentials:  credentials.NewStaticCredentialsProvider("test", "test", ""),
+	})
+	return client, fakeServer
+}
+
+func TestAwsSecretsManager(t *testing.T) {
+	ctx := context.Background()
+	client, fs := fakeServerForAwsSecretsManager(t)
+	syncer := NewAwsSecretsManagerSyncer(client, "tls-crt", "tls-key", "alias/tls")
+	fetcher := NewAwsSecretsManagerFetcher(client, "tls-crt", "tls-key")
+
+	for i := 0; i < 2; i++ {
+		if err := syncer.Sync(ctx, []byte("cert"), []byte("key")); err != nil {
+			t.Fatalf("unexpected error in sync: %+v", err)
+		}
+	}
+	// tls-crt is put once and compared once before the fingerprint is recorded, and tls-key is created.
+	assert.Equal(t, 1, fs.putValueCount)
+	assert.Equal(t, 1, fs.getValueCount)
+	assert.Equal(t, []string{"alias/tls"}, fs.createdKmsKeys)
+	assert.Equal(t, managedByValue, fs.secrets["tls-key"].Tags[managedByLabel])
+	assert.Equal(t, "v2", fs.secrets["tls-crt"].Tags[awsVersionTag])
+
+	tlsCert, tlsKey, err := fetcher.Fetch(ctx)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []byte("cert"), tlsCert)
+		assert.Equal(t, []byte("key"), tlsKey)
+	}
+}
+
+func TestAwsSecretsManagerSyncerWithoutFingerprint(t *testing.T) {
+	ctx := context.Background()
+	client, fs := fakeServerForAwsSecretsManager(t)
+	fs.secrets["tls-crt"].Versions = []string{"cert"}
+	fs.secrets["tls-key"] = &fakeAwsSecret{Name: "tls-key", Tags: map[string]string{}, Versions: []string{"key"}}
+	syncer := NewAwsSecretsManagerSyncer(client, "tls-crt", "tls-key", "")
+	for i := 0; i < 2; i++ {
+		if err := syncer.Sync(ctx, []byte("cert"), []byte("key")); err != nil {
+			t.Fatalf("unexpected error in sync: %+v", err)
+		}
+	}
+	assert.Equal(t, 0, fs.putValueCount)
+	assert.Equal(t, 2, fs.getValueCount)
+	assert.Equal(t, "v1", fs.secrets["tls-key"].Tags[awsVersionTag])
+}
+
+func TestAwsSecretsManagerSyncerTaggingDenied(t *testing.T) {
+	ctx := context.Background()
+	client, fs := fakeServerForAwsSecretsManager(t)
+	fs.denyTagging = true
+	syncer := NewAwsSecretsManagerSyncer(client, "tls-crt", "tls-key", "")
+	for i := 0; i < 2; i++ {
+		if err := syncer.Sync(ctx, []byte("cert"), []byte("key")); err != nil {
+			t.Fatalf("unexpected error in sync: %+v", err)
+		}
+	}
+	// Values are compared on every sync instead of the fingerprint.
+	assert.Equal(t, 1, fs.putValueCount)
+	assert.Equal(t, 3, fs.getValueCount)
+	assert.Equal(t, []string{"hoge", "cert"}, fs.secrets["tls-crt"].Versions)
+	assert.Empty(t, fs.secrets["tls-crt"].Tags[awsVersionTag])
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/aws/aws-sdk-go-v2/service/ssm/types"
+)
+
+type AwsSsmParameterFetcher struct {
+	client   *ssm.Client
+	certName string
+	keyName  string
+}
+
+func NewAwsSsmParameterFetcher(client *ssm.Client, certName string, keyName string) *AwsSsmParameterFetcher {
+	return &AwsSsmParameterFetcher{
+		client:   client,
+		certName: certName,
+		keyName:  keyName,
+	}
+}
+
+func (f *AwsSsmParameterFetcher) Fetch(ctx context.Context) ([]byte, []byte, error) {
+	cp, err := f.client.GetParameter(ctx, &ssm.GetParameterInput{
+		Name:           aws.String(f.certName),
+		WithDecryption: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	kp, err := f.client.GetParameter(ctx, &ssm.GetParameterInput{
+		Name:           aws.String(f.keyName),
+		WithDecryption: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return []byte(aws.ToString(cp.Parameter.Value)), []byte(aws.ToString(kp.Parameter.Value)), nil
+}
+
+// AwsSsmParameterSyncer writes the certificate and the key to SecureString parameters of SSM Parameter Store.
+// Values are encrypted with kmsKeyId, or the AWS managed key if it is empty.
+// Without ssm:ListTagsForResource or ssm:AddTagsToResource, values are compared on every sync
+// instead of the recorded fingerprint.
+type AwsSsmParameterSyncer struct {
+	client   *ssm.Client
+	certName string
+	keyName  string
+	kmsKeyId string
+	// fingerprintDenied is set once reading or recording the fingerprint is denied.
+	fingerprintDenied bool
+}
+
+func NewAwsSsmParameterSyncer(client *ssm.Client, certName string, keyName string, kmsKeyId string) *AwsSsmParameterSyncer {
+	return &AwsSsmParameterSyncer{
+		client:   client,
+		certName: certName,
+		keyName:  keyName,
+		kmsKeyId: kmsKeyId,
+	}
+}
+
+func (s *AwsSsmParameterSyncer) Sync(ctx context.Context, tlsCert []byte, tlsKey []byte) error {
+	if err := s.reconcileParameter(ctx, s.certName, tlsCert); err != nil {
+		return err
+	}
+	if err := s.reconcileParameter(ctx, s.keyName, tlsKey); err != nil {
+		return err
+	}
+	return nil
+}
+
+// reconcileParameter puts a new version when data differs from the current one.
+// The fingerprint of the current version is recorded in the parameter tags so that
+// the value is only decrypted when that record is missing or stale.
+func (s *AwsSsmParameterSyncer) reconcileParameter(ctx context.Context, name string, data []byte) error {
+	fingerprint := fmt.Sprintf("%x", sha256.Sum256(data))
+
+	p, err := s.client.GetParameter(ctx, &ssm.GetParameterInput{
+		Name: aws.String(name),
+	})
+	var notFound *types.ParameterNotFound
+	if errors.As(err, &notFound) {
+		return s.putParameter(ctx, name, data, fingerprint, false)
+	} else if err != nil {
+		return fmt.Errorf("get parameter: %w", err)
+	}
+	currentVersion := strconv.FormatInt(p.Parameter.Version, 10)
+
+	tags := make(map[string]string)
+	if !s.fingerprintDenied {
+		res, err := s.client.ListTagsForResource(ctx, &ssm.ListTagsForResourceInput{
+			ResourceType: types.ResourceTypeForTaggingParameter,
+			ResourceId:   aws.String(name),
+		})
+		if isAwsAccessDenied(err) {
+			log.Printf("failed to read fingerprint of %s, comparing values instead: %v", name, err)
+			s.fingerprintDenied = true
+		} else if err != nil {
+			return fmt.Errorf("list tags for parameter: %w", err)
+		} else {
+			for _, tag := range res.TagList {
+				tags[aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+			}
+		}
+	}
+	if tags[awsVersionTag] == currentVersion && tags[awsFingerprintTag] != "" {
+		if tags[awsFingerprintTag] == fingerprint {
+			return nil
+		}
+	} else {
+		dp, err := s.client.GetParameter(ctx, &ssm.GetParameterInput{
+			Name:           aws.String(fmt.Sprintf("%s:%s", name, currentVersion)),
+			WithDecryption: aws.Bool(true),
+		})
+		if err != nil {
+			return fmt.Errorf("get parameter: %w", err)
+		}
+		if bytes.Equal([]byte(aws.ToString(dp.Parameter.Value)), data) {
+			return s.recordFingerprint(ctx, name, currentVersion, fingerprint)
+		}
+	}
+	return s.putParameter(ctx, name, data, fingerprint, true)
+}
+
+func (s *AwsSsmParameterSyncer) putParameter(ctx context.Context, name string, data []byte, fingerprint string, overwrite bool) error {
+	log.Printf("Start putting parameter \"%s\"", name)
+	input := &ssm.PutParameterInput{
+		Name:      aws.String(name),
+		Value:     aws.String(string(data)),
+		Type:      types.ParameterTypeSecureString,
+		Overwrite: aws.Bool(overwrite),
+	}
+	if s.kmsKeyId != "" {
+		input.KeyId = aws.String(s.kmsKeyId)
+	}
+	// Tags can only be specified on creation.
+	if !overwrite {
+		input.Tags = []types.Tag{
+			{Key: aws.String(managedByLabel), Value: aws.String(managedByValue)},
+		}
+	}
+	// Values larger than 4KB, such as long chains, need the advanced tier.
+	if len(data) > 4096 {
+		input.Tier = types.ParameterTierAdvanced
+	}
+	put, err := s.client.PutParameter(ctx, input)
+	if err != nil {
+		return fmt.Errorf("put parameter: %w", err)
+	}
+	log.Printf("Complete putting parameter \"%s\"", name)
+	return s.recordFingerprint(ctx, name, strconv.FormatInt(put.Version, 10), fingerprint)
+}
+
+func (s *AwsSsmParameterSyncer) recordFingerprint(ctx context.Context, name string, version string, fingerprint string) error {
+	if s.fingerprintDenied {
+		return nil
+	}
+	_, err := s.client.AddTagsToResource(ctx, &ssm.AddTagsToResourceInput{
+		ResourceType: types.ResourceTypeForTaggingParameter,
+		ResourceId:   aws.String(name),
+		Tags: []types.Tag{
+			{Key: aws.String(awsVersionTag), Value: aws.String(version)},
+			{Key: aws.String(awsFingerprintTag), Value: aws.String(fingerprint)},
+		},
+	})
+	if isAwsAccessDenied(err) {
+		log.Printf("failed to record fingerprint of %s, comparing values instead: %v", name, err)
+		s.fingerprintDenied = true
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("record fingerprint of %s: %w", name, err)
+	}
+	return nil
+}
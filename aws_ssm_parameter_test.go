@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeSsmParameter struct {
+	KeyId    string
+	Tier     string
+	Tags     map[string]string
+	Versions []string
+}
+
+type fakeSsmServer struct {
+	parameters   map[string]*fakeSsmParameter
+	decryptCount int
+	putCount     int
+	denyTagging  bool
+}
+
+func (s *fakeSsmServer) writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func (s *fakeSsmServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Name           string
+		Value          string
+		KeyId          string
+		Tier           string
+		Overwrite      bool
+		WithDecryption bool
+		ResourceId     string
+		Tags           []struct{ Key, Value string }
+	}
+	_ = json.NewDecoder(r.Body).Decode(&body)
+	name, selector, _ := strings.Cut(body.Name+body.ResourceId, ":")
+	parameter := s.parameters[name]
+	target := strings.TrimPrefix(r.Header.Get("X-Amz-Target"), "AmazonSSM.")
+	if parameter == nil && target != "PutParameter" {
+		s.writeJSON(w, http.StatusBadRequest, map[string]string{"__type": "ParameterNotFound"})
+		return
+	}
+	if s.denyTagging && (target == "ListTagsForResource" || target == "AddTagsToResource") {
+		s.writeJSON(w, http.StatusBadRequest, map[string]string{"__type": "AccessDeniedException"})
+		return
+	}
+	switch target {
+	case "GetParameter":
+		version := len(parameter.Versions)
+		if selector != "" {
+			version, _ = strconv.Atoi(selector)
+		}
+		value := "encrypted"
+		if body.WithDecryption {
+			s.decryptCount++
+			value = parameter.Versions[version-1]
+		}
+		s.writeJSON(w, http.StatusOK, map[string]interface{}{
+			"Parameter": map[string]interface{}{"Name": name, "Type": "SecureString", "Value": value, "Version": version},
+		})
+	case "PutParameter":
+		if parameter != nil && !body.Overwrite {
+			s.writeJSON(w, http.StatusBadRequest, map[string]string{"__type": "ParameterAlreadyExists"})
+			return
+		}
+		if parameter != nil && len(body.Tags) > 0 {
+			s.writeJSON(w, http.StatusBadRequest, map[string]string{"__type": "ValidationException"})
+			return
+		}
+		s.putCount++
+		if parameter == nil {
+			parameter = &fakeSsmParameter{Tags: make(map[string]string)}
+			s.parameters[name] = parameter
+		}
+		for _, tag := range body.Tags {
+			parameter.Tags[tag.Key] = tag.Value
+		}
+		parameter.KeyId = body.KeyId
+		parameter.Tier = body.Tier
+		parameter.Versions = append(parameter.Versions, body.Value)
+		s.writeJSON(w, http.StatusOK, map[string]interface{}{"Version": len(parameter.Versions)})
+	case "ListTagsForResource":
+		var tags []map[string]string
+		for k, v := range parameter.Tags {
+			tags = append(tags, map[string]string{"Key": k, "Value": v})
+		}
+		s.writeJSON(w, http.StatusOK, map[string]interface{}{"TagList": tags})
+	case "AddTagsToResource":
+		for _, tag := range body.Tags {
+			parameter.Tags[tag.Key] = tag.Value
+		}
+		s.writeJSON(w, http.StatusOK, map[string]string{})
+	default:
+		http.Error(w, "unexpected target "+target, http.StatusBadRequest)
+	}
+}
+
+func fakeServerForAwsSsm(t *testing.T) (*ssm.Client, *fakeSsmServer) {
+	fakeServer := &fakeSsmServer{
+		parameters: map[string]*fakeSsmParameter{
+			"/tls/crt": {Tags: map[string]string{}, Versions: []string{"hoge"}},
+		},
+	}
+	srv := httptest.NewServer(fakeServer)
+	t.Cleanup(srv.Close)
+	client := ssm.New(ssm.Options{
+		Region:       "us-east-1",
+		BaseEndpoint: aws.String(srv.URL),
+		Credentials:  credentials.NewStaticCredentialsProvider("test", "test", ""),
+	})
+	return client, fakeServer
+}
+
+func TestAwsSsmParameter(t *testing.T) {
+	ctx := context.Background()
+	client, fs := fakeServerForAwsSsm(t)
+	syncer := NewAwsSsmParameterSyncer(client, "/tls/crt", "/tls/key", "alias/tls")
+	fetcher := NewAwsSsmParameterFetcher(client, "/tls/crt", "/tls/key")
+
+	for i := 0; i < 2; i++ {
+		if err := syncer.Sync(ctx, []byte("cert"), []byte("key")); err != nil {
+			t.Fatalf("unexpected error in sync: %+v", err)
+		}
+	}
+	// /tls/crt is decrypted once before the fingerprint is recorded, and /tls/key is created.
+	assert.Equal(t, 2, fs.putCount)
+	assert.Equal(t, 1, fs.decryptCount)
+	assert.Equal(t, []string{"hoge", "cert"}, fs.parameters["/tls/crt"].Versions)
+	assert.Equal(t, "alias/tls", fs.parameters["/tls/key"].KeyId)
+	assert.Equal(t, managedByValue, fs.parameters["/tls/key"].Tags[managedByLabel])
+	assert.Equal(t, "2", fs.parameters["/tls/crt"].Tags[awsVersionTag])
+
+	tlsCert, tlsKey, err := fetcher.Fetch(ctx)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []byte("cert"), tlsCert)
+		assert.Equal(t, []byte("key"), tlsKey)
+	}
+}
+
+func TestAwsSsmParameterSyncerAdvancedTier(t *testing.T) {
+	ctx := context.Background()
+	client, fs := fakeServerForAwsSsm(t)
+	syncer := NewAwsSsmParameterSyncer(client, "/tls/crt", "/tls/key", "")
+	tlsCert := []byte(strings.Repeat("a", 5000))
+	if err := syncer.Sync(ctx, tlsCert, []byte("key")); err != nil {
+		t.Fatalf("unexpected error in sync: %+v", err)
+	}
+	assert.Equal(t, "Advanced", fs.parameters["/tls/crt"].Tier)
+	assert.Equal(t, "", fs.parameters["/tls/key"].Tier)
+}
+
+func TestAwsSsmParameterSyncerTaggingDenied(t *testing.T) {
+	ctx := context.Background()
+	client, fs := fakeServerForAwsSsm(t)
+	fs.denyTagging = true
+	syncer := NewAwsSsmParameterSyncer(client, "/tls/crt", "/tls/key", "")
+	for i := 0; i < 2; i++ {
+		if err := syncer.Sync(ctx, []byte("cert"), []byte("key")); err != nil {
+			t.Fatalf("unexpected error in sync: %+v", err)
+		}
+	}
+	// Values are decrypted on every sync instead of comparing the fingerprint.
+	assert.Equal(t, 2, fs.putCount)
+	assert.Equal(t, 3, fs.decryptCount)
+	assert.Equal(t, []string{"hoge", "cert"}, fs.parameters["/tls/crt"].Versions)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/security/keyvault/azcertificates"
+	"github.com/Azure/azure-sdk-for-go/sdk/security/keyvault/azsecrets"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+const (
+	azureKeyVaultPKCS12ContentType = "application/x-pkcs12"
+	azureKeyVaultPEMContentType    = "application/x-pem-file"
+)
+
+// AzureKeyVaultSyncer imports the certificate and the key to a Key Vault certificate as PFX.
+// A new version is imported only when the thumbprint of the current version differs.
+type AzureKeyVaultSyncer struct {
+	client          *azcertificates.Client
+	certificateName string
+}
+
+func NewAzureKeyVaultSyncer(client *azcertificates.Client, certificateName string) *AzureKeyVaultSyncer {
+	return &AzureKeyVaultSyncer{
+		client:          client,
+		certificateName: certificateName,
+	}
+}
+
+func (s *AzureKeyVaultSyncer) Sync(ctx context.Context, tlsCert []byte, tlsKey []byte) error {
+	leaf, err := parseLeafCertificate(tlsCert)
+	if err != nil {
+		return fmt.Errorf("parse certificate: %w", err)
+	}
+	thumbprint := sha1.Sum(leaf.Raw)
+
+	current, err := s.client.GetCertificate(ctx, s.certificateName, "", nil)
+	var respErr *azcore.ResponseError
+	if errors.As(err, &respErr) && respErr.StatusCode == http.StatusNotFound {
+		log.Printf("Key Vault certificate \"%s\" is not found", s.certificateName)
+	} else if err != nil {
+		return fmt.Errorf("get key vault certificate: %w", err)
+	} else if bytes.Equal(current.X509Thumbprint, thumbprint[:]) {
+		return nil
+	}
+
+	pfx, err := encodePFX(tlsCert, tlsKey)
+	if err != nil {
+		return err
+	}
+	log.Printf("Start importing key vault certificate \"%s\"", s.certificateName)
+	_, err = s.client.ImportCertificate(ctx, s.certificateName, azcertificates.ImportCertificateParameters{
+		Base64EncodedCertificate: to.Ptr(base64.StdEncoding.EncodeToString(pfx)),
+		CertificatePolicy: &azcertificates.CertificatePolicy{
+			SecretProperties: &azcertificates.SecretProperties{
+				ContentType: to.Ptr(azureKeyVaultPKCS12ContentType),
+			},
+		},
+		Tags: map[string]*string{
+			managedByLabel: to.Ptr(managedByValue),
+		},
+	}, nil)
+	if err != nil {
+		return fmt.Errorf("import key vault certificate: %w", err)
+	}
+	log.Printf("Complete importing key vault certificate \"%s\"", s.certificateName)
+	return nil
+}
+
+// AzureKeyVaultFetcher exports the certificate and the key of a Key Vault certificate
+// through the secret backing it, which holds either PFX or PEM.
+type AzureKeyVaultFetcher struct {
+	client          *azsecrets.Client
+	certificateName string
+}
+
+func NewAzureKeyVaultFetcher(client *azsecrets.Client, certificateName string) *AzureKeyVaultFetcher {
+	return &AzureKeyVaultFetcher{
+		client:          client,
+		certificateName: certificateName,
+	}
+}
+
+func (f *AzureKeyVaultFetcher) Fetch(ctx context.Context) ([]byte, []byte, error) {
+	secret, err := f.client.GetSecret(ctx, f.certificateName, "", nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("get key vault secret: %w", err)
+	}
+	if secret.Value == nil {
+		return nil, nil, fmt.Errorf("key vault secret %s has no value", f.certificateName)
+	}
+	if secret.ContentType != nil && *secret.ContentType == azureKeyVaultPEMContentType {
+		return splitCombinedPEM([]byte(*secret.Value))
+	}
+	pfx, err := base64.StdEncoding.DecodeString(*secret.Value)
+	if err != nil {
+		return nil, nil, fmt.Errorf("decode key vault secret: %w", err)
+	}
+	return decodePFX(pfx)
+}
+
+// encodePFX encodes PEM certificates and a private key into PFX without password.
+// 3DES is used as older consumers of Key Vault certificates cannot read AES encrypted PFX.
+func encodePFX(tlsCert []byte, tlsKey []byte) ([]byte, error) {
+	var certs []*x509.Certificate
+	for block, rest := pem.Decode(tlsCert); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("parse certificate: %w", err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificate found")
+	}
+	key, err := parsePrivateKey(tlsKey)
+	if err != nil {
+		return nil, err
+	}
+	pfx, err := pkcs12.LegacyDES.Encode(key, certs[0], certs[1:], "")
+	if err != nil {
+		return nil, fmt.Errorf("encode pfx: %w", err)
+	}
+	return pfx, nil
+}
+
+// decodePFX decodes PFX without password into PEM certificates and a PKCS #8 private key.
+func decodePFX(pfx []byte) ([]byte, []byte, error) {
+	key, cert, caCerts, err := pkcs12.DecodeChain(pfx, "")
+	if err != nil {
+		return nil, nil, fmt.Errorf("decode pfx: %w", err)
+	}
+	tlsCert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	for _, c := range caCerts {
+		tlsCert = append(tlsCert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Raw})...)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("marshal private key: %w", err)
+	}
+	return tlsCert, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// parsePrivateKey parses a PEM private key in PKCS #8, PKCS #1 or SEC 1.
+func parsePrivateKey(tlsKey []byte) (crypto.PrivateKey, error) {
+	block, _ := pem.Decode(tlsKey)
+	if block == nil {
+		return nil, fmt.Errorf("no private key found")
+	}
+	switch block.Type {
+	case "PRIVATE KEY":
+		return x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	return nil, fmt.Errorf("unsupported private key type: %s", block.Type)
+}
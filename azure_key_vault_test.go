@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/security/keyvault/azcertificates"
+	"github.com/Azure/azure-sdk-for-go/sdk/security/keyvault/azsecrets"
+	"github.com/stretchr/testify/assert"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+type fakeAzureCredential struct{}
+
+func (fakeAzureCredential) GetToken(_ context.Context, _ policy.TokenRequestOptions) (azcore.AccessToken, error) {
+	return azcore.AccessToken{Token: "test-token", ExpiresOn: time.Now().Add(time.Hour)}, nil
+}
+
+type fakeKeyVaultCertificate struct {
+	Versions    []string
+	Thumbprint  []byte
+	ContentType string
+	Tags        map[string]string
+}
+
+type fakeKeyVaultServer struct {
+	url          string
+	certificates map[string]*fakeKeyVaultCertificate
+	importCount  int
+}
+
+func (s *fakeKeyVaultServer) writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func (s *fakeKeyVaultServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Key Vault answers a request without token with the challenge telling where to get one.
+	if r.Header.Get("Authorization") != "Bearer test-token" {
+		w.Header().Set("WWW-Authenticate", `Bearer authorization="https://login.microsoftonline.com/test-tenant", resource="https://vault.azure.net"`)
+		s.writeJSON(w, http.StatusUnauthorized, map[string]interface{}{"error": map[string]string{"code": "Unauthorized"}})
+		return
+	}
+	// /{collection}/{name}/{version or method}
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) < 2 {
+		http.Error(w, "unexpected path "+r.URL.Path, http.StatusBadRequest)
+		return
+	}
+	collection, name := parts[0], parts[1]
+	if collection == "certificates" && len(parts) == 3 && parts[2] == "import" && r.Method == http.MethodPost {
+		var body struct {
+			Value  string            `json:"value"`
+			Tags   map[string]string `json:"tags"`
+			Policy struct {
+				SecretProps struct {
+					ContentType string `json:"contentType"`
+				} `json:"secret_props"`
+			} `json:"policy"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		pfx, err := base64.StdEncoding.DecodeString(body.Value)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		_, cert, _, err := pkcs12.DecodeChain(pfx, "")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.importCount++
+		c, ok := s.certificates[name]
+		if !ok {
+			c = &fakeKeyVaultCertificate{}
+			s.certificates[name] = c
+		}
+		thumbprint := sha1.Sum(cert.Raw)
+		c.Versions = append(c.Versions, body.Value)
+		c.Thumbprint = thumbprint[:]
+		c.ContentType = body.Policy.SecretProps.ContentType
+		c.Tags = body.Tags
+		s.writeCertificate(w, name, c)
+		return
+	}
+	c, ok := s.certificates[name]
+	if !ok || r.Method != http.MethodGet {
+		s.writeJSON(w, http.StatusNotFound, map[string]interface{}{"error": map[string]string{"code": "CertificateNotFound", "message": "not found"}})
+		return
+	}
+	switch collection {
+	case "certificates":
+		s.writeCertificate(w, name, c)
+	case "secrets":
+		s.writeJSON(w, http.StatusOK, map[string]interface{}{
+			"id":          fmt.Sprintf("%s/secrets/%s/%d", s.url, name, len(c.Versions)),
+			"value":       c.Versions[len(c.Versions)-1],
+			"contentType": c.ContentType,
+		})
+	default:
+		http.Error(w, "unexpected path "+r.URL.Path, http.StatusBadRequest)
+	}
+}
+
+func (s *fakeKeyVaultServer) writeCertificate(w http.ResponseWriter, name string, c *fakeKeyVaultCertificate) {
+	s.writeJSON(w, http.StatusOK, map[string]interface{}{
+		"id":   fmt.Sprintf("%s/certificates/%s/%d", s.url, name, len(c.Versions)),
+		"x5t":  base64.RawURLEncoding.EncodeToString(c.Thumbprint),
+		"tags": c.Tags,
+	})
+}
+
+func fakeServerForAzureKeyVault(t *testing.T) (*azcertificates.Client, *azsecrets.Client, *fakeKeyVaultServer) {
+	fakeServer := &fakeKeyVaultServer{
+		certificates: make(map[string]*fakeKeyVaultCertificate),
+	}
+	// The challenge policy of Key Vault clients always requires https.
+	srv := httptest.NewTLSServer(fakeServer)
+	t.Cleanup(srv.Close)
+	fakeServer.url = srv.URL
+	clientOptions := azcore.ClientOptions{Transport: srv.Client()}
+	certificates, err := azcertificates.NewClient(srv.URL, fakeAzureCredential{}, &azcertificates.ClientOptions{
+		ClientOptions:                        clientOptions,
+		DisableChallengeResourceVerification: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	secrets, err := azsecrets.NewClient(srv.URL, fakeAzureCredential{}, &azsecrets.ClientOptions{
+		ClientOptions:                        clientOptions,
+		DisableChallengeResourceVerification: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certificates, secrets, fakeServer
+}
+
+func TestAzureKeyVault(t *testing.T) {
+	ctx := context.Background()
+	certificates, secrets, fs := fakeServerForAzureKeyVault(t)
+	syncer := NewAzureKeyVaultSyncer(certificates, "test-cert")
+	fetcher := NewAzureKeyVaultFetcher(secrets, "test-cert")
+	leaf, tlsKey := newTestCertificate(t, "*.example.com", time.Now().Add(time.Hour))
+	intermediate, _ := newTestCertificate(t, "Test CA", time.Now().Add(time.Hour))
+	tlsCert := append(append([]byte{}, leaf...), intermediate...)
+
+	for i := 0; i < 2; i++ {
+		if err := syncer.Sync(ctx, tlsCert, tlsKey); err != nil {
+			t.Fatalf("unexpected error in sync: %+v", err)
+		}
+	}
+	assert.Equal(t, 1, fs.importCount)
+	assert.Equal(t, azureKeyVaultPKCS12ContentType, fs.certificates["test-cert"].ContentType)
+	assert.Equal(t, map[string]string{managedByLabel: managedByValue}, fs.certificates["test-cert"].Tags)
+
+	exportedCert, exportedKey, err := fetcher.Fetch(ctx)
+	if assert.NoError(t, err) {
+		assert.Equal(t, tlsCert, exportedCert)
+		assert.Equal(t, tlsKey, exportedKey)
+	}
+
+	renewed, renewedKey := newTestCertificate(t, "*.example.com", time.Now().Add(2*time.Hour))
+	if err := syncer.Sync(ctx, renewed, renewedKey); err != nil {
+		t.Fatalf("unexpected error in sync: %+v", err)
+	}
+	assert.Equal(t, 2, fs.importCount)
+	assert.Len(t, fs.certificates["test-cert"].Versions, 2)
+}
+
+func TestAzureKeyVaultFetcherPEM(t *testing.T) {
+	ctx := context.Background()
+	_, secrets, fs := fakeServerForAzureKeyVault(t)
+	tlsCert, tlsKey := newTestCertificate(t, "*.example.com", time.Now().Add(time.Hour))
+	fs.certificates["test-cert"] = &fakeKeyVaultCertificate{
+		Versions:    []string{string(tlsKey) + string(tlsCert)},
+		ContentType: azureKeyVaultPEMContentType,
+	}
+	exportedCert, exportedKey, err := NewAzureKeyVaultFetcher(secrets, "test-cert").Fetch(ctx)
+	if assert.NoError(t, err) {
+		assert.Equal(t, tlsCert, exportedCert)
+		assert.Equal(t, tlsKey, exportedKey)
+	}
+}
@@ -1,154 +1,453 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"crypto/sha256"
+	"encoding/pem"
 	"fmt"
 	"log"
+	"path"
+	"strconv"
+	"strings"
+	"time"
 
 	certificatemanager "cloud.google.com/go/certificatemanager/apiv1"
 	"cloud.google.com/go/certificatemanager/apiv1/certificatemanagerpb"
+	"google.golang.org/api/iterator"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/types/known/fieldmaskpb"
 )
 
+const (
+	managedByLabel = "managed-by"
+	managedByValue = "tls-secrets-sync"
+	// certificateSupersededAtLabel records the unix time when a certificate was detached from the map entry.
+	certificateSupersededAtLabel = "tls-secrets-sync-superseded-at"
+	// certificateNameHashLength is the number of sha256 bytes in certificate names.
+	// Certificate IDs are limited to 63 characters, so the full hash does not fit with the prefix.
+	certificateNameHashLength    = 12
+	maxCertificateNameCollisions = 10
+	// maxCertificateNamePrefixLength leaves room for the hex hash and a collision suffix such as "-9".
+	maxCertificateNamePrefixLength = 63 - 2*certificateNameHashLength - 2
+)
+
+// OrphanPolicy decides what to do with managed certificates that are no longer referenced,
+// e.g. created by a Sync that failed before attaching them.
+type OrphanPolicy string
+
+const (
+	OrphanPolicyKeep   OrphanPolicy = "keep"
+	OrphanPolicyDryRun OrphanPolicy = "dry-run"
+	OrphanPolicyDelete OrphanPolicy = "delete"
+)
+
+func ParseOrphanPolicy(value string) (OrphanPolicy, error) {
+	switch p := OrphanPolicy(value); p {
+	case OrphanPolicyKeep, OrphanPolicyDryRun, OrphanPolicyDelete:
+		return p, nil
+	}
+	return "", fmt.Errorf("invalid orphan policy: %s", value)
+}
+
+// CertificateManagerMapEntry is a certificate map entry pointing at the synced certificate.
+// Either HostName or Primary must be set.
+type CertificateManagerMapEntry struct {
+	CertificateMap string
+	Name           string
+	HostName       string
+	Primary        bool
+}
+
+// ParseCertificateManagerMapEntry parses an entry such as
+// "map=my-map,entry=wildcard,hostname=*.example.com" or "map=my-map,entry=primary,matcher=primary".
+func ParseCertificateManagerMapEntry(value string) (CertificateManagerMapEntry, error) {
+	var entry CertificateManagerMapEntry
+	for _, field := range strings.Split(value, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(field), "=")
+		if !ok {
+			return entry, fmt.Errorf("invalid certificate map entry %q: %q is not key=value", value, field)
+		}
+		switch k {
+		case "map":
+			entry.CertificateMap = v
+		case "entry":
+			entry.Name = v
+		case "hostname":
+			entry.HostName = v
+		case "matcher":
+			if v != "primary" {
+				return entry, fmt.Errorf("invalid certificate map entry %q: unknown matcher %q", value, v)
+			}
+			entry.Primary = true
+		default:
+			return entry, fmt.Errorf("invalid certificate map entry %q: unknown key %q", value, k)
+		}
+	}
+	if entry.CertificateMap == "" {
+		return entry, fmt.Errorf("invalid certificate map entry %q: map is required", value)
+	}
+	if entry.Name == "" {
+		return entry, fmt.Errorf("invalid certificate map entry %q: entry is required", value)
+	}
+	if (entry.HostName == "") == !entry.Primary {
+		return entry, fmt.Errorf("invalid certificate map entry %q: either hostname or matcher=primary is required", value)
+	}
+	return entry, nil
+}
+
 type CertificateManagerSyncer struct {
-	client                  *certificatemanager.Client
-	projectId               string
-	location                string
-	certificateNamePrefix   string
-	certificateMapName      string
-	certificateMapEntryName string
-	hostName                string
+	client                *certificatemanager.Client
+	projectId             string
+	location              string
+	certificateNamePrefix string
+	mapEntries            []CertificateManagerMapEntry
+	deleteGracePeriod     time.Duration
+	orphanPolicy          OrphanPolicy
+	now                   func() time.Time
 }
 
-func NewCertificateManagerSyncer(client *certificatemanager.Client, hostName string, projectId string, location string, certificateNamePrefix string, certificateMapName string, certificateMapEntryName string) Syncer {
+// NewCertificateManagerSyncer creates a syncer for Certificate Manager.
+// Certificates detached from the map entries are deleted after deleteGracePeriod,
+// and unreferenced certificates labeled as ours are handled by orphanPolicy.
+func NewCertificateManagerSyncer(client *certificatemanager.Client, projectId string, location string, certificateNamePrefix string, mapEntries []CertificateManagerMapEntry, deleteGracePeriod time.Duration, orphanPolicy OrphanPolicy) Syncer {
 	return &CertificateManagerSyncer{
-		client:                  client,
-		hostName:                hostName,
-		projectId:               projectId,
-		location:                location,
-		certificateNamePrefix:   certificateNamePrefix,
-		certificateMapName:      certificateMapName,
-		certificateMapEntryName: certificateMapEntryName,
+		client:                client,
+		projectId:             projectId,
+		location:              location,
+		certificateNamePrefix: certificateNamePrefix,
+		mapEntries:            mapEntries,
+		deleteGracePeriod:     deleteGracePeriod,
+		orphanPolicy:          orphanPolicy,
+		now:                   time.Now,
 	}
 }
 
 func (c *CertificateManagerSyncer) Sync(ctx context.Context, tlsCert []byte, tlsKey []byte) error {
-	certificateNameHash := sha256.Sum256(tlsCert)
-	certificateName := fmt.Sprintf("%s%x", c.certificateNamePrefix, certificateNameHash[:4])
-	certificateFullName := fmt.Sprintf("projects/%s/locations/%s/certificates/%s", c.projectId, c.location, certificateName)
+	certificateFullName, err := c.ensureCertificate(ctx, tlsCert, tlsKey)
+	if err != nil {
+		return err
+	}
 
-	_, err := c.client.GetCertificate(ctx, &certificatemanagerpb.GetCertificateRequest{
-		Name: certificateFullName,
-	})
-	createNewCertificate := false
-	if err != nil && status.Code(err) == codes.NotFound {
-		createNewCertificate = true
-	} else if err != nil {
-		return fmt.Errorf("get certificate: %w", err)
+	// Attach to certificate map entries
+	var removeCertificates []string
+	seen := map[string]bool{certificateFullName: true}
+	for _, entry := range c.mapEntries {
+		detached, err := c.reconcileMapEntry(ctx, entry, certificateFullName)
+		if err != nil {
+			return err
+		}
+		for _, certificate := range detached {
+			if !seen[certificate] {
+				seen[certificate] = true
+				removeCertificates = append(removeCertificates, certificate)
+			}
+		}
 	}
-	if createNewCertificate {
-		log.Printf("Start creating certificate \"%s\"", certificateName)
-		op, err := c.client.CreateCertificate(ctx, &certificatemanagerpb.CreateCertificateRequest{
-			Parent:        fmt.Sprintf("projects/%s/locations/%s", c.projectId, c.location),
-			CertificateId: certificateName,
-			Certificate: &certificatemanagerpb.Certificate{
-				Name: certificateName,
-				Labels: map[string]string{
-					"managed-by": "tls-secrets-sync",
-				},
-				Type: &certificatemanagerpb.Certificate_SelfManaged{
-					SelfManaged: &certificatemanagerpb.Certificate_SelfManagedCertificate{
-						PemCertificate: string(tlsCert),
-						PemPrivateKey:  string(tlsKey),
-					},
+	for _, certificate := range removeCertificates {
+		if c.deleteGracePeriod > 0 {
+			if err := c.markSuperseded(ctx, certificate); err != nil {
+				return err
+			}
+		} else if err := c.deleteCertificate(ctx, certificate); err != nil {
+			return err
+		}
+	}
+	if c.deleteGracePeriod > 0 || c.orphanPolicy != OrphanPolicyKeep {
+		referenced, err := c.referencedCertificates(ctx)
+		if err != nil {
+			return err
+		}
+		referenced[certificateFullName] = true
+		if err := c.cleanupCertificates(ctx, referenced); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ensureCertificate returns the full name of a certificate whose content equals tlsCert, creating it if needed.
+// The name is derived from the hash of tlsCert, and a numbered suffix is added when a certificate
+// with the same name but different content already exists.
+func (c *CertificateManagerSyncer) ensureCertificate(ctx context.Context, tlsCert []byte, tlsKey []byte) (string, error) {
+	certificateNameHash := sha256.Sum256(tlsCert)
+	baseName := fmt.Sprintf("%s%x", c.certificateNamePrefix, certificateNameHash[:certificateNameHashLength])
+	for i := 0; i < maxCertificateNameCollisions; i++ {
+		certificateName := baseName
+		if i > 0 {
+			certificateName = fmt.Sprintf("%s-%d", baseName, i)
+		}
+		certificateFullName := fmt.Sprintf("projects/%s/locations/%s/certificates/%s", c.projectId, c.location, certificateName)
+		cert, err := c.client.GetCertificate(ctx, &certificatemanagerpb.GetCertificateRequest{
+			Name: certificateFullName,
+		})
+		if err != nil && status.Code(err) == codes.NotFound {
+			if err := c.createCertificate(ctx, certificateName, tlsCert, tlsKey); err != nil {
+				return "", err
+			}
+			return certificateFullName, nil
+		} else if err != nil {
+			return "", fmt.Errorf("get certificate: %w", err)
+		}
+		if samePEMCertificates([]byte(cert.PemCertificate), tlsCert) {
+			return certificateFullName, nil
+		}
+		log.Printf("Certificate \"%s\" already exists with different content", certificateName)
+	}
+	return "", fmt.Errorf("too many certificates with different content named %s", baseName)
+}
+
+func (c *CertificateManagerSyncer) createCertificate(ctx context.Context, certificateName string, tlsCert []byte, tlsKey []byte) error {
+	log.Printf("Start creating certificate \"%s\"", certificateName)
+	op, err := c.client.CreateCertificate(ctx, &certificatemanagerpb.CreateCertificateRequest{
+		Parent:        fmt.Sprintf("projects/%s/locations/%s", c.projectId, c.location),
+		CertificateId: certificateName,
+		Certificate: &certificatemanagerpb.Certificate{
+			Name: certificateName,
+			Labels: map[string]string{
+				managedByLabel: managedByValue,
+			},
+			Type: &certificatemanagerpb.Certificate_SelfManaged{
+				SelfManaged: &certificatemanagerpb.Certificate_SelfManagedCertificate{
+					PemCertificate: string(tlsCert),
+					PemPrivateKey:  string(tlsKey),
 				},
 			},
-		})
-		if err != nil {
-			return fmt.Errorf("create certificate: %w", err)
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("create certificate: %w", err)
+	}
+	_, err = op.Wait(ctx)
+	if err != nil {
+		return fmt.Errorf("wait for certificate creation: %w", err)
+	}
+	log.Printf("Complete creating certificate \"%s\"", certificateName)
+	return nil
+}
+
+// samePEMCertificates reports whether a and b contain the same certificates, ignoring PEM formatting.
+func samePEMCertificates(a []byte, b []byte) bool {
+	var blocksA, blocksB [][]byte
+	for block, rest := pem.Decode(a); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type == "CERTIFICATE" {
+			blocksA = append(blocksA, block.Bytes)
 		}
-		_, err = op.Wait(ctx)
-		if err != nil {
-			return fmt.Errorf("wait for certificate creation: %w", err)
+	}
+	for block, rest := pem.Decode(b); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type == "CERTIFICATE" {
+			blocksB = append(blocksB, block.Bytes)
+		}
+	}
+	if len(blocksA) == 0 || len(blocksA) != len(blocksB) {
+		return false
+	}
+	for i := range blocksA {
+		if !bytes.Equal(blocksA[i], blocksB[i]) {
+			return false
 		}
-		log.Printf("Complete creating certificate \"%s\"", certificateName)
 	}
-	// Attach to certificate map entry
+	return true
+}
+
+// reconcileMapEntry points the map entry at certificateFullName and returns the certificates detached from it.
+func (c *CertificateManagerSyncer) reconcileMapEntry(ctx context.Context, entry CertificateManagerMapEntry, certificateFullName string) ([]string, error) {
 	mapEntry, err := c.client.GetCertificateMapEntry(ctx, &certificatemanagerpb.GetCertificateMapEntryRequest{
-		Name: fmt.Sprintf("projects/%s/locations/%s/certificateMaps/%s/certificateMapEntries/%s", c.projectId, c.location, c.certificateMapName, c.certificateMapEntryName),
+		Name: fmt.Sprintf("projects/%s/locations/%s/certificateMaps/%s/certificateMapEntries/%s", c.projectId, c.location, entry.CertificateMap, entry.Name),
 	})
 	createNewMapEntry := false
 	if err != nil && status.Code(err) == codes.NotFound {
 		createNewMapEntry = true
 	} else if err != nil {
-		return fmt.Errorf("get certificate map entry: %w", err)
+		return nil, fmt.Errorf("get certificate map entry: %w", err)
 	}
 	if createNewMapEntry {
-		log.Printf("Start creating certificate map entry \"%s\"", c.certificateMapEntryName)
-		op, err := c.client.CreateCertificateMapEntry(ctx, &certificatemanagerpb.CreateCertificateMapEntryRequest{
-			Parent:                fmt.Sprintf("projects/%s/locations/%s/certificateMaps/%s", c.projectId, c.location, c.certificateMapName),
-			CertificateMapEntryId: c.certificateMapEntryName,
-			CertificateMapEntry: &certificatemanagerpb.CertificateMapEntry{
-				Name: c.certificateMapEntryName,
-				Labels: map[string]string{
-					"managed-by": "tls-secrets-sync",
-				},
-				Certificates: []string{certificateFullName},
-				Match: &certificatemanagerpb.CertificateMapEntry_Hostname{
-					Hostname: c.hostName,
-				},
+		log.Printf("Start creating certificate map entry \"%s\"", entry.Name)
+		newMapEntry := &certificatemanagerpb.CertificateMapEntry{
+			Name: entry.Name,
+			Labels: map[string]string{
+				managedByLabel: managedByValue,
 			},
+			Certificates: []string{certificateFullName},
+		}
+		if entry.Primary {
+			newMapEntry.Match = &certificatemanagerpb.CertificateMapEntry_Matcher_{
+				Matcher: certificatemanagerpb.CertificateMapEntry_PRIMARY,
+			}
+		} else {
+			newMapEntry.Match = &certificatemanagerpb.CertificateMapEntry_Hostname{
+				Hostname: entry.HostName,
+			}
+		}
+		op, err := c.client.CreateCertificateMapEntry(ctx, &certificatemanagerpb.CreateCertificateMapEntryRequest{
+			Parent:                fmt.Sprintf("projects/%s/locations/%s/certificateMaps/%s", c.projectId, c.location, entry.CertificateMap),
+			CertificateMapEntryId: entry.Name,
+			CertificateMapEntry:   newMapEntry,
 		})
 		if err != nil {
-			return fmt.Errorf("create certificate map entry: %w", err)
+			return nil, fmt.Errorf("create certificate map entry: %w", err)
 		}
 		_, err = op.Wait(ctx)
 		if err != nil {
-			return fmt.Errorf("wait for certificate map creation: %w", err)
-		}
-		log.Printf("Complete creating certificate map entry \"%s\"", c.certificateMapEntryName)
-	} else {
-		updateCertificate := true
-		var removeCertificates []string
-		if len(mapEntry.Certificates) != 1 || mapEntry.Certificates[0] != certificateFullName {
-			updateCertificate = true
-			removeCertificates = mapEntry.Certificates
-			mapEntry.Certificates = []string{certificateFullName}
-		}
-		if updateCertificate {
-			log.Printf("Start updating certificate map entry \"%s\"", c.certificateMapEntryName)
-			op, err := c.client.UpdateCertificateMapEntry(ctx, &certificatemanagerpb.UpdateCertificateMapEntryRequest{
-				CertificateMapEntry: mapEntry,
-				UpdateMask: &fieldmaskpb.FieldMask{
-					Paths: []string{"certificates"},
-				},
-			})
-			if err != nil {
-				return fmt.Errorf("update certificate map entry: %w", err)
+			return nil, fmt.Errorf("wait for certificate map creation: %w", err)
+		}
+		log.Printf("Complete creating certificate map entry \"%s\"", entry.Name)
+		return nil, nil
+	}
+
+	if len(mapEntry.Certificates) == 1 && mapEntry.Certificates[0] == certificateFullName {
+		return nil, nil
+	}
+	removeCertificates := mapEntry.Certificates
+	mapEntry.Certificates = []string{certificateFullName}
+	log.Printf("Start updating certificate map entry \"%s\"", entry.Name)
+	op, err := c.client.UpdateCertificateMapEntry(ctx, &certificatemanagerpb.UpdateCertificateMapEntryRequest{
+		CertificateMapEntry: mapEntry,
+		UpdateMask: &fieldmaskpb.FieldMask{
+			Paths: []string{"certificates"},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("update certificate map entry: %w", err)
+	}
+	_, err = op.Wait(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("wait for certificate map entry update: %w", err)
+	}
+	log.Printf("Complete updating certificate map entry \"%s\"", entry.Name)
+	return removeCertificates, nil
+}
+
+func (c *CertificateManagerSyncer) deleteCertificate(ctx context.Context, certificate string) error {
+	log.Printf("Start deleting certificate \"%s\"", certificate)
+	op, err := c.client.DeleteCertificate(ctx, &certificatemanagerpb.DeleteCertificateRequest{
+		Name: certificate,
+	})
+	if err != nil {
+		return fmt.Errorf("delete certificate: %w", err)
+	}
+	err = op.Wait(ctx)
+	if err != nil {
+		return fmt.Errorf("wait for certificate deletion: %w", err)
+	}
+	log.Printf("Complete deleting certificate \"%s\"", certificate)
+	return nil
+}
+
+// markSuperseded labels the certificate with the current time, so that a later Sync deletes it after the grace period.
+func (c *CertificateManagerSyncer) markSuperseded(ctx context.Context, certificate string) error {
+	cert, err := c.client.GetCertificate(ctx, &certificatemanagerpb.GetCertificateRequest{
+		Name: certificate,
+	})
+	if err != nil {
+		return fmt.Errorf("get certificate: %w", err)
+	}
+	labels := make(map[string]string, len(cert.Labels)+1)
+	for k, v := range cert.Labels {
+		labels[k] = v
+	}
+	labels[certificateSupersededAtLabel] = strconv.FormatInt(c.now().Unix(), 10)
+	log.Printf("Mark certificate \"%s\" as superseded", certificate)
+	op, err := c.client.UpdateCertificate(ctx, &certificatemanagerpb.UpdateCertificateRequest{
+		Certificate: &certificatemanagerpb.Certificate{
+			Name:   certificate,
+			Labels: labels,
+		},
+		UpdateMask: &fieldmaskpb.FieldMask{
+			Paths: []string{"labels"},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("update certificate: %w", err)
+	}
+	_, err = op.Wait(ctx)
+	if err != nil {
+		return fmt.Errorf("wait for certificate update: %w", err)
+	}
+	return nil
+}
+
+// referencedCertificates returns certificates referenced by any map entry in the location,
+// so that certificates of other syncers sharing the prefix are never treated as orphans.
+func (c *CertificateManagerSyncer) referencedCertificates(ctx context.Context) (map[string]bool, error) {
+	referenced := make(map[string]bool)
+	maps := c.client.ListCertificateMaps(ctx, &certificatemanagerpb.ListCertificateMapsRequest{
+		Parent: fmt.Sprintf("projects/%s/locations/%s", c.projectId, c.location),
+	})
+	for {
+		certificateMap, err := maps.Next()
+		if err == iterator.Done {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("list certificate maps: %w", err)
+		}
+		entries := c.client.ListCertificateMapEntries(ctx, &certificatemanagerpb.ListCertificateMapEntriesRequest{
+			Parent: certificateMap.Name,
+		})
+		for {
+			entry, err := entries.Next()
+			if err == iterator.Done {
+				break
+			} else if err != nil {
+				return nil, fmt.Errorf("list certificate map entries: %w", err)
 			}
-			_, err = op.Wait(ctx)
-			if err != nil {
-				return fmt.Errorf("wait for certificate map entry update: %w", err)
+			for _, certificate := range entry.Certificates {
+				referenced[certificate] = true
 			}
-			log.Printf("Complete updating certificate map entry \"%s\"", c.certificateMapEntryName)
 		}
+	}
+	return referenced, nil
+}
 
-		for _, certificate := range removeCertificates {
-			log.Printf("Start deleting certificate \"%s\"", certificate)
-			op, err := c.client.DeleteCertificate(ctx, &certificatemanagerpb.DeleteCertificateRequest{
-				Name: certificate,
-			})
+// cleanupCertificates deletes superseded certificates whose grace period has elapsed and orphaned certificates,
+// among certificates with the name prefix and the managed-by label.
+// Certificates referenced by map entries are kept even if they were superseded before.
+// Orphaned certificates are marked as superseded first when the grace period is set,
+// e.g. when marking failed after the map entry was switched.
+func (c *CertificateManagerSyncer) cleanupCertificates(ctx context.Context, referenced map[string]bool) error {
+	it := c.client.ListCertificates(ctx, &certificatemanagerpb.ListCertificatesRequest{
+		Parent: fmt.Sprintf("projects/%s/locations/%s", c.projectId, c.location),
+	})
+	for {
+		cert, err := it.Next()
+		if err == iterator.Done {
+			break
+		} else if err != nil {
+			return fmt.Errorf("list certificates: %w", err)
+		}
+		if referenced[cert.Name] || !strings.HasPrefix(path.Base(cert.Name), c.certificateNamePrefix) ||
+			cert.Labels[managedByLabel] != managedByValue {
+			continue
+		}
+		if supersededAt, ok := cert.Labels[certificateSupersededAtLabel]; ok {
+			unix, err := strconv.ParseInt(supersededAt, 10, 64)
 			if err != nil {
-				return fmt.Errorf("delete certificate: %w", err)
+				log.Printf("ignore certificate \"%s\" with invalid label %s=%s", cert.Name, certificateSupersededAtLabel, supersededAt)
+				continue
 			}
-			err = op.Wait(ctx)
-			if err != nil {
-				return fmt.Errorf("wait for certificate deletion: %w", err)
+			if c.now().Sub(time.Unix(unix, 0)) < c.deleteGracePeriod {
+				continue
+			}
+			if err := c.deleteCertificate(ctx, cert.Name); err != nil {
+				return err
+			}
+			continue
+		}
+		switch c.orphanPolicy {
+		case OrphanPolicyDryRun:
+			log.Printf("[dry-run] delete orphaned certificate \"%s\"", cert.Name)
+		case OrphanPolicyDelete:
+			if c.deleteGracePeriod > 0 {
+				if err := c.markSuperseded(ctx, cert.Name); err != nil {
+					return err
+				}
+				continue
+			}
+			log.Printf("delete orphaned certificate \"%s\"", cert.Name)
+			if err := c.deleteCertificate(ctx, cert.Name); err != nil {
+				return err
 			}
-			log.Printf("Complete deleting certificate \"%s\"", certificate)
 		}
 	}
 	return nil
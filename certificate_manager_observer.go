@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"log"
+
+	certificatemanager "cloud.google.com/go/certificatemanager/apiv1"
+	"cloud.google.com/go/certificatemanager/apiv1/certificatemanagerpb"
+)
+
+// CertificateManagerObserver compares the certificates attached to map entries with the source without writing anything.
+// Self-managed certificates do not expose the private key, so Certificate Manager cannot be a Fetcher.
+type CertificateManagerObserver struct {
+	client     *certificatemanager.Client
+	projectId  string
+	location   string
+	mapEntries []CertificateManagerMapEntry
+}
+
+func NewCertificateManagerObserver(client *certificatemanager.Client, projectId string, location string, mapEntries []CertificateManagerMapEntry) *CertificateManagerObserver {
+	return &CertificateManagerObserver{
+		client:     client,
+		projectId:  projectId,
+		location:   location,
+		mapEntries: mapEntries,
+	}
+}
+
+func (o *CertificateManagerObserver) Sync(ctx context.Context, tlsCert []byte, _ []byte) error {
+	for _, entry := range o.mapEntries {
+		if err := o.observe(ctx, entry, tlsCert); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (o *CertificateManagerObserver) observe(ctx context.Context, entry CertificateManagerMapEntry, tlsCert []byte) error {
+	mapEntry, err := o.client.GetCertificateMapEntry(ctx, &certificatemanagerpb.GetCertificateMapEntryRequest{
+		Name: fmt.Sprintf("projects/%s/locations/%s/certificateMaps/%s/certificateMapEntries/%s", o.projectId, o.location, entry.CertificateMap, entry.Name),
+	})
+	if err != nil {
+		return fmt.Errorf("get certificate map entry: %w", err)
+	}
+	drift := certificateManagerDrift.WithLabelValues(entry.CertificateMap, entry.Name)
+	if len(mapEntry.Certificates) == 0 {
+		log.Printf("certificate map entry \"%s\" has no certificate", entry.Name)
+		drift.Set(1)
+		return nil
+	}
+	cert, err := o.client.GetCertificate(ctx, &certificatemanagerpb.GetCertificateRequest{
+		Name: mapEntry.Certificates[0],
+	})
+	if err != nil {
+		return fmt.Errorf("get certificate: %w", err)
+	}
+	if cert.ExpireTime != nil {
+		certificateManagerExpiry.WithLabelValues(entry.CertificateMap, entry.Name).Set(float64(cert.ExpireTime.AsTime().Unix()))
+	} else if block, _ := pem.Decode([]byte(cert.PemCertificate)); block != nil {
+		if parsed, err := x509.ParseCertificate(block.Bytes); err == nil {
+			certificateManagerExpiry.WithLabelValues(entry.CertificateMap, entry.Name).Set(float64(parsed.NotAfter.Unix()))
+		}
+	}
+	if samePEMCertificates([]byte(cert.PemCertificate), tlsCert) {
+		drift.Set(0)
+	} else {
+		log.Printf("certificate \"%s\" attached to certificate map entry \"%s\" differs from the source", cert.Name, entry.Name)
+		drift.Set(1)
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/certificatemanager/apiv1/certificatemanagerpb"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestCertificateManagerObserver(t *testing.T) {
+	ctx := context.Background()
+	client, fs := fakeServerForCertificateManager(t)
+	expireTime := time.Unix(1800000000, 0)
+	attachedCert, _ := newTestCertificate(t, "*.example.com", expireTime)
+	otherCert, _ := newTestCertificate(t, "*.example.com", expireTime)
+
+	certificateName := "projects/test-project/locations/global/certificates/test-attached"
+	fs.certificates[certificateName] = &certificatemanagerpb.Certificate{
+		Name:           certificateName,
+		PemCertificate: string(attachedCert),
+		ExpireTime:     timestamppb.New(expireTime),
+	}
+	fs.mapEntries[testCertificateMapEntryName] = &certificatemanagerpb.CertificateMapEntry{
+		Name:         testCertificateMapEntryName,
+		Certificates: []string{certificateName},
+	}
+	observer := NewCertificateManagerObserver(client, "test-project", "global", testCertificateManagerMapEntries)
+
+	if err := observer.Sync(ctx, attachedCert, nil); err != nil {
+		t.Fatalf("unexpected error in sync: %+v", err)
+	}
+	assert.Equal(t, 0.0, testutil.ToFloat64(certificateManagerDrift.WithLabelValues("test-map", "test-entry")))
+	assert.Equal(t, float64(expireTime.Unix()), testutil.ToFloat64(certificateManagerExpiry.WithLabelValues("test-map", "test-entry")))
+
+	if err := observer.Sync(ctx, otherCert, nil); err != nil {
+		t.Fatalf("unexpected error in sync: %+v", err)
+	}
+	assert.Equal(t, 1.0, testutil.ToFloat64(certificateManagerDrift.WithLabelValues("test-map", "test-entry")))
+
+	// Nothing is written by the observer.
+	assert.Equal(t, []string{certificateName}, fs.certificateNames())
+	assert.Equal(t, []string{certificateName}, fs.mapEntries[testCertificateMapEntryName].Certificates)
+}
+
+func TestCertificateManagerObserverMapEntryNotFound(t *testing.T) {
+	ctx := context.Background()
+	client, _ := fakeServerForCertificateManager(t)
+	observer := NewCertificateManagerObserver(client, "test-project", "global", testCertificateManagerMapEntries)
+	err := observer.Sync(ctx, []byte("tlsCert"), nil)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "get certificate map entry")
+	}
+}
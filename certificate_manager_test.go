@@ -0,0 +1,453 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	certificatemanager "cloud.google.com/go/certificatemanager/apiv1"
+	"cloud.google.com/go/certificatemanager/apiv1/certificatemanagerpb"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/api/option"
+	"google.golang.org/genproto/googleapis/longrunning"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+type fakeCertificateManagerServer struct {
+	certificatemanagerpb.UnimplementedCertificateManagerServer
+	certificates map[string]*certificatemanagerpb.Certificate
+	mapEntries   map[string]*certificatemanagerpb.CertificateMapEntry
+}
+
+func newFakeCertificateManagerServer() *fakeCertificateManagerServer {
+	return &fakeCertificateManagerServer{
+		certificates: make(map[string]*certificatemanagerpb.Certificate),
+		mapEntries:   make(map[string]*certificatemanagerpb.CertificateMapEntry),
+	}
+}
+
+func doneOperation(m proto.Message) (*longrunning.Operation, error) {
+	resp, err := anypb.New(m)
+	if err != nil {
+		return nil, err
+	}
+	return &longrunning.Operation{
+		Name:   "operations/fake",
+		Done:   true,
+		Result: &longrunning.Operation_Response{Response: resp},
+	}, nil
+}
+
+func (s *fakeCertificateManagerServer) certificateNames() []string {
+	names := make([]string, 0, len(s.certificates))
+	for name := range s.certificates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (s *fakeCertificateManagerServer) ListCertificates(_ context.Context, req *certificatemanagerpb.ListCertificatesRequest) (*certificatemanagerpb.ListCertificatesResponse, error) {
+	resp := &certificatemanagerpb.ListCertificatesResponse{}
+	for _, name := range s.certificateNames() {
+		resp.Certificates = append(resp.Certificates, proto.Clone(s.certificates[name]).(*certificatemanagerpb.Certificate))
+	}
+	return resp, nil
+}
+
+func (s *fakeCertificateManagerServer) GetCertificate(_ context.Context, req *certificatemanagerpb.GetCertificateRequest) (*certificatemanagerpb.Certificate, error) {
+	if cert, ok := s.certificates[req.Name]; ok {
+		return proto.Clone(cert).(*certificatemanagerpb.Certificate), nil
+	}
+	return nil, status.Errorf(codes.NotFound, "Not Found")
+}
+
+func (s *fakeCertificateManagerServer) CreateCertificate(_ context.Context, req *certificatemanagerpb.CreateCertificateRequest) (*longrunning.Operation, error) {
+	cert := proto.Clone(req.Certificate).(*certificatemanagerpb.Certificate)
+	cert.Name = req.Parent + "/certificates/" + req.CertificateId
+	if selfManaged := cert.GetSelfManaged(); selfManaged != nil {
+		cert.PemCertificate = selfManaged.PemCertificate
+		cert.Type = &certificatemanagerpb.Certificate_SelfManaged{
+			SelfManaged: &certificatemanagerpb.Certificate_SelfManagedCertificate{},
+		}
+	}
+	s.certificates[cert.Name] = cert
+	return doneOperation(cert)
+}
+
+func (s *fakeCertificateManagerServer) UpdateCertificate(_ context.Context, req *certificatemanagerpb.UpdateCertificateRequest) (*longrunning.Operation, error) {
+	cert, ok := s.certificates[req.Certificate.Name]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "Not Found")
+	}
+	for _, p := range req.UpdateMask.Paths {
+		if p == "labels" {
+			cert.Labels = req.Certificate.Labels
+		}
+	}
+	return doneOperation(cert)
+}
+
+func (s *fakeCertificateManagerServer) DeleteCertificate(_ context.Context, req *certificatemanagerpb.DeleteCertificateRequest) (*longrunning.Operation, error) {
+	if _, ok := s.certificates[req.Name]; !ok {
+		return nil, status.Errorf(codes.NotFound, "Not Found")
+	}
+	delete(s.certificates, req.Name)
+	return doneOperation(&emptypb.Empty{})
+}
+
+func (s *fakeCertificateManagerServer) GetCertificateMapEntry(_ context.Context, req *certificatemanagerpb.GetCertificateMapEntryRequest) (*certificatemanagerpb.CertificateMapEntry, error) {
+	if entry, ok := s.mapEntries[req.Name]; ok {
+		return proto.Clone(entry).(*certificatemanagerpb.CertificateMapEntry), nil
+	}
+	return nil, status.Errorf(codes.NotFound, "Not Found")
+}
+
+func (s *fakeCertificateManagerServer) CreateCertificateMapEntry(_ context.Context, req *certificatemanagerpb.CreateCertificateMapEntryRequest) (*longrunning.Operation, error) {
+	entry := proto.Clone(req.CertificateMapEntry).(*certificatemanagerpb.CertificateMapEntry)
+	entry.Name = req.Parent + "/certificateMapEntries/" + req.CertificateMapEntryId
+	s.mapEntries[entry.Name] = entry
+	return doneOperation(entry)
+}
+
+func (s *fakeCertificateManagerServer) UpdateCertificateMapEntry(_ context.Context, req *certificatemanagerpb.UpdateCertificateMapEntryRequest) (*longrunning.Operation, error) {
+	entry, ok := s.mapEntries[req.CertificateMapEntry.Name]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "Not Found")
+	}
+	for _, p := range req.UpdateMask.Paths {
+		if p == "certificates" {
+			entry.Certificates = req.CertificateMapEntry.Certificates
+		}
+	}
+	return doneOperation(entry)
+}
+
+func (s *fakeCertificateManagerServer) ListCertificateMaps(_ context.Context, req *certificatemanagerpb.ListCertificateMapsRequest) (*certificatemanagerpb.ListCertificateMapsResponse, error) {
+	resp := &certificatemanagerpb.ListCertificateMapsResponse{}
+	seen := make(map[string]bool)
+	for name := range s.mapEntries {
+		parent, _, _ := strings.Cut(name, "/certificateMapEntries/")
+		if !seen[parent] {
+			seen[parent] = true
+			resp.CertificateMaps = append(resp.CertificateMaps, &certificatemanagerpb.CertificateMap{Name: parent})
+		}
+	}
+	return resp, nil
+}
+
+func (s *fakeCertificateManagerServer) ListCertificateMapEntries(_ context.Context, req *certificatemanagerpb.ListCertificateMapEntriesRequest) (*certificatemanagerpb.ListCertificateMapEntriesResponse, error) {
+	resp := &certificatemanagerpb.ListCertificateMapEntriesResponse{}
+	for name, entry := range s.mapEntries {
+		if strings.HasPrefix(name, req.Parent+"/certificateMapEntries/") {
+			resp.CertificateMapEntries = append(resp.CertificateMapEntries, proto.Clone(entry).(*certificatemanagerpb.CertificateMapEntry))
+		}
+	}
+	return resp, nil
+}
+
+func fakeServerForCertificateManager(t *testing.T) (*certificatemanager.Client, *fakeCertificateManagerServer) {
+	fakeServer := newFakeCertificateManagerServer()
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gsrv := grpc.NewServer()
+	certificatemanagerpb.RegisterCertificateManagerServer(gsrv, fakeServer)
+	fakeServerAddr := l.Addr().String()
+	go func() {
+		if err := gsrv.Serve(l); err == grpc.ErrServerStopped {
+		} else if err != nil {
+			panic(err)
+		}
+	}()
+	t.Cleanup(gsrv.Stop)
+
+	client, err := certificatemanager.NewClient(context.Background(),
+		option.WithEndpoint(fakeServerAddr),
+		option.WithoutAuthentication(),
+		option.WithGRPCDialOption(grpc.WithTransportCredentials(insecure.NewCredentials())),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, fakeServer
+}
+
+const testCertificateMapEntryName = "projects/test-project/locations/global/certificateMaps/test-map/certificateMapEntries/test-entry"
+
+var testCertificateManagerMapEntries = []CertificateManagerMapEntry{
+	{CertificateMap: "test-map", Name: "test-entry", HostName: "*.example.com"},
+}
+
+func TestCertificateManagerSyncer(t *testing.T) {
+	ctx := context.Background()
+	client, fs := fakeServerForCertificateManager(t)
+	syncer := NewCertificateManagerSyncer(client, "test-project", "global", "test-", testCertificateManagerMapEntries, 0, OrphanPolicyKeep)
+	tlsCert1, tlsKey1 := newTestCertificate(t, "*.example.com", time.Now().Add(time.Hour))
+	tlsCert2, tlsKey2 := newTestCertificate(t, "*.example.com", time.Now().Add(time.Hour))
+
+	if err := syncer.Sync(ctx, tlsCert1, tlsKey1); err != nil {
+		t.Fatalf("unexpected error in sync: %+v", err)
+	}
+	assert.Len(t, fs.certificates, 1)
+	first := fs.mapEntries[testCertificateMapEntryName].Certificates[0]
+	assert.Contains(t, fs.certificates, first)
+	assert.Equal(t, "*.example.com", fs.mapEntries[testCertificateMapEntryName].GetHostname())
+
+	if err := syncer.Sync(ctx, tlsCert2, tlsKey2); err != nil {
+		t.Fatalf("unexpected error in sync: %+v", err)
+	}
+	second := fs.mapEntries[testCertificateMapEntryName].Certificates[0]
+	assert.NotEqual(t, first, second)
+	assert.Equal(t, []string{second}, fs.certificateNames())
+}
+
+func TestCertificateManagerSyncerDeleteGracePeriod(t *testing.T) {
+	ctx := context.Background()
+	client, fs := fakeServerForCertificateManager(t)
+	now := time.Unix(1700000000, 0)
+	syncer := NewCertificateManagerSyncer(client, "test-project", "global", "test-", testCertificateManagerMapEntries, time.Hour, OrphanPolicyKeep).(*CertificateManagerSyncer)
+	syncer.now = func() time.Time { return now }
+	tlsCert1, tlsKey1 := newTestCertificate(t, "*.example.com", now.Add(time.Hour))
+	tlsCert2, tlsKey2 := newTestCertificate(t, "*.example.com", now.Add(time.Hour))
+	// A superseded certificate of the prefix not managed by the syncer is never deleted.
+	unmanaged := "projects/test-project/locations/global/certificates/test-unmanaged"
+	fs.certificates[unmanaged] = &certificatemanagerpb.Certificate{
+		Name:   unmanaged,
+		Labels: map[string]string{certificateSupersededAtLabel: "1600000000"},
+	}
+
+	if err := syncer.Sync(ctx, tlsCert1, tlsKey1); err != nil {
+		t.Fatalf("unexpected error in sync: %+v", err)
+	}
+	first := fs.mapEntries[testCertificateMapEntryName].Certificates[0]
+
+	if err := syncer.Sync(ctx, tlsCert2, tlsKey2); err != nil {
+		t.Fatalf("unexpected error in sync: %+v", err)
+	}
+	second := fs.mapEntries[testCertificateMapEntryName].Certificates[0]
+	assert.Len(t, fs.certificates, 3)
+	assert.Equal(t, "1700000000", fs.certificates[first].Labels[certificateSupersededAtLabel])
+
+	now = now.Add(59 * time.Minute)
+	if err := syncer.Sync(ctx, tlsCert2, tlsKey2); err != nil {
+		t.Fatalf("unexpected error in sync: %+v", err)
+	}
+	assert.Len(t, fs.certificates, 3)
+
+	now = now.Add(time.Minute)
+	if err := syncer.Sync(ctx, tlsCert2, tlsKey2); err != nil {
+		t.Fatalf("unexpected error in sync: %+v", err)
+	}
+	assert.ElementsMatch(t, []string{second, unmanaged}, fs.certificateNames())
+}
+
+func TestCertificateManagerSyncerOrphanPolicy(t *testing.T) {
+	orphan := "projects/test-project/locations/global/certificates/test-orphan"
+	unmanaged := "projects/test-project/locations/global/certificates/test-unmanaged"
+	otherPrefix := "projects/test-project/locations/global/certificates/other-orphan"
+	testCases := []struct {
+		Name     string
+		Policy   OrphanPolicy
+		Expected []string
+	}{
+		{
+			Name:     "Keep",
+			Policy:   OrphanPolicyKeep,
+			Expected: []string{otherPrefix, orphan, unmanaged},
+		},
+		{
+			Name:     "DryRun",
+			Policy:   OrphanPolicyDryRun,
+			Expected: []string{otherPrefix, orphan, unmanaged},
+		},
+		{
+			Name:     "Delete",
+			Policy:   OrphanPolicyDelete,
+			Expected: []string{otherPrefix, unmanaged},
+		},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			ctx := context.Background()
+			client, fs := fakeServerForCertificateManager(t)
+			for _, name := range []string{orphan, otherPrefix} {
+				fs.certificates[name] = &certificatemanagerpb.Certificate{
+					Name:   name,
+					Labels: map[string]string{managedByLabel: managedByValue},
+				}
+			}
+			fs.certificates[unmanaged] = &certificatemanagerpb.Certificate{Name: unmanaged}
+			syncer := NewCertificateManagerSyncer(client, "test-project", "global", "test-", testCertificateManagerMapEntries, 0, tc.Policy)
+			tlsCert, tlsKey := newTestCertificate(t, "*.example.com", time.Now().Add(time.Hour))
+			if err := syncer.Sync(ctx, tlsCert, tlsKey); err != nil {
+				t.Fatalf("unexpected error in sync: %+v", err)
+			}
+			current := fs.mapEntries[testCertificateMapEntryName].Certificates[0]
+			expected := append([]string{current}, tc.Expected...)
+			sort.Strings(expected)
+			assert.Equal(t, expected, fs.certificateNames())
+		})
+	}
+}
+
+func TestCertificateManagerSyncerOrphanReferenced(t *testing.T) {
+	ctx := context.Background()
+	client, fs := fakeServerForCertificateManager(t)
+	now := time.Unix(1700000000, 0)
+	live := "projects/test-project/locations/global/certificates/test-live"
+	orphan := "projects/test-project/locations/global/certificates/test-orphan"
+	for _, name := range []string{live, orphan} {
+		fs.certificates[name] = &certificatemanagerpb.Certificate{
+			Name:   name,
+			Labels: map[string]string{managedByLabel: managedByValue},
+		}
+	}
+	// Another syncer sharing the prefix attaches its certificate to its own map.
+	otherEntry := "projects/test-project/locations/global/certificateMaps/other-map/certificateMapEntries/other-entry"
+	fs.mapEntries[otherEntry] = &certificatemanagerpb.CertificateMapEntry{Name: otherEntry, Certificates: []string{live}}
+	syncer := NewCertificateManagerSyncer(client, "test-project", "global", "test-", testCertificateManagerMapEntries, time.Hour, OrphanPolicyDelete).(*CertificateManagerSyncer)
+	syncer.now = func() time.Time { return now }
+	tlsCert, tlsKey := newTestCertificate(t, "*.example.com", now.Add(time.Hour))
+
+	if err := syncer.Sync(ctx, tlsCert, tlsKey); err != nil {
+		t.Fatalf("unexpected error in sync: %+v", err)
+	}
+	current := fs.mapEntries[testCertificateMapEntryName].Certificates[0]
+	// The orphan is kept for the grace period like a superseded certificate.
+	assert.ElementsMatch(t, []string{live, orphan, current}, fs.certificateNames())
+	assert.Equal(t, "1700000000", fs.certificates[orphan].Labels[certificateSupersededAtLabel])
+	assert.Empty(t, fs.certificates[live].Labels[certificateSupersededAtLabel])
+
+	now = now.Add(time.Hour)
+	if err := syncer.Sync(ctx, tlsCert, tlsKey); err != nil {
+		t.Fatalf("unexpected error in sync: %+v", err)
+	}
+	assert.ElementsMatch(t, []string{live, current}, fs.certificateNames())
+}
+
+func TestCertificateManagerSyncerNameCollision(t *testing.T) {
+	ctx := context.Background()
+	client, fs := fakeServerForCertificateManager(t)
+	syncer := NewCertificateManagerSyncer(client, "test-project", "global", "test-", testCertificateManagerMapEntries, 0, OrphanPolicyKeep)
+	tlsCert, tlsKey := newTestCertificate(t, "*.example.com", time.Now().Add(time.Hour))
+	otherCert, _ := newTestCertificate(t, "*.example.com", time.Now().Add(time.Hour))
+
+	hash := sha256.Sum256(tlsCert)
+	name := fmt.Sprintf("projects/test-project/locations/global/certificates/test-%x", hash[:certificateNameHashLength])
+	fs.certificates[name] = &certificatemanagerpb.Certificate{
+		Name:           name,
+		PemCertificate: string(otherCert),
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := syncer.Sync(ctx, tlsCert, tlsKey); err != nil {
+			t.Fatalf("unexpected error in sync: %+v", err)
+		}
+		assert.Equal(t, []string{name + "-1"}, fs.mapEntries[testCertificateMapEntryName].Certificates)
+		assert.Equal(t, []string{name, name + "-1"}, fs.certificateNames())
+	}
+}
+
+func TestSamePEMCertificates(t *testing.T) {
+	cert1, _ := newTestCertificate(t, "example.com", time.Now().Add(time.Hour))
+	cert2, _ := newTestCertificate(t, "example.com", time.Now().Add(time.Hour))
+	assert.True(t, samePEMCertificates(cert1, cert1))
+	assert.True(t, samePEMCertificates(cert1, append([]byte("\n"), cert1...)))
+	assert.False(t, samePEMCertificates(cert1, cert2))
+	assert.False(t, samePEMCertificates(cert1, append(cert1, cert2...)))
+	assert.False(t, samePEMCertificates(nil, nil))
+}
+
+func TestCertificateManagerSyncerMultipleMapEntries(t *testing.T) {
+	ctx := context.Background()
+	client, fs := fakeServerForCertificateManager(t)
+	entries := []CertificateManagerMapEntry{
+		{CertificateMap: "test-map", Name: "test-entry", HostName: "*.example.com"},
+		{CertificateMap: "test-map", Name: "apex", HostName: "example.com"},
+		{CertificateMap: "other-map", Name: "primary", Primary: true},
+	}
+	syncer := NewCertificateManagerSyncer(client, "test-project", "global", "test-", entries, 0, OrphanPolicyKeep)
+
+	for i := 0; i < 2; i++ {
+		tlsCert, tlsKey := newTestCertificate(t, "*.example.com", time.Now().Add(time.Hour))
+		if err := syncer.Sync(ctx, tlsCert, tlsKey); err != nil {
+			t.Fatalf("unexpected error in sync: %+v", err)
+		}
+		names := fs.certificateNames()
+		assert.Len(t, names, 1)
+		assert.Len(t, fs.mapEntries, 3)
+		for _, entry := range fs.mapEntries {
+			assert.Equal(t, names, entry.Certificates)
+		}
+	}
+	assert.Equal(t, "example.com", fs.mapEntries["projects/test-project/locations/global/certificateMaps/test-map/certificateMapEntries/apex"].GetHostname())
+	assert.Equal(t, certificatemanagerpb.CertificateMapEntry_PRIMARY, fs.mapEntries["projects/test-project/locations/global/certificateMaps/other-map/certificateMapEntries/primary"].GetMatcher())
+}
+
+func TestParseCertificateManagerMapEntry(t *testing.T) {
+	testCases := []struct {
+		Name     string
+		Value    string
+		Expected CertificateManagerMapEntry
+		Error    string
+	}{
+		{
+			Name:     "HostName",
+			Value:    "map=m,entry=e,hostname=*.example.com",
+			Expected: CertificateManagerMapEntry{CertificateMap: "m", Name: "e", HostName: "*.example.com"},
+		},
+		{
+			Name:     "Primary",
+			Value:    "map=m,entry=e,matcher=primary",
+			Expected: CertificateManagerMapEntry{CertificateMap: "m", Name: "e", Primary: true},
+		},
+		{
+			Name:  "No Matcher",
+			Value: "map=m,entry=e",
+			Error: "either hostname or matcher=primary is required",
+		},
+		{
+			Name:  "Both Matchers",
+			Value: "map=m,entry=e,hostname=example.com,matcher=primary",
+			Error: "either hostname or matcher=primary is required",
+		},
+		{
+			Name:  "No Map",
+			Value: "entry=e,hostname=example.com",
+			Error: "map is required",
+		},
+		{
+			Name:  "Unknown Matcher",
+			Value: "map=m,entry=e,matcher=all",
+			Error: "unknown matcher",
+		},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			entry, err := ParseCertificateManagerMapEntry(tc.Value)
+			if tc.Error != "" {
+				if assert.Error(t, err) {
+					assert.Contains(t, err.Error(), tc.Error)
+				}
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, tc.Expected, entry)
+		})
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+
+	compute "cloud.google.com/go/compute/apiv1"
+	"cloud.google.com/go/compute/apiv1/computepb"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/protobuf/proto"
+)
+
+// ComputeSslCertificateSyncer syncs the certificate to classic SSL certificates of Cloud Load Balancing
+// and attaches it to global target HTTPS / SSL proxies.
+type ComputeSslCertificateSyncer struct {
+	sslCertificates       *compute.SslCertificatesClient
+	targetHttpsProxies    *compute.TargetHttpsProxiesClient
+	targetSslProxies      *compute.TargetSslProxiesClient
+	projectId             string
+	certificateNamePrefix string
+	httpsProxyNames       []string
+	sslProxyNames         []string
+}
+
+func NewComputeSslCertificateSyncer(sslCertificates *compute.SslCertificatesClient, targetHttpsProxies *compute.TargetHttpsProxiesClient, targetSslProxies *compute.TargetSslProxiesClient, projectId string, certificateNamePrefix string, httpsProxyNames []string, sslProxyNames []string) *ComputeSslCertificateSyncer {
+	return &ComputeSslCertificateSyncer{
+		sslCertificates:       sslCertificates,
+		targetHttpsProxies:    targetHttpsProxies,
+		targetSslProxies:      targetSslProxies,
+		projectId:             projectId,
+		certificateNamePrefix: certificateNamePrefix,
+		httpsProxyNames:       httpsProxyNames,
+		sslProxyNames:         sslProxyNames,
+	}
+}
+
+func (c *ComputeSslCertificateSyncer) Sync(ctx context.Context, tlsCert []byte, tlsKey []byte) error {
+	certificate, err := c.ensureCertificate(ctx, tlsCert, tlsKey)
+	if err != nil {
+		return err
+	}
+
+	var removeCertificates []string
+	seen := map[string]bool{certificate.GetName(): true}
+	for _, proxyName := range c.httpsProxyNames {
+		proxy, err := c.targetHttpsProxies.Get(ctx, &computepb.GetTargetHttpsProxyRequest{
+			Project:          c.projectId,
+			TargetHttpsProxy: proxyName,
+		})
+		if err != nil {
+			return fmt.Errorf("get target https proxy: %w", err)
+		}
+		sslCertificates, detached, changed := c.replaceCertificate(proxy.SslCertificates, certificate)
+		if !changed {
+			continue
+		}
+		log.Printf("Start updating target https proxy \"%s\"", proxyName)
+		op, err := c.targetHttpsProxies.SetSslCertificates(ctx, &computepb.SetSslCertificatesTargetHttpsProxyRequest{
+			Project:          c.projectId,
+			TargetHttpsProxy: proxyName,
+			TargetHttpsProxiesSetSslCertificatesRequestResource: &computepb.TargetHttpsProxiesSetSslCertificatesRequest{
+				SslCertificates: sslCertificates,
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("set ssl certificates of target https proxy: %w", err)
+		}
+		if err := op.Wait(ctx); err != nil {
+			return fmt.Errorf("wait for target https proxy update: %w", err)
+		}
+		log.Printf("Complete updating target https proxy \"%s\"", proxyName)
+		for _, name := range detached {
+			if !seen[name] {
+				seen[name] = true
+				removeCertificates = append(removeCertificates, name)
+			}
+		}
+	}
+	for _, proxyName := range c.sslProxyNames {
+		proxy, err := c.targetSslProxies.Get(ctx, &computepb.GetTargetSslProxyRequest{
+			Project:        c.projectId,
+			TargetSslProxy: proxyName,
+		})
+		if err != nil {
+			return fmt.Errorf("get target ssl proxy: %w", err)
+		}
+		sslCertificates, detached, changed := c.replaceCertificate(proxy.SslCertificates, certificate)
+		if !changed {
+			continue
+		}
+		log.Printf("Start updating target ssl proxy \"%s\"", proxyName)
+		op, err := c.targetSslProxies.SetSslCertificates(ctx, &computepb.SetSslCertificatesTargetSslProxyRequest{
+			Project:        c.projectId,
+			TargetSslProxy: proxyName,
+			TargetSslProxiesSetSslCertificatesRequestResource: &computepb.TargetSslProxiesSetSslCertificatesRequest{
+				SslCertificates: sslCertificates,
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("set ssl certificates of target ssl proxy: %w", err)
+		}
+		if err := op.Wait(ctx); err != nil {
+			return fmt.Errorf("wait for target ssl proxy update: %w", err)
+		}
+		log.Printf("Complete updating target ssl proxy \"%s\"", proxyName)
+		for _, name := range detached {
+			if !seen[name] {
+				seen[name] = true
+				removeCertificates = append(removeCertificates, name)
+			}
+		}
+	}
+
+	for _, name := range removeCertificates {
+		log.Printf("Start deleting ssl certificate \"%s\"", name)
+		op, err := c.sslCertificates.Delete(ctx, &computepb.DeleteSslCertificateRequest{
+			Project:        c.projectId,
+			SslCertificate: name,
+		})
+		if isResourceInUse(err) {
+			// Proxies not managed by the syncer may use it. It is retried on the next sync.
+			log.Printf("Skip deleting ssl certificate \"%s\" used by another resource", name)
+			continue
+		} else if err != nil {
+			return fmt.Errorf("delete ssl certificate: %w", err)
+		}
+		if err := op.Wait(ctx); err != nil {
+			return fmt.Errorf("wait for ssl certificate deletion: %w", err)
+		}
+		log.Printf("Complete deleting ssl certificate \"%s\"", name)
+	}
+	return nil
+}
+
+// isResourceInUse reports whether err is from deleting a resource still used by another resource.
+func isResourceInUse(err error) bool {
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	for _, item := range apiErr.Errors {
+		if item.Reason == "resourceInUseByAnotherResource" {
+			return true
+		}
+	}
+	return false
+}
+
+// replaceCertificate puts certificate in place of the certificates with our prefix, keeping the other certificates
+// attached to the proxy. It returns the new list, the names of the detached certificates and whether the list changed.
+func (c *ComputeSslCertificateSyncer) replaceCertificate(current []string, certificate *computepb.SslCertificate) ([]string, []string, bool) {
+	var sslCertificates, detached []string
+	attached := false
+	changed := false
+	for _, u := range current {
+		name := path.Base(u)
+		switch {
+		case !strings.HasPrefix(name, c.certificateNamePrefix):
+			sslCertificates = append(sslCertificates, u)
+			continue
+		case attached:
+			changed = true
+		case name == certificate.GetName():
+			sslCertificates = append(sslCertificates, u)
+			attached = true
+		default:
+			sslCertificates = append(sslCertificates, certificate.GetSelfLink())
+			attached = true
+			changed = true
+		}
+		if name != certificate.GetName() {
+			detached = append(detached, name)
+		}
+	}
+	if !attached {
+		sslCertificates = append(sslCertificates, certificate.GetSelfLink())
+		changed = true
+	}
+	return sslCertificates, detached, changed
+}
+
+// ensureCertificate returns an SSL certificate whose content equals tlsCert, creating it if needed.
+// Names are chosen in the same way as CertificateManagerSyncer.
+func (c *ComputeSslCertificateSyncer) ensureCertificate(ctx context.Context, tlsCert []byte, tlsKey []byte) (*computepb.SslCertificate, error) {
+	certificateNameHash := sha256.Sum256(tlsCert)
+	baseName := fmt.Sprintf("%s%x", c.certificateNamePrefix, certificateNameHash[:certificateNameHashLength])
+	for i := 0; i < maxCertificateNameCollisions; i++ {
+		certificateName := baseName
+		if i > 0 {
+			certificateName = fmt.Sprintf("%s-%d", baseName, i)
+		}
+		cert, err := c.sslCertificates.Get(ctx, &computepb.GetSslCertificateRequest{
+			Project:        c.projectId,
+			SslCertificate: certificateName,
+		})
+		var apiErr *googleapi.Error
+		if errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound {
+			return c.createCertificate(ctx, certificateName, tlsCert, tlsKey)
+		} else if err != nil {
+			return nil, fmt.Errorf("get ssl certificate: %w", err)
+		}
+		if samePEMCertificates([]byte(cert.GetCertificate()), tlsCert) {
+			return cert, nil
+		}
+		log.Printf("SSL certificate \"%s\" already exists with different content", certificateName)
+	}
+	return nil, fmt.Errorf("too many ssl certificates with different content named %s", baseName)
+}
+
+func (c *ComputeSslCertificateSyncer) createCertificate(ctx context.Context, certificateName string, tlsCert []byte, tlsKey []byte) (*computepb.SslCertificate, error) {
+	log.Printf("Start creating ssl certificate \"%s\"", certificateName)
+	op, err := c.sslCertificates.Insert(ctx, &computepb.InsertSslCertificateRequest{
+		Project: c.projectId,
+		SslCertificateResource: &computepb.SslCertificate{
+			Name:        proto.String(certificateName),
+			Description: proto.String("managed-by: " + managedByValue),
+			Certificate: proto.String(string(tlsCert)),
+			PrivateKey:  proto.String(string(tlsKey)),
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("create ssl certificate: %w", err)
+	}
+	if err := op.Wait(ctx); err != nil {
+		return nil, fmt.Errorf("wait for ssl certificate creation: %w", err)
+	}
+	log.Printf("Complete creating ssl certificate \"%s\"", certificateName)
+	cert, err := c.sslCertificates.Get(ctx, &computepb.GetSslCertificateRequest{
+		Project:        c.projectId,
+		SslCertificate: certificateName,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("get ssl certificate: %w", err)
+	}
+	return cert, nil
+}
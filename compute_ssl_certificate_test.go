@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	compute "cloud.google.com/go/compute/apiv1"
+	"cloud.google.com/go/compute/apiv1/computepb"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/api/option"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+type fakeComputeServer struct {
+	url             string
+	sslCertificates map[string]*computepb.SslCertificate
+	httpsProxies    map[string]*computepb.TargetHttpsProxy
+	sslProxies      map[string]*computepb.TargetSslProxy
+	// inUse is the set of certificate names used by proxies not in the maps, which cannot be deleted.
+	inUse map[string]bool
+}
+
+func (s *fakeComputeServer) certificateNames() []string {
+	names := make([]string, 0, len(s.sslCertificates))
+	for name := range s.sslCertificates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (s *fakeComputeServer) writeJSON(w http.ResponseWriter, m proto.Message) {
+	b, err := protojson.Marshal(m)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(b)
+}
+
+func (s *fakeComputeServer) writeOperation(w http.ResponseWriter) {
+	s.writeJSON(w, &computepb.Operation{
+		Name:   proto.String("operation-fake"),
+		Status: computepb.Operation_DONE.Enum(),
+	})
+}
+
+func (s *fakeComputeServer) notFound(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusNotFound)
+	_, _ = w.Write([]byte(`{"error":{"code":404,"message":"Not Found"}}`))
+}
+
+func (s *fakeComputeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// /compute/v1/projects/{project}/global/{collection}/{name}[/{method}]
+	// targetHttpsProxies.setSslCertificates is the only method without "/global".
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/compute/v1/projects/"), "/")
+	if len(parts) == 4 && parts[1] == "targetHttpsProxies" {
+		parts = append([]string{parts[0], "global"}, parts[1:]...)
+	}
+	if len(parts) < 3 || parts[1] != "global" {
+		http.Error(w, "unexpected path "+r.URL.Path, http.StatusBadRequest)
+		return
+	}
+	project, collection, rest := parts[0], parts[2], parts[3:]
+	body, _ := io.ReadAll(r.Body)
+	switch {
+	case collection == "operations":
+		s.writeOperation(w)
+	case collection == "sslCertificates" && r.Method == http.MethodPost && len(rest) == 0:
+		cert := &computepb.SslCertificate{}
+		if err := protojson.Unmarshal(body, cert); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		cert.SelfLink = proto.String(fmt.Sprintf("%s/compute/v1/projects/%s/global/sslCertificates/%s", s.url, project, cert.GetName()))
+		cert.PrivateKey = nil
+		s.sslCertificates[cert.GetName()] = cert
+		s.writeOperation(w)
+	case collection == "sslCertificates" && len(rest) == 1:
+		cert, ok := s.sslCertificates[rest[0]]
+		if !ok {
+			s.notFound(w)
+			return
+		}
+		if r.Method == http.MethodDelete {
+			if s.inUse[rest[0]] {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte(`{"error":{"code":400,"message":"The ssl_certificate resource is already being used","errors":[{"reason":"resourceInUseByAnotherResource"}]}}`))
+				return
+			}
+			delete(s.sslCertificates, rest[0])
+			s.writeOperation(w)
+			return
+		}
+		s.writeJSON(w, cert)
+	case collection == "targetHttpsProxies" && len(rest) >= 1:
+		proxy, ok := s.httpsProxies[rest[0]]
+		if !ok {
+			s.notFound(w)
+			return
+		}
+		if len(rest) == 2 && rest[1] == "setSslCertificates" {
+			req := &computepb.TargetHttpsProxiesSetSslCertificatesRequest{}
+			if err := protojson.Unmarshal(body, req); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			proxy.SslCertificates = req.SslCertificates
+			s.writeOperation(w)
+			return
+		}
+		s.writeJSON(w, proxy)
+	case collection == "targetSslProxies" && len(rest) >= 1:
+		proxy, ok := s.sslProxies[rest[0]]
+		if !ok {
+			s.notFound(w)
+			return
+		}
+		if len(rest) == 2 && rest[1] == "setSslCertificates" {
+			req := &computepb.TargetSslProxiesSetSslCertificatesRequest{}
+			if err := protojson.Unmarshal(body, req); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			proxy.SslCertificates = req.SslCertificates
+			s.writeOperation(w)
+			return
+		}
+		s.writeJSON(w, proxy)
+	default:
+		http.Error(w, "unexpected request "+r.Method+" "+r.URL.Path, http.StatusBadRequest)
+	}
+}
+
+func fakeServerForCompute(t *testing.T) (*ComputeSslCertificateSyncer, *fakeComputeServer) {
+	fakeServer := &fakeComputeServer{
+		sslCertificates: make(map[string]*computepb.SslCertificate),
+		httpsProxies: map[string]*computepb.TargetHttpsProxy{
+			"test-https-proxy": {Name: proto.String("test-https-proxy")},
+		},
+		sslProxies: map[string]*computepb.TargetSslProxy{
+			"test-ssl-proxy": {Name: proto.String("test-ssl-proxy")},
+		},
+		inUse: make(map[string]bool),
+	}
+	srv := httptest.NewServer(fakeServer)
+	t.Cleanup(srv.Close)
+	fakeServer.url = srv.URL
+
+	ctx := context.Background()
+	opts := []option.ClientOption{
+		option.WithEndpoint(srv.URL),
+		option.WithoutAuthentication(),
+	}
+	sslCertificates, err := compute.NewSslCertificatesRESTClient(ctx, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	targetHttpsProxies, err := compute.NewTargetHttpsProxiesRESTClient(ctx, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	targetSslProxies, err := compute.NewTargetSslProxiesRESTClient(ctx, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	syncer := NewComputeSslCertificateSyncer(sslCertificates, targetHttpsProxies, targetSslProxies, "test-project", "test-", []string{"test-https-proxy"}, []string{"test-ssl-proxy"})
+	return syncer, fakeServer
+}
+
+func TestComputeSslCertificateSyncer(t *testing.T) {
+	ctx := context.Background()
+	syncer, fs := fakeServerForCompute(t)
+	otherCertificate := fs.url + "/compute/v1/projects/test-project/global/sslCertificates/other-cert"
+	fs.httpsProxies["test-https-proxy"].SslCertificates = []string{otherCertificate}
+
+	var previous string
+	for i := 0; i < 2; i++ {
+		tlsCert, tlsKey := newTestCertificate(t, "*.example.com", time.Now().Add(time.Hour))
+		if err := syncer.Sync(ctx, tlsCert, tlsKey); err != nil {
+			t.Fatalf("unexpected error in sync: %+v", err)
+		}
+		names := fs.certificateNames()
+		if assert.Len(t, names, 1) {
+			assert.NotEqual(t, previous, names[0])
+			previous = names[0]
+		}
+		assert.Equal(t, []string{otherCertificate, fs.sslCertificates[previous].GetSelfLink()}, fs.httpsProxies["test-https-proxy"].SslCertificates)
+		assert.Equal(t, []string{fs.sslCertificates[previous].GetSelfLink()}, fs.sslProxies["test-ssl-proxy"].SslCertificates)
+	}
+}
+
+func TestComputeSslCertificateSyncerNoChange(t *testing.T) {
+	ctx := context.Background()
+	syncer, fs := fakeServerForCompute(t)
+	tlsCert, tlsKey := newTestCertificate(t, "*.example.com", time.Now().Add(time.Hour))
+	if err := syncer.Sync(ctx, tlsCert, tlsKey); err != nil {
+		t.Fatalf("unexpected error in sync: %+v", err)
+	}
+	attached := fs.httpsProxies["test-https-proxy"].SslCertificates
+	// Partial URLs are also accepted by Compute Engine.
+	fs.httpsProxies["test-https-proxy"].SslCertificates = []string{"projects/test-project/global/sslCertificates/" + path.Base(attached[0])}
+	if err := syncer.Sync(ctx, tlsCert, tlsKey); err != nil {
+		t.Fatalf("unexpected error in sync: %+v", err)
+	}
+	assert.Equal(t, []string{"projects/test-project/global/sslCertificates/" + path.Base(attached[0])}, fs.httpsProxies["test-https-proxy"].SslCertificates)
+}
+
+func TestComputeSslCertificateSyncerProxyNotFound(t *testing.T) {
+	ctx := context.Background()
+	syncer, fs := fakeServerForCompute(t)
+	delete(fs.httpsProxies, "test-https-proxy")
+	tlsCert, tlsKey := newTestCertificate(t, "*.example.com", time.Now().Add(time.Hour))
+	err := syncer.Sync(ctx, tlsCert, tlsKey)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "get target https proxy")
+	}
+}
+
+func TestComputeSslCertificateSyncerInUse(t *testing.T) {
+	ctx := context.Background()
+	syncer, fs := fakeServerForCompute(t)
+	tlsCert, tlsKey := newTestCertificate(t, "*.example.com", time.Now().Add(time.Hour))
+	if err := syncer.Sync(ctx, tlsCert, tlsKey); err != nil {
+		t.Fatalf("unexpected error in sync: %+v", err)
+	}
+	previous := fs.certificateNames()[0]
+	fs.inUse[previous] = true
+
+	// The previous certificate used by another proxy is kept without failing the sync.
+	tlsCert, tlsKey = newTestCertificate(t, "*.example.com", time.Now().Add(time.Hour))
+	if err := syncer.Sync(ctx, tlsCert, tlsKey); err != nil {
+		t.Fatalf("unexpected error in sync: %+v", err)
+	}
+	assert.Len(t, fs.certificateNames(), 2)
+	assert.Contains(t, fs.sslCertificates, previous)
+}
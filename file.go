@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// kubernetesAtomicWriterDataDir is the symlink swapped by kubelet when a mounted Secret or ConfigMap is updated.
+const kubernetesAtomicWriterDataDir = "..data"
+
+// FileFetcher reads the certificate and the key from files.
+// If combinedFile is set, both are read from that single PEM file instead of certFile and keyFile.
+type FileFetcher struct {
+	dir          string
+	certFile     string
+	keyFile      string
+	combinedFile string
+}
+
+func NewFileFetcher(dir string, certFile string, keyFile string, combinedFile string) *FileFetcher {
+	return &FileFetcher{
+		dir:          dir,
+		certFile:     certFile,
+		keyFile:      keyFile,
+		combinedFile: combinedFile,
+	}
+}
+
+func (f *FileFetcher) paths() []string {
+	if f.combinedFile != "" {
+		return []string{filepath.Join(f.dir, f.combinedFile)}
+	}
+	return []string{filepath.Join(f.dir, f.certFile), filepath.Join(f.dir, f.keyFile)}
+}
+
+// Fetch returns the certificate and the key, or an error if they are not a matching pair,
+// e.g. while a writer replacing both files has replaced only one of them.
+func (f *FileFetcher) Fetch(_ context.Context) ([]byte, []byte, error) {
+	tlsCert, tlsKey, err := f.read()
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := tls.X509KeyPair(tlsCert, tlsKey); err != nil {
+		return nil, nil, fmt.Errorf("invalid key pair: %w", err)
+	}
+	return tlsCert, tlsKey, nil
+}
+
+func (f *FileFetcher) read() ([]byte, []byte, error) {
+	if f.combinedFile != "" {
+		data, err := os.ReadFile(filepath.Join(f.dir, f.combinedFile))
+		if err != nil {
+			return nil, nil, err
+		}
+		return splitCombinedPEM(data)
+	}
+	tlsCert, err := os.ReadFile(filepath.Join(f.dir, f.certFile))
+	if err != nil {
+		return nil, nil, err
+	}
+	tlsKey, err := os.ReadFile(filepath.Join(f.dir, f.keyFile))
+	if err != nil {
+		return nil, nil, err
+	}
+	return tlsCert, tlsKey, nil
+}
+
+// Watch notifies changes of the files until ctx is done.
+// Directories are watched instead of files so that atomic renames and Kubernetes "..data" symlink swaps are detected.
+func (f *FileFetcher) Watch(ctx context.Context) (<-chan struct{}, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string]bool)
+	dirs := make(map[string]bool)
+	for _, p := range f.paths() {
+		files[filepath.Clean(p)] = true
+		dir := filepath.Dir(p)
+		if dirs[dir] {
+			continue
+		}
+		dirs[dir] = true
+		if err := watcher.Add(dir); err != nil {
+			_ = watcher.Close()
+			return nil, fmt.Errorf("watch %s: %w", dir, err)
+		}
+	}
+	changes := make(chan struct{}, 1)
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if !files[filepath.Clean(event.Name)] && filepath.Base(event.Name) != kubernetesAtomicWriterDataDir {
+					continue
+				}
+				select {
+				case changes <- struct{}{}:
+				default:
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Print("failed to watch files: ", err)
+			}
+		}
+	}()
+	return changes, nil
+}
+
+// splitCombinedPEM splits a PEM file into certificates and a private key.
+func splitCombinedPEM(data []byte) ([]byte, []byte, error) {
+	var tlsCert, tlsKey []byte
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type == "CERTIFICATE" {
+			tlsCert = append(tlsCert, pem.EncodeToMemory(block)...)
+		} else if strings.HasSuffix(block.Type, "PRIVATE KEY") {
+			if tlsKey != nil {
+				return nil, nil, fmt.Errorf("multiple private keys found")
+			}
+			tlsKey = pem.EncodeToMemory(block)
+		}
+	}
+	if tlsCert == nil {
+		return nil, nil, fmt.Errorf("no certificate found")
+	}
+	if tlsKey == nil {
+		return nil, nil, fmt.Errorf("no private key found")
+	}
+	return tlsCert, tlsKey, nil
+}
+
+// FilePaths are the destinations of FileSyncer. Empty paths are not written.
+// Cert is the leaf certificate, Chain the intermediates and FullChain both of them.
+type FilePaths struct {
+	Cert      string
+	Key       string
+	Chain     string
+	FullChain string
+}
+
+// FileSyncer writes the certificate and the key to files, and reloads the consumer when any of them changed.
+type FileSyncer struct {
+	paths         FilePaths
+	fileMode      os.FileMode
+	keyMode       os.FileMode
+	uid           int
+	gid           int
+	reloadCommand []string
+	pidFile       string
+	signal        os.Signal
+	// pendingReload is set when files are changed and cleared only after the reload succeeds,
+	// so a failed reload is retried on the next sync even if the files are unchanged.
+	pendingReload bool
+}
+
+// NewFileSyncer creates a FileSyncer. Ownership is left unchanged when uid or gid is -1.
+// After files are changed, reloadCommand is executed and signal is sent to the process in pidFile if they are set.
+func NewFileSyncer(paths FilePaths, fileMode os.FileMode, keyMode os.FileMode, uid int, gid int, reloadCommand []string, pidFile string, signal os.Signal) *FileSyncer {
+	return &FileSyncer{
+		paths:         paths,
+		fileMode:      fileMode,
+		keyMode:       keyMode,
+		uid:           uid,
+		gid:           gid,
+		reloadCommand: reloadCommand,
+		pidFile:       pidFile,
+		signal:        signal,
+	}
+}
+
+func (s *FileSyncer) Sync(ctx context.Context, tlsCert []byte, tlsKey []byte) error {
+	leaf, chain := splitCertificateChain(tlsCert)
+	files := []struct {
+		path string
+		data []byte
+		mode os.FileMode
+	}{
+		{s.paths.Cert, leaf, s.fileMode},
+		{s.paths.Chain, chain, s.fileMode},
+		{s.paths.FullChain, tlsCert, s.fileMode},
+		{s.paths.Key, tlsKey, s.keyMode},
+	}
+	for _, f := range files {
+		if f.path == "" {
+			continue
+		}
+		current, err := os.ReadFile(f.path)
+		if err == nil && bytes.Equal(current, f.data) {
+			continue
+		} else if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		log.Printf("write file %s", f.path)
+		if err := s.writeFile(f.path, f.data, f.mode); err != nil {
+			return err
+		}
+		s.pendingReload = true
+	}
+	if s.pendingReload {
+		if err := s.reload(ctx); err != nil {
+			return err
+		}
+		s.pendingReload = false
+	}
+	return nil
+}
+
+// writeFile replaces path atomically by renaming a temporary file in the same directory.
+func (s *FileSyncer) writeFile(path string, data []byte, mode os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if s.uid >= 0 || s.gid >= 0 {
+		if err := tmp.Chown(s.uid, s.gid); err != nil {
+			_ = tmp.Close()
+			return err
+		}
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s *FileSyncer) reload(ctx context.Context) error {
+	if len(s.reloadCommand) > 0 {
+		log.Printf("run reload command %s", strings.Join(s.reloadCommand, " "))
+		out, err := exec.CommandContext(ctx, s.reloadCommand[0], s.reloadCommand[1:]...).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("reload command: %w: %s", err, out)
+		}
+	}
+	if s.pidFile != "" {
+		data, err := os.ReadFile(s.pidFile)
+		if err != nil {
+			return err
+		}
+		pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+		if err != nil {
+			return fmt.Errorf("invalid pid file %s: %w", s.pidFile, err)
+		}
+		process, err := os.FindProcess(pid)
+		if err != nil {
+			return err
+		}
+		log.Printf("send %s to pid %d", s.signal, pid)
+		if err := process.Signal(s.signal); err != nil {
+			return fmt.Errorf("send %s to pid %d: %w", s.signal, pid, err)
+		}
+	}
+	return nil
+}
+
+// splitCertificateChain splits PEM certificates into the leaf and the rest of the chain.
+func splitCertificateChain(tlsCert []byte) ([]byte, []byte) {
+	var leaf, chain []byte
+	for block, rest := pem.Decode(tlsCert); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		if leaf == nil {
+			leaf = pem.EncodeToMemory(block)
+		} else {
+			chain = append(chain, pem.EncodeToMemory(block)...)
+		}
+	}
+	return leaf, chain
+}
+
+// parseLeafCertificate parses the first certificate in PEM.
+func parseLeafCertificate(tlsCert []byte) (*x509.Certificate, error) {
+	for block, rest := pem.Decode(tlsCert); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type == "CERTIFICATE" {
+			return x509.ParseCertificate(block.Bytes)
+		}
+	}
+	return nil, fmt.Errorf("no certificate found")
+}
+
+// ParseSignal parses a signal name such as "HUP" or "SIGHUP".
+func ParseSignal(name string) (os.Signal, error) {
+	switch strings.TrimPrefix(strings.ToUpper(name), "SIG") {
+	case "HUP":
+		return syscall.SIGHUP, nil
+	case "INT":
+		return syscall.SIGINT, nil
+	case "TERM":
+		return syscall.SIGTERM, nil
+	case "USR1":
+		return syscall.SIGUSR1, nil
+	case "USR2":
+		return syscall.SIGUSR2, nil
+	}
+	return nil, fmt.Errorf("unsupported signal: %s", name)
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileFetcher(t *testing.T) {
+	ctx := context.Background()
+	tlsCert, tlsKey := newTestCertificate(t, "example.com", time.Now().Add(time.Hour))
+	_, otherKey := newTestCertificate(t, "example.com", time.Now().Add(time.Hour))
+	testCases := []struct {
+		Name         string
+		Files        map[string][]byte
+		CombinedFile string
+		Error        string
+	}{
+		{
+			Name:  "Separate Files",
+			Files: map[string][]byte{"tls.crt": tlsCert, "tls.key": tlsKey},
+		},
+		{
+			Name:         "Combined File",
+			Files:        map[string][]byte{"combined.pem": append(append([]byte{}, tlsKey...), tlsCert...)},
+			CombinedFile: "combined.pem",
+		},
+		{
+			Name:  "Key Not Found",
+			Files: map[string][]byte{"tls.crt": tlsCert},
+			Error: "no such file",
+		},
+		{
+			Name:  "Mismatched Key",
+			Files: map[string][]byte{"tls.crt": tlsCert, "tls.key": otherKey},
+			Error: "invalid key pair",
+		},
+		{
+			Name:         "Combined File Mismatched Key",
+			Files:        map[string][]byte{"combined.pem": append(append([]byte{}, otherKey...), tlsCert...)},
+			CombinedFile: "combined.pem",
+			Error:        "invalid key pair",
+		},
+		{
+			Name:         "Combined File Without Key",
+			Files:        map[string][]byte{"combined.pem": tlsCert},
+			CombinedFile: "combined.pem",
+			Error:        "no private key found",
+		},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			dir := t.TempDir()
+			for name, data := range tc.Files {
+				if err := os.WriteFile(filepath.Join(dir, name), data, 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			fetcher := NewFileFetcher(dir, "tls.crt", "tls.key", tc.CombinedFile)
+			cert, key, err := fetcher.Fetch(ctx)
+			if tc.Error != "" {
+				if assert.Error(t, err) {
+					assert.Contains(t, err.Error(), tc.Error)
+				}
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, tlsCert, cert)
+			assert.Equal(t, tlsKey, key)
+		})
+	}
+}
+
+func waitForChange(t *testing.T, changes <-chan struct{}) {
+	t.Helper()
+	select {
+	case <-changes:
+	case <-time.After(5 * time.Second):
+		t.Fatal("change was not notified")
+	}
+}
+
+func TestFileFetcherWatch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "tls.crt"), []byte("cert1"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "tls.key"), []byte("key1"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	changes, err := NewFileFetcher(dir, "tls.crt", "tls.key", "").Watch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Atomic replace by rename
+	if err := os.WriteFile(filepath.Join(dir, "tls.crt.tmp"), []byte("cert2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(filepath.Join(dir, "tls.crt.tmp"), filepath.Join(dir, "tls.crt")); err != nil {
+		t.Fatal(err)
+	}
+	waitForChange(t, changes)
+}
+
+func TestFileFetcherWatchKubernetesVolume(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	dir := t.TempDir()
+	// Layout of a Secret volume written by kubelet
+	writeVersion := func(version string, cert []byte, key []byte) {
+		if err := os.Mkdir(filepath.Join(dir, version), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, version, "tls.crt"), cert, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, version, "tls.key"), key, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(version, filepath.Join(dir, "..data_tmp")); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cert1, key1 := newTestCertificate(t, "example.com", time.Now().Add(time.Hour))
+	cert2, key2 := newTestCertificate(t, "example.com", time.Now().Add(time.Hour))
+	writeVersion("..2024_01_01", cert1, key1)
+	for _, name := range []string{"tls.crt", "tls.key"} {
+		if err := os.Symlink(filepath.Join("..data", name), filepath.Join(dir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fetcher := NewFileFetcher(dir, "tls.crt", "tls.key", "")
+	changes, err := fetcher.Watch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeVersion("..2024_01_02", cert2, key2)
+	waitForChange(t, changes)
+	cert, _, err := fetcher.Fetch(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, cert2, cert)
+}
+
+func TestFileSyncer(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	leaf, tlsKey := newTestCertificate(t, "example.com", time.Now().Add(time.Hour))
+	intermediate, _ := newTestCertificate(t, "intermediate", time.Now().Add(time.Hour))
+	tlsCert := append(append([]byte{}, leaf...), intermediate...)
+	paths := FilePaths{
+		Cert:      filepath.Join(dir, "cert.pem"),
+		Key:       filepath.Join(dir, "privkey.pem"),
+		Chain:     filepath.Join(dir, "chain.pem"),
+		FullChain: filepath.Join(dir, "fullchain.pem"),
+	}
+	marker := filepath.Join(dir, "reloaded")
+	syncer := NewFileSyncer(paths, 0640, 0600, -1, -1, []string{"touch", marker}, "", nil)
+
+	if err := syncer.Sync(ctx, tlsCert, tlsKey); err != nil {
+		t.Fatalf("unexpected error in sync: %+v", err)
+	}
+	for path, expected := range map[string][]byte{paths.Cert: leaf, paths.Chain: intermediate, paths.FullChain: tlsCert, paths.Key: tlsKey} {
+		data, err := os.ReadFile(path)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, data, path)
+	}
+	info, err := os.Stat(paths.Cert)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0640), info.Mode().Perm())
+	info, err = os.Stat(paths.Key)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	assert.FileExists(t, marker)
+
+	// Nothing is written and reloaded when the content is unchanged.
+	if err := os.Remove(marker); err != nil {
+		t.Fatal(err)
+	}
+	if err := syncer.Sync(ctx, tlsCert, tlsKey); err != nil {
+		t.Fatalf("unexpected error in sync: %+v", err)
+	}
+	assert.NoFileExists(t, marker)
+	entries, err := os.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Len(t, entries, 4)
+}
+
+func TestFileSyncerReloadSignal(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	pidFile := filepath.Join(dir, "app.pid")
+	if err := os.WriteFile(pidFile, []byte(fmt.Sprintf("%d\n", os.Getpid())), 0600); err != nil {
+		t.Fatal(err)
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+	defer signal.Stop(signals)
+
+	sig, err := ParseSignal("SIGUSR1")
+	assert.Nil(t, err)
+	syncer := NewFileSyncer(FilePaths{Cert: filepath.Join(dir, "tls.crt"), Key: filepath.Join(dir, "tls.key")}, 0644, 0600, -1, -1, nil, pidFile, sig)
+	tlsCert, tlsKey := newTestCertificate(t, "example.com", time.Now().Add(time.Hour))
+	if err := syncer.Sync(ctx, tlsCert, tlsKey); err != nil {
+		t.Fatalf("unexpected error in sync: %+v", err)
+	}
+	select {
+	case <-signals:
+	case <-time.After(5 * time.Second):
+		t.Fatal("signal was not sent")
+	}
+}
+
+func TestFileSyncerReloadCommandFailure(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	syncer := NewFileSyncer(FilePaths{FullChain: filepath.Join(dir, "tls.crt"), Key: filepath.Join(dir, "tls.key")}, 0644, 0600, -1, -1, []string{"false"}, "", nil)
+	err := syncer.Sync(ctx, []byte("tlsCert"), []byte("tlsKey"))
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "reload command")
+	}
+
+	// The reload is retried with the same files until it succeeds.
+	err = syncer.Sync(ctx, []byte("tlsCert"), []byte("tlsKey"))
+	assert.Error(t, err)
+	marker := filepath.Join(dir, "reloaded")
+	syncer.reloadCommand = []string{"touch", marker}
+	assert.NoError(t, syncer.Sync(ctx, []byte("tlsCert"), []byte("tlsKey")))
+	assert.FileExists(t, marker)
+	assert.NoError(t, os.Remove(marker))
+	assert.NoError(t, syncer.Sync(ctx, []byte("tlsCert"), []byte("tlsKey")))
+	assert.NoFileExists(t, marker)
+}
@@ -3,115 +3,688 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	goerrors "errors"
+	"fmt"
 	"log"
 	"strings"
 
 	apiv1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 )
 
+// restartedFingerprintAnnotation is set on pod templates to restart workloads referencing an updated secret.
+const restartedFingerprintAnnotation = annotationKey + "/restarted-fingerprint"
+
+// restartPendingAnnotation is set on a synced secret with the fingerprint of its certificate
+// until workloads referencing it are restarted, so failed restarts are retried on the next sync.
+const restartPendingAnnotation = annotationKey + "/restart-pending"
+
+// backupOfAnnotation is set on a backup secret with the name of the secret being replaced.
+const backupOfAnnotation = annotationKey + "/backup-of"
+
+// Labels on synced secrets recording which pipeline and source produced them.
+// Secrets with managedByLabel, and the pipeline and source name labels of the syncer, are owned by it.
+// The source namespace is recorded but not part of the ownership, so changing it does not orphan copies.
+// The source name label is a hash, as secret names may be longer than label values.
+const (
+	pipelineLabel          = annotationKey + "/pipeline"
+	sourceNamespaceLabel   = annotationKey + "/source-namespace"
+	sourceNameLabel        = annotationKey + "/source-name"
+	sourceFingerprintLabel = annotationKey + "/source-fingerprint"
+)
+
+// Adoption policies for a secret of the destination name not owned by any syncer.
+const (
+	// AdoptNever leaves the secret as it is and reports the namespace as blocked.
+	AdoptNever = "never"
+	// AdoptTLS adopts the secret if its type is kubernetes.io/tls.
+	AdoptTLS = "tls"
+	// AdoptAlways adopts the secret and changes its type to kubernetes.io/tls if needed.
+	AdoptAlways = "always"
+)
+
+// defaultPipeline is the pipeline label of syncers without KubernetesSyncOptions.Pipeline.
+const defaultPipeline = "default"
+
+// KubernetesSyncOptions are optional behaviors of KubernetesSyncer.
+type KubernetesSyncOptions struct {
+	// RestartWorkloads restarts Deployments, StatefulSets and DaemonSets referencing an updated secret,
+	// for pods which read it through env vars or never reload it.
+	RestartWorkloads bool
+	// DiscoverReferences creates the secret also in namespaces where Ingresses or Gateways reference it.
+	DiscoverReferences bool
+	// ReferenceGrantNamespace keeps the secret only in this namespace, and instead of copying it,
+	// creates ReferenceGrants allowing Gateways in the other namespaces to use it.
+	// Namespaces discovered by Ingresses still get a copy, as Ingresses cannot reference other namespaces.
+	ReferenceGrantNamespace string
+	// DestinationNames renames secrets keyed by the source secret name. Unlisted secrets keep the source name.
+	DestinationNames map[string]string
+	// Pipeline distinguishes secrets of syncers sharing a cluster. Secrets of other pipelines are never modified.
+	Pipeline string
+	// SourceNamespace is recorded in the ownership labels. The source secrets in it are never synced over.
+	SourceNamespace string
+	// AdoptionPolicy is one of AdoptNever, AdoptTLS and AdoptAlways. Empty means AdoptNever.
+	// Secrets owned by other pipelines are never adopted.
+	AdoptionPolicy string
+	// KeepLegacySecrets leaves secrets synced before ownership labels, which have only the annotation
+	// of the source secret name, as they are. By default they are migrated to the ownership labels of the syncer
+	// if still requested, and removed otherwise.
+	KeepLegacySecrets bool
+}
+
+// ParseKubernetesSecretNames parses secret names such as "tls-cert" or "tls-cert=www-cert",
+// renaming the source secret tls-cert to www-cert in destination namespaces.
+// It returns the source secret names and the destination names for KubernetesSyncOptions.DestinationNames.
+func ParseKubernetesSecretNames(values []string) ([]string, map[string]string, error) {
+	var sources []string
+	destinations := make(map[string]string)
+	sourceOf := make(map[string]string)
+	for _, value := range values {
+		source, destination, ok := strings.Cut(value, "=")
+		if !ok {
+			destination = source
+		}
+		if source == "" || destination == "" {
+			return nil, nil, fmt.Errorf("invalid secret name %q: expected name or source=destination", value)
+		}
+		if other, ok := sourceOf[destination]; ok {
+			return nil, nil, fmt.Errorf("invalid secret name %q: destination %s is also used by %s", value, destination, other)
+		}
+		if containsString(sources, source) {
+			return nil, nil, fmt.Errorf("invalid secret name %q: source %s is given twice", value, source)
+		}
+		sourceOf[destination] = source
+		sources = append(sources, source)
+		if destination != source {
+			destinations[source] = destination
+		}
+	}
+	return sources, destinations, nil
+}
+
+// KubernetesSyncer copies certificates to namespaces requesting them by the annotation,
+// for one or more secret names in a single pass over namespaces.
+// It needs list on namespaces, and get, list, create, update and delete on secrets in all namespaces.
+// Secrets are listed by the ownership labels, and by the lack of them to find legacy secrets.
 type KubernetesSyncer struct {
-	k          kubernetes.Interface
-	secretName string
+	k           kubernetes.Interface
+	dynamic     dynamic.Interface
+	secretNames []string
+	options     KubernetesSyncOptions
+	// blocked is the set of "namespace/name" of secrets blocked by unmanaged secrets in the last sync.
+	blocked map[string]bool
 }
 
-func NewKubernetesSyncer(k kubernetes.Interface, secretName string) *KubernetesSyncer {
+// NewKubernetesSyncer creates a syncer. dynamicClient is used only for Gateway API and may be nil otherwise.
+func NewKubernetesSyncer(k kubernetes.Interface, dynamicClient dynamic.Interface, secretNames []string, options KubernetesSyncOptions) *KubernetesSyncer {
+	if options.Pipeline == "" {
+		options.Pipeline = defaultPipeline
+	}
 	return &KubernetesSyncer{
-		k:          k,
-		secretName: secretName,
+		k:           k,
+		dynamic:     dynamicClient,
+		secretNames: secretNames,
+		options:     options,
 	}
 }
 
-func (s *KubernetesSyncer) checkAnnotations(list string, key string) bool {
-	for _, k := range strings.Split(list, ",") {
-		if k == key {
-			return true
+// destinationName returns the name of the secret synced from the source secret.
+func (s *KubernetesSyncer) destinationName(source string) string {
+	if name, ok := s.options.DestinationNames[source]; ok {
+		return name
+	}
+	return source
+}
+
+// requestedNames parses the namespace annotation, a comma separated list of source secret names
+// each optionally followed by "=" and the local name, into local names keyed by source secret name.
+// Entries with an invalid local name are skipped, so a typo in one namespace does not stop syncing the others.
+func (s *KubernetesSyncer) requestedNames(namespace string, list string) map[string]string {
+	names := make(map[string]string)
+	for _, v := range strings.Split(list, ",") {
+		source, local, ok := strings.Cut(strings.TrimSpace(v), "=")
+		if !ok {
+			local = s.destinationName(source)
 		}
+		if source == "" || local == "" {
+			continue
+		}
+		if msgs := validation.IsDNS1123Subdomain(local); len(msgs) > 0 {
+			log.Printf("skip invalid secret name for namespace=%s,name=%s: %s", namespace, local, strings.Join(msgs, ", "))
+			continue
+		}
+		names[source] = local
 	}
-	return false
+	return names
 }
 
+// Sync syncs the certificate as the first secret name.
 func (s *KubernetesSyncer) Sync(ctx context.Context, tlsCert []byte, tlsKey []byte) error {
+	return s.SyncAll(ctx, map[string]TLSKeyPair{
+		s.secretNames[0]: {Cert: tlsCert, Key: tlsKey},
+	})
+}
+
+// SyncAll syncs certificates keyed by source secret name.
+// Secrets of names missing in certs, such as ones failed to fetch, are left as they are.
+func (s *KubernetesSyncer) SyncAll(ctx context.Context, certs map[string]TLSKeyPair) error {
 	namespaces, err := s.k.CoreV1().Namespaces().List(ctx, metav1.ListOptions{})
 	if err != nil {
 		return err
 	}
+	byIngress := make(map[string]map[string]bool)
+	byGateway := make(map[string]map[string]bool)
+	if s.options.DiscoverReferences {
+		byIngress, byGateway, err = s.referencingNamespaces(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	owned, err := s.ownedSecrets(ctx)
+	if err != nil {
+		return err
+	}
+	legacy := make(map[string]map[string][]apiv1.Secret)
+	if !s.options.KeepLegacySecrets {
+		legacy, err = s.legacySecrets(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	granted := make(map[string][]string)
+	blocked := make(map[string]bool)
 	for _, ns := range namespaces.Items {
-		createSecret := s.checkAnnotations(ns.GetAnnotations()[annotationKey], s.secretName)
-
-		secret, err := s.k.CoreV1().Secrets(ns.Name).Get(ctx, s.secretName, metav1.GetOptions{})
-		if errors.IsNotFound(err) {
-			if createSecret {
-				log.Printf("create secret for namespace=%s,name=%s", ns.Name, s.secretName)
-				secret := apiv1.Secret{
-					ObjectMeta: metav1.ObjectMeta{
-						Name: s.secretName,
-						Annotations: map[string]string{
-							annotationKey: s.secretName,
-						},
-					},
-					Type: apiv1.SecretTypeTLS,
-					Data: map[string][]byte{
-						"tls.key": tlsKey,
-						"tls.crt": tlsCert,
-					},
+		requested := s.requestedNames(ns.Name, ns.GetAnnotations()[annotationKey])
+		for _, source := range s.secretNames {
+			pair, ok := certs[source]
+			if !ok {
+				continue
+			}
+			name, createSecret := requested[source]
+			if s.options.ReferenceGrantNamespace == "" {
+				if !createSecret && (byIngress[source][ns.Name] || byGateway[source][ns.Name]) {
+					name, createSecret = s.destinationName(source), true
 				}
-				_, err := s.k.CoreV1().Secrets(ns.Name).Create(ctx, &secret, metav1.CreateOptions{})
-				if err != nil {
+			} else if ns.Name == s.options.ReferenceGrantNamespace {
+				name, createSecret = s.destinationName(source), true
+			} else {
+				if createSecret || byGateway[source][ns.Name] {
+					granted[source] = append(granted[source], ns.Name)
+				}
+				// Ingresses cannot use secrets in other namespaces, so they still get a copy.
+				name, createSecret = s.destinationName(source), byIngress[source][ns.Name]
+			}
+			// Remove copies no longer requested, including ones under a previous local name.
+			for _, secret := range append(owned[ns.Name][source], legacy[ns.Name][source]...) {
+				if (createSecret && secret.Name == name) || s.isSource(ns.Name, secret.Name) {
+					continue
+				}
+				log.Printf("remove secret for namespace=%s,name=%s", ns.Name, secret.Name)
+				if err := s.k.CoreV1().Secrets(ns.Name).Delete(ctx, secret.Name, metav1.DeleteOptions{}); err != nil {
 					return err
 				}
 			}
-		} else if err != nil {
-			return err
-
-		} else {
-			if secret.GetAnnotations()[annotationKey] != s.secretName {
-				continue
+			if createSecret && s.isSource(ns.Name, name) {
+				log.Printf("skip source secret for namespace=%s,name=%s", ns.Name, name)
+				createSecret = false
 			}
 			if createSecret {
-				// Sync
-				if !bytes.Equal(secret.Data["tls.key"], tlsKey) || !bytes.Equal(secret.Data["tls.crt"], tlsCert) {
-					// Update Secret
-					log.Printf("update secret for namespace=%s,name=%s", ns.Name, s.secretName)
-					secret.Data["tls.key"] = tlsKey
-					secret.Data["tls.crt"] = tlsCert
-					_, err := s.k.CoreV1().Secrets(ns.Name).Update(ctx, secret, metav1.UpdateOptions{})
-					if err != nil {
-						return err
-					}
-				}
-			} else {
-				log.Printf("remove secret for namespace=%s,name=%s", ns.Name, s.secretName)
-				if err := s.k.CoreV1().Secrets(ns.Name).Delete(ctx, secret.Name, metav1.DeleteOptions{}); err != nil {
+				if err := s.reconcileSecret(ctx, ns.Name, source, name, pair, blocked); err != nil {
 					return err
 				}
 			}
 		}
 	}
+	for key := range s.blocked {
+		if !blocked[key] {
+			namespace, name, _ := strings.Cut(key, "/")
+			kubernetesBlockedSecrets.DeleteLabelValues(namespace, name)
+		}
+	}
+	s.blocked = blocked
+	if s.options.ReferenceGrantNamespace != "" {
+		for _, source := range s.secretNames {
+			if _, ok := certs[source]; !ok {
+				continue
+			}
+			if err := s.reconcileReferenceGrants(ctx, source, granted[source]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// isSource returns whether name in namespace is one of the source secrets, which must never be synced over or removed.
+func (s *KubernetesSyncer) isSource(namespace string, name string) bool {
+	return s.options.SourceNamespace != "" && namespace == s.options.SourceNamespace && containsString(s.secretNames, name)
+}
+
+// ownerLabels returns the labels recording the ownership of the secret synced from source.
+func (s *KubernetesSyncer) ownerLabels(source string, tlsCert []byte) map[string]string {
+	return map[string]string{
+		managedByLabel:         managedByValue,
+		pipelineLabel:          s.options.Pipeline,
+		sourceNamespaceLabel:   s.options.SourceNamespace,
+		sourceNameLabel:        sourceNameHash(source),
+		sourceFingerprintLabel: sourceFingerprint(tlsCert),
+	}
+}
+
+// sourceFingerprint is the sha256 of the certificate, truncated to fit in a label value.
+func sourceFingerprint(tlsCert []byte) string {
+	return fmt.Sprintf("%x", sha256.Sum256(tlsCert))[:32]
+}
+
+// sourceNameHash is the sha256 of the source secret name, truncated to fit in a label value.
+func sourceNameHash(source string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(source)))[:32]
+}
+
+// owns reports whether secret was synced from source by this syncer.
+func (s *KubernetesSyncer) owns(secret *apiv1.Secret, source string) bool {
+	labels := secret.GetLabels()
+	return labels[managedByLabel] == managedByValue &&
+		labels[pipelineLabel] == s.options.Pipeline &&
+		labels[sourceNameLabel] == sourceNameHash(source)
+}
+
+// isLegacy reports whether secret was synced from source before ownership labels,
+// when only the annotation of the source secret name was recorded.
+func isLegacy(secret *apiv1.Secret, source string) bool {
+	return secret.GetLabels()[managedByLabel] == "" && secret.GetAnnotations()[annotationKey] == source
+}
+
+// legacySecrets returns secrets synced before ownership labels from the sources of the syncer,
+// keyed by namespace and source secret name.
+func (s *KubernetesSyncer) legacySecrets(ctx context.Context) (map[string]map[string][]apiv1.Secret, error) {
+	unlabeled, err := labels.NewRequirement(managedByLabel, selection.DoesNotExist, nil)
+	if err != nil {
+		return nil, err
+	}
+	selector := labels.NewSelector().Add(*unlabeled)
+	secrets, err := s.k.CoreV1().Secrets(metav1.NamespaceAll).List(ctx, metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return nil, fmt.Errorf("list legacy secrets: %w", err)
+	}
+	legacy := make(map[string]map[string][]apiv1.Secret)
+	for _, secret := range secrets.Items {
+		source := secret.GetAnnotations()[annotationKey]
+		if !containsString(s.secretNames, source) || !isLegacy(&secret, source) {
+			continue
+		}
+		if legacy[secret.Namespace] == nil {
+			legacy[secret.Namespace] = make(map[string][]apiv1.Secret)
+		}
+		legacy[secret.Namespace][source] = append(legacy[secret.Namespace][source], secret)
+	}
+	return legacy, nil
+}
+
+// ownedSecrets returns secrets owned by the syncer, keyed by namespace and source secret name.
+func (s *KubernetesSyncer) ownedSecrets(ctx context.Context) (map[string]map[string][]apiv1.Secret, error) {
+	selector := labels.SelectorFromSet(labels.Set{
+		managedByLabel: managedByValue,
+		pipelineLabel:  s.options.Pipeline,
+	})
+	secrets, err := s.k.CoreV1().Secrets(metav1.NamespaceAll).List(ctx, metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return nil, fmt.Errorf("list owned secrets: %w", err)
+	}
+	sources := make(map[string]string)
+	for _, source := range s.secretNames {
+		sources[sourceNameHash(source)] = source
+	}
+	owned := make(map[string]map[string][]apiv1.Secret)
+	for _, secret := range secrets.Items {
+		source, ok := sources[secret.Labels[sourceNameLabel]]
+		if !ok || !s.owns(&secret, source) {
+			continue
+		}
+		if owned[secret.Namespace] == nil {
+			owned[secret.Namespace] = make(map[string][]apiv1.Secret)
+		}
+		owned[secret.Namespace][source] = append(owned[secret.Namespace][source], secret)
+	}
+	return owned, nil
+}
+
+// reconcileSecret creates or updates the secret name synced from the source secret.
+// A secret of the name not created by the syncer is left as it is unless the adoption policy allows,
+// and is recorded in blocked.
+func (s *KubernetesSyncer) reconcileSecret(ctx context.Context, namespace string, source string, name string, pair TLSKeyPair, blocked map[string]bool) error {
+	secret, err := s.k.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		log.Printf("create secret for namespace=%s,name=%s", namespace, name)
+		secret := apiv1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:   name,
+				Labels: s.ownerLabels(source, pair.Cert),
+				Annotations: map[string]string{
+					annotationKey: source,
+				},
+			},
+			Type: apiv1.SecretTypeTLS,
+			Data: map[string][]byte{
+				"tls.key": pair.Key,
+				"tls.crt": pair.Cert,
+			},
+		}
+		_, err := s.k.CoreV1().Secrets(namespace).Create(ctx, &secret, metav1.CreateOptions{})
+		return err
+	} else if err != nil {
+		return err
+	}
+	fingerprint := fmt.Sprintf("%x", sha256.Sum256(pair.Cert))
+	adopted := false
+	if !s.owns(secret, source) {
+		if !s.options.KeepLegacySecrets && isLegacy(secret, source) {
+			log.Printf("migrate secret for namespace=%s,name=%s", namespace, name)
+		} else if !s.adoptable(secret) {
+			return s.block(ctx, secret, blocked)
+		} else {
+			log.Printf("adopt secret for namespace=%s,name=%s", namespace, name)
+		}
+		original := secret.DeepCopy()
+		if secret.Labels == nil {
+			secret.Labels = make(map[string]string)
+		}
+		for k, v := range s.ownerLabels(source, pair.Cert) {
+			secret.Labels[k] = v
+		}
+		if secret.Annotations == nil {
+			secret.Annotations = make(map[string]string)
+		}
+		secret.Annotations[annotationKey] = source
+		if secret.Type != apiv1.SecretTypeTLS {
+			// The type is immutable.
+			secret.Type = apiv1.SecretTypeTLS
+			secret.Data = map[string][]byte{
+				"tls.key": pair.Key,
+				"tls.crt": pair.Cert,
+			}
+			if s.options.RestartWorkloads {
+				secret.Annotations[restartPendingAnnotation] = fingerprint
+			}
+			secret, err = s.replaceSecret(ctx, original, secret)
+			if err != nil {
+				return err
+			}
+			return s.restartPending(ctx, secret)
+		}
+		if secret.Data == nil {
+			secret.Data = make(map[string][]byte)
+		}
+		adopted = true
+	}
+	if adopted || !bytes.Equal(secret.Data["tls.key"], pair.Key) || !bytes.Equal(secret.Data["tls.crt"], pair.Cert) {
+		// Update Secret
+		log.Printf("update secret for namespace=%s,name=%s", namespace, name)
+		secret.Data["tls.key"] = pair.Key
+		secret.Data["tls.crt"] = pair.Cert
+		secret.Labels[sourceNamespaceLabel] = s.options.SourceNamespace
+		secret.Labels[sourceFingerprintLabel] = sourceFingerprint(pair.Cert)
+		if s.options.RestartWorkloads {
+			if secret.Annotations == nil {
+				secret.Annotations = make(map[string]string)
+			}
+			secret.Annotations[restartPendingAnnotation] = fingerprint
+		}
+		secret, err = s.k.CoreV1().Secrets(namespace).Update(ctx, secret, metav1.UpdateOptions{})
+		if err != nil {
+			return err
+		}
+	}
+	return s.restartPending(ctx, secret)
+}
+
+// backupSecretName returns the name of the backup of the secret name while it is replaced.
+func backupSecretName(name string) string {
+	return fmt.Sprintf("tls-secrets-sync-backup-%x", sha256.Sum256([]byte(name)))[:40]
+}
+
+// replaceSecret replaces secret as it is on the server with replacement of the same name, which cannot be done
+// by an update as the type is immutable. The original is kept in a backup secret until the replacement is created,
+// and is restored if creating the replacement fails.
+func (s *KubernetesSyncer) replaceSecret(ctx context.Context, secret *apiv1.Secret, replacement *apiv1.Secret) (*apiv1.Secret, error) {
+	client := s.k.CoreV1().Secrets(secret.Namespace)
+	original := secret.DeepCopy()
+	original.ResourceVersion = ""
+	original.UID = ""
+	backup := original.DeepCopy()
+	backup.Name = backupSecretName(secret.Name)
+	backup.Annotations = map[string]string{backupOfAnnotation: secret.Name}
+	backup.Labels = nil
+	if _, err := client.Create(ctx, backup, metav1.CreateOptions{}); err != nil {
+		return nil, fmt.Errorf("create backup secret %s/%s: %w", backup.Namespace, backup.Name, err)
+	}
+	log.Printf("replace secret for namespace=%s,name=%s", secret.Namespace, secret.Name)
+	preconditions := metav1.Preconditions{UID: &secret.UID, ResourceVersion: &secret.ResourceVersion}
+	if err := client.Delete(ctx, secret.Name, metav1.DeleteOptions{Preconditions: &preconditions}); err != nil {
+		return nil, fmt.Errorf("delete secret %s/%s: %w", secret.Namespace, secret.Name, err)
+	}
+	replacement.ResourceVersion = ""
+	replacement.UID = ""
+	created, err := client.Create(ctx, replacement, metav1.CreateOptions{})
+	if err != nil {
+		log.Printf("restore secret for namespace=%s,name=%s", secret.Namespace, secret.Name)
+		if _, restoreErr := client.Create(ctx, original, metav1.CreateOptions{}); restoreErr != nil {
+			return nil, fmt.Errorf("create secret %s/%s: %w, and restore failed, the original is kept in %s: %v",
+				secret.Namespace, secret.Name, err, backup.Name, restoreErr)
+		}
+		s.deleteBackupSecret(ctx, backup)
+		return nil, fmt.Errorf("create secret %s/%s: %w", secret.Namespace, secret.Name, err)
+	}
+	s.deleteBackupSecret(ctx, backup)
+	return created, nil
+}
+
+// deleteBackupSecret deletes backup no longer needed. A failure is only logged, as the backup is harmless.
+func (s *KubernetesSyncer) deleteBackupSecret(ctx context.Context, backup *apiv1.Secret) {
+	if err := s.k.CoreV1().Secrets(backup.Namespace).Delete(ctx, backup.Name, metav1.DeleteOptions{}); err != nil {
+		log.Printf("failed to delete backup secret for namespace=%s,name=%s: %v", backup.Namespace, backup.Name, err)
+	}
+}
+
+// restartPending restarts workloads referencing the secret if a restart is pending, and then clears the record.
+func (s *KubernetesSyncer) restartPending(ctx context.Context, secret *apiv1.Secret) error {
+	fingerprint := secret.GetAnnotations()[restartPendingAnnotation]
+	if !s.options.RestartWorkloads || fingerprint == "" {
+		return nil
+	}
+	if err := s.restart(ctx, secret.Namespace, secret.Name, fingerprint); err != nil {
+		return err
+	}
+	delete(secret.Annotations, restartPendingAnnotation)
+	_, err := s.k.CoreV1().Secrets(secret.Namespace).Update(ctx, secret, metav1.UpdateOptions{})
+	return err
+}
+
+// adoptable reports whether the secret not owned by the syncer can be adopted under the adoption policy.
+func (s *KubernetesSyncer) adoptable(secret *apiv1.Secret) bool {
+	if secret.GetLabels()[managedByLabel] == managedByValue || secret.GetAnnotations()[annotationKey] != "" {
+		// Owned by another pipeline or source.
+		return false
+	}
+	switch s.options.AdoptionPolicy {
+	case AdoptAlways:
+		return true
+	case AdoptTLS:
+		return secret.Type == apiv1.SecretTypeTLS
+	default:
+		return false
+	}
+}
+
+// block records the namespace requesting the secret as blocked by the unmanaged secret,
+// emitting a warning event when it is newly blocked.
+func (s *KubernetesSyncer) block(ctx context.Context, secret *apiv1.Secret, blocked map[string]bool) error {
+	key := secret.Namespace + "/" + secret.Name
+	blocked[key] = true
+	kubernetesBlockedSecrets.WithLabelValues(secret.Namespace, secret.Name).Set(1)
+	if s.blocked[key] {
+		return nil
+	}
+	log.Printf("blocked by unmanaged secret for namespace=%s,name=%s", secret.Namespace, secret.Name)
+	now := metav1.Now()
+	event := &apiv1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("%s.%x", secret.Name, now.UnixNano()),
+			Namespace: secret.Namespace,
+		},
+		InvolvedObject: apiv1.ObjectReference{
+			Kind:            "Secret",
+			APIVersion:      "v1",
+			Namespace:       secret.Namespace,
+			Name:            secret.Name,
+			UID:             secret.UID,
+			ResourceVersion: secret.ResourceVersion,
+		},
+		Reason:         "SyncBlocked",
+		Message:        fmt.Sprintf("secret is requested but not managed by %s, and not adopted by the adoption policy", managedByValue),
+		Type:           apiv1.EventTypeWarning,
+		Source:         apiv1.EventSource{Component: managedByValue},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	}
+	if _, err := s.k.CoreV1().Events(secret.Namespace).Create(ctx, event, metav1.CreateOptions{}); err != nil {
+		// The sync itself is not failed by the event.
+		log.Print("failed to create event: ", err)
+	}
+	return nil
+}
+
+// podSpecReferencesSecret reports whether spec uses secretName through volumes, env or envFrom.
+func podSpecReferencesSecret(spec *apiv1.PodSpec, secretName string) bool {
+	for _, v := range spec.Volumes {
+		if v.Secret != nil && v.Secret.SecretName == secretName {
+			return true
+		}
+		if v.Projected != nil {
+			for _, source := range v.Projected.Sources {
+				if source.Secret != nil && source.Secret.Name == secretName {
+					return true
+				}
+			}
+		}
+	}
+	containers := append(append([]apiv1.Container{}, spec.InitContainers...), spec.Containers...)
+	for _, c := range containers {
+		for _, env := range c.Env {
+			if env.ValueFrom != nil && env.ValueFrom.SecretKeyRef != nil && env.ValueFrom.SecretKeyRef.Name == secretName {
+				return true
+			}
+		}
+		for _, envFrom := range c.EnvFrom {
+			if envFrom.SecretRef != nil && envFrom.SecretRef.Name == secretName {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// restartTemplate sets fingerprint on the pod template, reporting whether the workload needs an update.
+func restartTemplate(template *apiv1.PodTemplateSpec, secretName string, fingerprint string) bool {
+	if !podSpecReferencesSecret(&template.Spec, secretName) || template.Annotations[restartedFingerprintAnnotation] == fingerprint {
+		return false
+	}
+	if template.Annotations == nil {
+		template.Annotations = make(map[string]string)
+	}
+	template.Annotations[restartedFingerprintAnnotation] = fingerprint
+	return true
+}
+
+// restart triggers a rolling restart of workloads in namespace referencing the secret,
+// the same way as kubectl rollout restart but with the fingerprint of the certificate.
+func (s *KubernetesSyncer) restart(ctx context.Context, namespace string, secretName string, fingerprint string) error {
+	deployments, err := s.k.AppsV1().Deployments(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	for i := range deployments.Items {
+		d := &deployments.Items[i]
+		if restartTemplate(&d.Spec.Template, secretName, fingerprint) {
+			log.Printf("restart deployment for namespace=%s,name=%s", namespace, d.Name)
+			if _, err := s.k.AppsV1().Deployments(namespace).Update(ctx, d, metav1.UpdateOptions{}); err != nil {
+				return err
+			}
+		}
+	}
+	statefulSets, err := s.k.AppsV1().StatefulSets(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	for i := range statefulSets.Items {
+		ss := &statefulSets.Items[i]
+		if restartTemplate(&ss.Spec.Template, secretName, fingerprint) {
+			log.Printf("restart statefulset for namespace=%s,name=%s", namespace, ss.Name)
+			if _, err := s.k.AppsV1().StatefulSets(namespace).Update(ctx, ss, metav1.UpdateOptions{}); err != nil {
+				return err
+			}
+		}
+	}
+	daemonSets, err := s.k.AppsV1().DaemonSets(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	for i := range daemonSets.Items {
+		ds := &daemonSets.Items[i]
+		if restartTemplate(&ds.Spec.Template, secretName, fingerprint) {
+			log.Printf("restart daemonset for namespace=%s,name=%s", namespace, ds.Name)
+			if _, err := s.k.AppsV1().DaemonSets(namespace).Update(ctx, ds, metav1.UpdateOptions{}); err != nil {
+				return err
+			}
+		}
+	}
 	return nil
 }
 
 type KubernetesFetcher struct {
-	k          kubernetes.Interface
-	namespace  string
-	secretName string
+	k           kubernetes.Interface
+	namespace   string
+	secretNames []string
 }
 
-func NewKubernetesFetcher(k kubernetes.Interface, namespace string, secretName string) *KubernetesFetcher {
+func NewKubernetesFetcher(k kubernetes.Interface, namespace string, secretNames ...string) *KubernetesFetcher {
 	return &KubernetesFetcher{
-		k:          k,
-		namespace:  namespace,
-		secretName: secretName,
+		k:           k,
+		namespace:   namespace,
+		secretNames: secretNames,
 	}
 }
 
+// Fetch fetches the first secret.
 func (f *KubernetesFetcher) Fetch(ctx context.Context) ([]byte, []byte, error) {
-	ret, err := f.k.CoreV1().Secrets(f.namespace).Get(ctx, f.secretName, metav1.GetOptions{})
+	ret, err := f.k.CoreV1().Secrets(f.namespace).Get(ctx, f.secretNames[0], metav1.GetOptions{})
 	if err != nil {
 		return nil, nil, err
 	}
 	return ret.Data["tls.crt"], ret.Data["tls.key"], nil
 }
+
+// FetchAll fetches every secret. Secrets failed to fetch are missing in the result and reported in the error,
+// so the others are still synced.
+func (f *KubernetesFetcher) FetchAll(ctx context.Context) (map[string]TLSKeyPair, error) {
+	certs := make(map[string]TLSKeyPair)
+	var errs []error
+	for _, secretName := range f.secretNames {
+		ret, err := f.k.CoreV1().Secrets(f.namespace).Get(ctx, secretName, metav1.GetOptions{})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("get secret %s: %w", secretName, err))
+			continue
+		}
+		certs[secretName] = TLSKeyPair{Cert: ret.Data["tls.crt"], Key: ret.Data["tls.key"]}
+	}
+	return certs, goerrors.Join(errs...)
+}
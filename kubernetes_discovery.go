@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// gatewayGVRs are the Gateway API versions to discover Gateways, in order of preference.
+var gatewayGVRs = []schema.GroupVersionResource{
+	{Group: "gateway.networking.k8s.io", Version: "v1", Resource: "gateways"},
+	{Group: "gateway.networking.k8s.io", Version: "v1beta1", Resource: "gateways"},
+}
+
+// referencingNamespaces returns namespaces where an Ingress or a Gateway listener references the destination secret,
+// keyed by the source secret name. Namespaces referenced only by Gateways are returned separately,
+// as Gateways can use the secret through a ReferenceGrant while Ingresses always need a copy.
+func (s *KubernetesSyncer) referencingNamespaces(ctx context.Context) (map[string]map[string]bool, map[string]map[string]bool, error) {
+	byIngress := make(map[string]map[string]bool)
+	byGateway := make(map[string]map[string]bool)
+	sources := make(map[string]string)
+	for _, source := range s.secretNames {
+		byIngress[source] = make(map[string]bool)
+		byGateway[source] = make(map[string]bool)
+		sources[s.destinationName(source)] = source
+	}
+	ingresses, err := s.k.NetworkingV1().Ingresses(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, nil, fmt.Errorf("list ingresses: %w", err)
+	}
+	for _, ing := range ingresses.Items {
+		for _, tls := range ing.Spec.TLS {
+			if source, ok := sources[tls.SecretName]; ok && !s.isSource(ing.Namespace, tls.SecretName) {
+				byIngress[source][ing.Namespace] = true
+			}
+		}
+	}
+
+	gateways, err := s.listGateways(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, gw := range gateways {
+		for secretName, source := range sources {
+			for _, ns := range gatewayCertificateRefNamespaces(gw, secretName, s.options.ReferenceGrantNamespace) {
+				if s.isSource(ns, secretName) {
+					continue
+				}
+				byGateway[source][ns] = true
+			}
+		}
+	}
+	return byIngress, byGateway, nil
+}
+
+// listGateways lists Gateways of the newest served version, or nothing if Gateway API is not installed.
+func (s *KubernetesSyncer) listGateways(ctx context.Context) ([]unstructured.Unstructured, error) {
+	for _, gvr := range gatewayGVRs {
+		list, err := s.dynamic.Resource(gvr).Namespace(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+		if errors.IsNotFound(err) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("list gateways: %w", err)
+		}
+		return list.Items, nil
+	}
+	log.Print("gateway api is not installed, skip discovering gateways")
+	return nil, nil
+}
+
+// gatewayCertificateRefNamespaces returns namespaces of the listener certificateRefs of gw referencing secretName.
+// A reference without namespace is to the namespace of gw.
+// A reference to grantNamespace returns the namespace of gw instead, as it is where the ReferenceGrant is needed from.
+func gatewayCertificateRefNamespaces(gw unstructured.Unstructured, secretName string, grantNamespace string) []string {
+	var namespaces []string
+	listeners, _, _ := unstructured.NestedSlice(gw.Object, "spec", "listeners")
+	for _, l := range listeners {
+		listener, ok := l.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		refs, _, _ := unstructured.NestedSlice(listener, "tls", "certificateRefs")
+		for _, r := range refs {
+			ref, ok := r.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			group, _, _ := unstructured.NestedString(ref, "group")
+			kind, found, _ := unstructured.NestedString(ref, "kind")
+			if !found {
+				kind = "Secret"
+			}
+			name, _, _ := unstructured.NestedString(ref, "name")
+			if group != "" || kind != "Secret" || name != secretName {
+				continue
+			}
+			namespace, _, _ := unstructured.NestedString(ref, "namespace")
+			if namespace == "" || (grantNamespace != "" && namespace == grantNamespace) {
+				namespace = gw.GetNamespace()
+			}
+			namespaces = append(namespaces, namespace)
+		}
+	}
+	return namespaces
+}
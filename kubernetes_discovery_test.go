@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	apiv1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func newTestGateway(namespace string, name string, refs ...map[string]interface{}) *unstructured.Unstructured {
+	var certificateRefs []interface{}
+	for _, ref := range refs {
+		certificateRefs = append(certificateRefs, ref)
+	}
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "gateway.networking.k8s.io/v1",
+		"kind":       "Gateway",
+		"metadata":   map[string]interface{}{"namespace": namespace, "name": name},
+		"spec": map[string]interface{}{
+			"listeners": []interface{}{
+				map[string]interface{}{"name": "http", "protocol": "HTTP", "port": int64(80)},
+				map[string]interface{}{
+					"name":     "https",
+					"protocol": "HTTPS",
+					"port":     int64(443),
+					"tls":      map[string]interface{}{"certificateRefs": certificateRefs},
+				},
+			},
+		},
+	}}
+}
+
+// newFakeDynamicClient returns a client serving gateways and reference grants.
+// Gateways are created through the tracker, which would guess "gatewaies" for their resource name.
+func newFakeDynamicClient(t *testing.T, gateways ...*unstructured.Unstructured) *dynamicfake.FakeDynamicClient {
+	listKinds := make(map[schema.GroupVersionResource]string)
+	for _, gvr := range gatewayGVRs {
+		listKinds[gvr] = "GatewayList"
+	}
+	listKinds[referenceGrantGVR] = "ReferenceGrantList"
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), listKinds)
+	for _, gw := range gateways {
+		if err := client.Tracker().Create(gatewayGVRs[0], gw, gw.GetNamespace()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return client
+}
+
+func Test_KubernetesSyncerDiscoverReferences(t *testing.T) {
+	ctx := context.Background()
+	namespace := func(name string) *apiv1.Namespace {
+		return &apiv1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name}}
+	}
+	clientset := fake.NewSimpleClientset(
+		namespace("ingress"), namespace("gateway"), namespace("shared"), namespace("unrelated"), namespace("stale"),
+		&networkingv1.Ingress{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "ingress", Name: "web"},
+			Spec:       networkingv1.IngressSpec{TLS: []networkingv1.IngressTLS{{SecretName: "other"}, {SecretName: "sec-cert"}}},
+		},
+		&networkingv1.Ingress{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "unrelated", Name: "web"},
+			Spec:       networkingv1.IngressSpec{TLS: []networkingv1.IngressTLS{{SecretName: "other"}}},
+		},
+		&apiv1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: "stale", Name: "sec-cert", Labels: ownerTestLabels("sec-cert"), Annotations: map[string]string{annotationKey: "sec-cert"}}},
+	)
+	dynamicClient := newFakeDynamicClient(t,
+		newTestGateway("gateway", "gw", map[string]interface{}{"name": "sec-cert"}),
+		newTestGateway("gateway", "cross", map[string]interface{}{"kind": "Secret", "name": "sec-cert", "namespace": "shared"}),
+		newTestGateway("unrelated", "gw", map[string]interface{}{"group": "example.com", "kind": "Certificate", "name": "sec-cert"}),
+	)
+	syncer := NewKubernetesSyncer(clientset, dynamicClient, []string{"sec-cert"}, KubernetesSyncOptions{DiscoverReferences: true})
+	if err := syncer.Sync(ctx, []byte{61, 62, 63, 64}, []byte{65, 66, 67, 68}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ns := range []string{"ingress", "gateway", "shared"} {
+		secret, err := clientset.CoreV1().Secrets(ns).Get(ctx, "sec-cert", metav1.GetOptions{})
+		if assert.NoError(t, err, ns) {
+			assert.Equal(t, []byte{61, 62, 63, 64}, secret.Data["tls.crt"])
+		}
+	}
+	// Secrets are removed from namespaces which no longer reference them.
+	for _, ns := range []string{"unrelated", "stale"} {
+		_, err := clientset.CoreV1().Secrets(ns).Get(ctx, "sec-cert", metav1.GetOptions{})
+		assert.Error(t, err, ns)
+	}
+}
+
+func Test_KubernetesSyncerDiscoverReferencesSourceNamespace(t *testing.T) {
+	ctx := context.Background()
+	source := &apiv1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "certs", Name: "sec-cert"},
+		Type:       apiv1.SecretTypeTLS,
+		Data:       map[string][]byte{"tls.crt": {61, 62, 63, 64}, "tls.key": {65, 66, 67, 68}},
+	}
+	clientset := fake.NewSimpleClientset(
+		&apiv1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "certs"}},
+		source,
+		&networkingv1.Ingress{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "certs", Name: "web"},
+			Spec:       networkingv1.IngressSpec{TLS: []networkingv1.IngressTLS{{SecretName: "sec-cert"}}},
+		},
+	)
+	syncer := NewKubernetesSyncer(clientset, newFakeDynamicClient(t), []string{"sec-cert"}, KubernetesSyncOptions{
+		DiscoverReferences: true,
+		SourceNamespace:    "certs",
+		AdoptionPolicy:     AdoptTLS,
+	})
+	if err := syncer.Sync(ctx, []byte{61, 62, 63, 64}, []byte{65, 66, 67, 68}); err != nil {
+		t.Fatal(err)
+	}
+	if err := clientset.NetworkingV1().Ingresses("certs").Delete(ctx, "web", metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := syncer.Sync(ctx, []byte{61, 62, 63, 64}, []byte{65, 66, 67, 68}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The source secret is neither adopted nor removed.
+	secret, err := clientset.CoreV1().Secrets("certs").Get(ctx, "sec-cert", metav1.GetOptions{})
+	if assert.NoError(t, err) {
+		assert.Equal(t, source.Labels, secret.Labels)
+		assert.Equal(t, source.Annotations, secret.Annotations)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+var referenceGrantGVR = schema.GroupVersionResource{Group: "gateway.networking.k8s.io", Version: "v1beta1", Resource: "referencegrants"}
+
+// referenceGrantNameHashLength is the number of sha256 bytes in shortened ReferenceGrant names.
+const referenceGrantNameHashLength = 8
+
+// referenceGrantName returns the name of the ReferenceGrant allowing Gateways in namespace to use secretName.
+// Both are DNS labels or subdomains, so the name is unique and valid unless it is too long,
+// in which case it is truncated and suffixed with a hash of the full name.
+func referenceGrantName(secretName string, namespace string) string {
+	name := secretName + "." + namespace
+	if len(name) <= validation.DNS1123SubdomainMaxLength {
+		return name
+	}
+	hash := sha256.Sum256([]byte(name))
+	suffix := fmt.Sprintf("%x", hash[:referenceGrantNameHashLength])
+	prefix := strings.TrimRight(name[:validation.DNS1123SubdomainMaxLength-len(suffix)-1], ".-")
+	return prefix + "-" + suffix
+}
+
+// newReferenceGrant returns the ReferenceGrant allowing Gateways in namespace to use the secret synced from source.
+// It has the ownership labels of the syncer, so grants of other pipelines and sources are never modified.
+func (s *KubernetesSyncer) newReferenceGrant(source string, namespace string) *unstructured.Unstructured {
+	secretName := s.destinationName(source)
+	grant := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": referenceGrantGVR.GroupVersion().String(),
+		"kind":       "ReferenceGrant",
+		"metadata": map[string]interface{}{
+			"name":        referenceGrantName(secretName, namespace),
+			"namespace":   s.options.ReferenceGrantNamespace,
+			"annotations": map[string]interface{}{annotationKey: secretName},
+		},
+		"spec": map[string]interface{}{
+			"from": []interface{}{
+				map[string]interface{}{"group": "gateway.networking.k8s.io", "kind": "Gateway", "namespace": namespace},
+			},
+			"to": []interface{}{
+				map[string]interface{}{"group": "", "kind": "Secret", "name": secretName},
+			},
+		},
+	}}
+	grant.SetLabels(s.referenceGrantLabels(source))
+	return grant
+}
+
+// referenceGrantLabels returns the labels recording the ownership of ReferenceGrants for the secret synced from source.
+func (s *KubernetesSyncer) referenceGrantLabels(source string) labels.Set {
+	return labels.Set{
+		managedByLabel:  managedByValue,
+		pipelineLabel:   s.options.Pipeline,
+		sourceNameLabel: sourceNameHash(source),
+	}
+}
+
+// reconcileReferenceGrants makes ReferenceGrants in the grant namespace allow Gateways in exactly namespaces
+// to use the secret synced from source, deleting grants created for other namespaces.
+// A grant of the same name not created by the syncer is left as it is and the namespace is reported as blocked.
+func (s *KubernetesSyncer) reconcileReferenceGrants(ctx context.Context, source string, namespaces []string) error {
+	grantNamespace := s.options.ReferenceGrantNamespace
+	client := s.dynamic.Resource(referenceGrantGVR).Namespace(grantNamespace)
+	selector := labels.SelectorFromSet(s.referenceGrantLabels(source))
+	list, err := client.List(ctx, metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return fmt.Errorf("list reference grants: %w", err)
+	}
+	existing := make(map[string]bool)
+	for _, grant := range list.Items {
+		existing[grant.GetName()] = true
+	}
+
+	for _, ns := range namespaces {
+		name := referenceGrantName(s.destinationName(source), ns)
+		if existing[name] {
+			delete(existing, name)
+			continue
+		}
+		log.Printf("create reference grant for namespace=%s,name=%s", grantNamespace, name)
+		_, err := client.Create(ctx, s.newReferenceGrant(source, ns), metav1.CreateOptions{})
+		if errors.IsAlreadyExists(err) {
+			log.Printf("blocked by unmanaged reference grant for namespace=%s,name=%s", grantNamespace, name)
+		} else if err != nil {
+			return fmt.Errorf("create reference grant %s: %w", name, err)
+		}
+	}
+	for name := range existing {
+		log.Printf("remove reference grant for namespace=%s,name=%s", grantNamespace, name)
+		if err := client.Delete(ctx, name, metav1.DeleteOptions{}); err != nil {
+			return fmt.Errorf("delete reference grant %s: %w", name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	apiv1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func Test_KubernetesSyncerReferenceGrant(t *testing.T) {
+	ctx := context.Background()
+	namespace := func(name string, annotation string) *apiv1.Namespace {
+		return &apiv1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name, Annotations: map[string]string{annotationKey: annotation}}}
+	}
+	managedSecret := func(namespace string) *apiv1.Secret {
+		return &apiv1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: "sec-cert", Labels: ownerTestLabels("sec-cert"), Annotations: map[string]string{annotationKey: "sec-cert"}}}
+	}
+	clientset := fake.NewSimpleClientset(
+		namespace("certs", ""), namespace("app1", "sec-cert"), namespace("app2", "other,sec-cert"), namespace("app3", ""),
+		namespace("app4", "sec-cert"),
+		managedSecret("app1"),
+	)
+	dynamicClient := newFakeDynamicClient(t)
+	syncer := NewKubernetesSyncer(clientset, dynamicClient, []string{"sec-cert"}, KubernetesSyncOptions{ReferenceGrantNamespace: "certs"})
+	otherPipeline := NewKubernetesSyncer(clientset, dynamicClient, []string{"sec-cert"}, KubernetesSyncOptions{ReferenceGrantNamespace: "certs", Pipeline: "other"})
+	otherSource := NewKubernetesSyncer(clientset, dynamicClient, []string{"other"}, KubernetesSyncOptions{ReferenceGrantNamespace: "certs"})
+	stale := syncer.newReferenceGrant("sec-cert", "app3")
+	unrelated := otherSource.newReferenceGrant("other", "app3")
+	otherPipelineGrant := otherPipeline.newReferenceGrant("sec-cert", "app5")
+	unmanaged := syncer.newReferenceGrant("sec-cert", "app4")
+	unmanaged.SetLabels(nil)
+	for _, grant := range []*unstructured.Unstructured{stale, unrelated, otherPipelineGrant, unmanaged} {
+		if err := dynamicClient.Tracker().Create(referenceGrantGVR, grant, "certs"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if err := syncer.Sync(ctx, []byte{61, 62, 63, 64}, []byte{65, 66, 67, 68}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The secret is kept only in the grant namespace.
+	secret, err := clientset.CoreV1().Secrets("certs").Get(ctx, "sec-cert", metav1.GetOptions{})
+	if assert.NoError(t, err) {
+		assert.Equal(t, []byte{61, 62, 63, 64}, secret.Data["tls.crt"])
+	}
+	for _, ns := range []string{"app1", "app2"} {
+		_, err := clientset.CoreV1().Secrets(ns).Get(ctx, "sec-cert", metav1.GetOptions{})
+		assert.Error(t, err, ns)
+	}
+
+	list, err := dynamicClient.Resource(referenceGrantGVR).Namespace("certs").List(ctx, metav1.ListOptions{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	var names []string
+	for _, grant := range list.Items {
+		names = append(names, grant.GetName())
+	}
+	sort.Strings(names)
+	// Grants of other pipelines and sources are kept, and the unmanaged grant is left as it is.
+	assert.Equal(t, []string{"other.app3", "sec-cert.app1", "sec-cert.app2", "sec-cert.app4", "sec-cert.app5"}, names)
+	grant, err := dynamicClient.Resource(referenceGrantGVR).Namespace("certs").Get(ctx, "sec-cert.app4", metav1.GetOptions{})
+	if assert.NoError(t, err) {
+		assert.Empty(t, grant.GetLabels())
+	}
+
+	grant, err = dynamicClient.Resource(referenceGrantGVR).Namespace("certs").Get(ctx, "sec-cert.app2", metav1.GetOptions{})
+	if assert.NoError(t, err) {
+		assert.Equal(t, defaultPipeline, grant.GetLabels()[pipelineLabel])
+		from, _, _ := unstructured.NestedSlice(grant.Object, "spec", "from")
+		assert.Equal(t, []interface{}{map[string]interface{}{"group": "gateway.networking.k8s.io", "kind": "Gateway", "namespace": "app2"}}, from)
+		to, _, _ := unstructured.NestedSlice(grant.Object, "spec", "to")
+		assert.Equal(t, []interface{}{map[string]interface{}{"group": "", "kind": "Secret", "name": "sec-cert"}}, to)
+	}
+}
+
+func Test_KubernetesSyncerReferenceGrantDiscover(t *testing.T) {
+	ctx := context.Background()
+	clientset := fake.NewSimpleClientset(
+		&apiv1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "certs"}},
+		&apiv1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "gateway"}},
+		&apiv1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "ingress"}},
+		&networkingv1.Ingress{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "ingress", Name: "web"},
+			Spec:       networkingv1.IngressSpec{TLS: []networkingv1.IngressTLS{{SecretName: "sec-cert"}}},
+		},
+	)
+	dynamicClient := newFakeDynamicClient(t,
+		newTestGateway("gateway", "gw", map[string]interface{}{"name": "sec-cert", "namespace": "certs"}),
+	)
+	syncer := NewKubernetesSyncer(clientset, dynamicClient, []string{"sec-cert"}, KubernetesSyncOptions{DiscoverReferences: true, ReferenceGrantNamespace: "certs"})
+	if err := syncer.Sync(ctx, []byte{61, 62, 63, 64}, []byte{65, 66, 67, 68}); err != nil {
+		t.Fatal(err)
+	}
+	_, err := dynamicClient.Resource(referenceGrantGVR).Namespace("certs").Get(ctx, "sec-cert.gateway", metav1.GetOptions{})
+	assert.NoError(t, err)
+	_, err = clientset.CoreV1().Secrets("gateway").Get(ctx, "sec-cert", metav1.GetOptions{})
+	assert.Error(t, err)
+
+	// Ingresses cannot use a ReferenceGrant, so the namespace gets a copy instead.
+	_, err = clientset.CoreV1().Secrets("ingress").Get(ctx, "sec-cert", metav1.GetOptions{})
+	assert.NoError(t, err)
+	_, err = dynamicClient.Resource(referenceGrantGVR).Namespace("certs").Get(ctx, "sec-cert.ingress", metav1.GetOptions{})
+	assert.Error(t, err)
+}
+
+func TestReferenceGrantName(t *testing.T) {
+	assert.Equal(t, "sec-cert.app1", referenceGrantName("sec-cert", "app1"))
+
+	secretName := strings.Repeat("a", 200) + "." + strings.Repeat("b", 52)
+	name := referenceGrantName(secretName, "app1")
+	assert.Empty(t, validation.IsDNS1123Subdomain(name))
+	assert.NotEqual(t, name, referenceGrantName(secretName, "app2"))
+}
@@ -2,16 +2,31 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"fmt"
 	"testing"
 
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
 	apiv1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
 )
 
+// ownerTestLabels returns the labels of a secret synced from source by the default pipeline.
+func ownerTestLabels(source string) map[string]string {
+	return map[string]string{
+		managedByLabel:  managedByValue,
+		pipelineLabel:   defaultPipeline,
+		sourceNameLabel: sourceNameHash(source),
+	}
+}
+
 func Test_KubernetesSyncer(t *testing.T) {
 	checkSecret := func(tlsCert []byte, tlsKey []byte, checkAnnotation bool) func(t *testing.T, clientset kubernetes.Interface, err error) {
 		return func(t *testing.T, clientset kubernetes.Interface, err error) {
@@ -207,7 +222,7 @@ func Test_KubernetesSyncer(t *testing.T) {
 					t.Fatal(err)
 				}
 			}
-			syncer := NewKubernetesSyncer(clientset, "sec-cert")
+			syncer := NewKubernetesSyncer(clientset, nil, []string{"sec-cert"}, KubernetesSyncOptions{})
 			err := syncer.Sync(ctx, []byte{61, 62, 63, 64}, []byte{65, 66, 67, 68})
 			tc.Check(t, clientset, err)
 		})
@@ -239,3 +254,419 @@ func Test_KubernetesFetcher(t *testing.T) {
 	assert.Equal(t, []byte{61, 62, 63, 64}, cert)
 	assert.Equal(t, []byte{65, 66, 67, 68}, key)
 }
+
+func Test_KubernetesMultipleSecrets(t *testing.T) {
+	ctx := context.Background()
+	clientset := fake.NewSimpleClientset(
+		&apiv1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "both", Annotations: map[string]string{annotationKey: "web-cert,api-cert"}}},
+		&apiv1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "web", Annotations: map[string]string{annotationKey: "web-cert"}}},
+		&apiv1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "certs", Name: "web-cert"},
+			Data:       map[string][]byte{"tls.crt": {61}, "tls.key": {62}},
+		},
+		&apiv1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "web", Name: "missing-cert", Annotations: map[string]string{annotationKey: "missing-cert"}},
+			Data:       map[string][]byte{"tls.crt": {1}, "tls.key": {2}},
+		},
+	)
+	fetcher := NewKubernetesFetcher(clientset, "certs", "web-cert", "missing-cert")
+	certs, err := fetcher.FetchAll(ctx)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "missing-cert")
+	}
+	assert.Equal(t, map[string]TLSKeyPair{"web-cert": {Cert: []byte{61}, Key: []byte{62}}}, certs)
+
+	certs["api-cert"] = TLSKeyPair{Cert: []byte{63}, Key: []byte{64}}
+	syncer := NewKubernetesSyncer(clientset, nil, []string{"web-cert", "api-cert", "missing-cert"}, KubernetesSyncOptions{})
+	if err := syncer.SyncAll(ctx, certs); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		Namespace string
+		Name      string
+		Cert      []byte
+	}{
+		{Namespace: "both", Name: "web-cert", Cert: []byte{61}},
+		{Namespace: "both", Name: "api-cert", Cert: []byte{63}},
+		{Namespace: "web", Name: "web-cert", Cert: []byte{61}},
+		// A secret failed to fetch is left as it is, even though no namespace requests it.
+		{Namespace: "web", Name: "missing-cert", Cert: []byte{1}},
+	} {
+		secret, err := clientset.CoreV1().Secrets(tc.Namespace).Get(ctx, tc.Name, metav1.GetOptions{})
+		if assert.NoError(t, err, tc.Namespace, tc.Name) {
+			assert.Equal(t, tc.Cert, secret.Data["tls.crt"])
+		}
+	}
+	_, err = clientset.CoreV1().Secrets("web").Get(ctx, "api-cert", metav1.GetOptions{})
+	assert.True(t, errors.IsNotFound(err))
+}
+
+func Test_KubernetesSyncerRestartRetry(t *testing.T) {
+	ctx := context.Background()
+	volume := apiv1.PodSpec{Volumes: []apiv1.Volume{{Name: "tls", VolumeSource: apiv1.VolumeSource{Secret: &apiv1.SecretVolumeSource{SecretName: "sec-cert"}}}}}
+	clientset := fake.NewSimpleClientset(
+		&apiv1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "test-namespace", Annotations: map[string]string{annotationKey: "sec-cert"}}},
+		&apiv1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "sec-cert", Namespace: "test-namespace", Labels: ownerTestLabels("sec-cert"), Annotations: map[string]string{annotationKey: "sec-cert"}}, Type: apiv1.SecretTypeTLS, Data: map[string][]byte{"tls.crt": {1}, "tls.key": {2}}},
+		&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "volume", Namespace: "test-namespace"}, Spec: appsv1.DeploymentSpec{Template: apiv1.PodTemplateSpec{Spec: volume}}},
+	)
+	clientset.PrependReactor("update", "deployments", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, fmt.Errorf("admission webhook denied")
+	})
+	syncer := NewKubernetesSyncer(clientset, nil, []string{"sec-cert"}, KubernetesSyncOptions{RestartWorkloads: true})
+	assert.Error(t, syncer.Sync(ctx, []byte{61, 62, 63, 64}, []byte{65, 66, 67, 68}))
+	fingerprint := fmt.Sprintf("%x", sha256.Sum256([]byte{61, 62, 63, 64}))
+	secret, err := clientset.CoreV1().Secrets("test-namespace").Get(ctx, "sec-cert", metav1.GetOptions{})
+	if assert.NoError(t, err) {
+		assert.Equal(t, []byte{61, 62, 63, 64}, secret.Data["tls.crt"])
+		assert.Equal(t, fingerprint, secret.Annotations[restartPendingAnnotation])
+	}
+
+	// The restart is retried although the secret is already up to date.
+	clientset.ReactionChain = clientset.ReactionChain[1:]
+	if err := syncer.Sync(ctx, []byte{61, 62, 63, 64}, []byte{65, 66, 67, 68}); err != nil {
+		t.Fatal(err)
+	}
+	deployment, err := clientset.AppsV1().Deployments("test-namespace").Get(ctx, "volume", metav1.GetOptions{})
+	if assert.NoError(t, err) {
+		assert.Equal(t, fingerprint, deployment.Spec.Template.Annotations[restartedFingerprintAnnotation])
+	}
+	secret, err = clientset.CoreV1().Secrets("test-namespace").Get(ctx, "sec-cert", metav1.GetOptions{})
+	if assert.NoError(t, err) {
+		assert.NotContains(t, secret.Annotations, restartPendingAnnotation)
+	}
+}
+
+func TestParseKubernetesSecretNames(t *testing.T) {
+	sources, destinations, err := ParseKubernetesSecretNames([]string{"web-cert", "api-cert=api-tls"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"web-cert", "api-cert"}, sources)
+		assert.Equal(t, map[string]string{"api-cert": "api-tls"}, destinations)
+	}
+	for _, values := range [][]string{{"web-cert="}, {"web-cert", "api-cert=web-cert"}, {"web-cert=a", "web-cert=b"}} {
+		_, _, err := ParseKubernetesSecretNames(values)
+		assert.Error(t, err, values)
+	}
+}
+
+func Test_KubernetesSyncerRename(t *testing.T) {
+	ctx := context.Background()
+	namespace := func(name string, requested string) *apiv1.Namespace {
+		return &apiv1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name, Annotations: map[string]string{annotationKey: requested}}}
+	}
+	clientset := fake.NewSimpleClientset(
+		namespace("default-name", "sec-cert"),
+		namespace("local-name", "sec-cert=my-cert"),
+		namespace("renamed", "sec-cert=new-cert"),
+		namespace("invalid", "sec-cert=Bad_Name"),
+		&apiv1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "renamed", Name: "old-cert", Labels: ownerTestLabels("sec-cert"), Annotations: map[string]string{annotationKey: "sec-cert"}},
+			Data:       map[string][]byte{"tls.crt": {1}, "tls.key": {2}},
+		},
+	)
+	syncer := NewKubernetesSyncer(clientset, nil, []string{"sec-cert"}, KubernetesSyncOptions{DestinationNames: map[string]string{"sec-cert": "www-cert"}})
+	if err := syncer.Sync(ctx, []byte{61, 62, 63, 64}, []byte{65, 66, 67, 68}); err != nil {
+		t.Fatal(err)
+	}
+	for ns, name := range map[string]string{"default-name": "www-cert", "local-name": "my-cert", "renamed": "new-cert"} {
+		secret, err := clientset.CoreV1().Secrets(ns).Get(ctx, name, metav1.GetOptions{})
+		if assert.NoError(t, err, ns) {
+			assert.Equal(t, []byte{61, 62, 63, 64}, secret.Data["tls.crt"])
+			assert.Equal(t, "sec-cert", secret.Annotations[annotationKey])
+		}
+	}
+	// The copy under the previous local name is removed.
+	_, err := clientset.CoreV1().Secrets("renamed").Get(ctx, "old-cert", metav1.GetOptions{})
+	assert.True(t, errors.IsNotFound(err))
+	// An invalid local name is skipped without failing the sync.
+	secrets, err := clientset.CoreV1().Secrets("invalid").List(ctx, metav1.ListOptions{})
+	if assert.NoError(t, err) {
+		assert.Empty(t, secrets.Items)
+	}
+}
+
+func Test_KubernetesSyncerOwnership(t *testing.T) {
+	ctx := context.Background()
+	annotated := map[string]string{annotationKey: "sec-cert"}
+	owned := func(pipeline string, sourceNamespace string) map[string]string {
+		return map[string]string{
+			managedByLabel:       managedByValue,
+			pipelineLabel:        pipeline,
+			sourceNamespaceLabel: sourceNamespace,
+			sourceNameLabel:      sourceNameHash("sec-cert"),
+		}
+	}
+	clientset := fake.NewSimpleClientset(
+		&apiv1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "legacy", Annotations: annotated}},
+		&apiv1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "other-pipeline", Annotations: annotated}},
+		&apiv1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "moved", Annotations: annotated}},
+		&apiv1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "stale"}},
+		&apiv1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "legacy", Name: "sec-cert", Annotations: annotated},
+			Data:       map[string][]byte{"tls.crt": {1}, "tls.key": {2}},
+		},
+		&apiv1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "other-pipeline", Name: "sec-cert", Annotations: annotated, Labels: owned("staging", "certs")},
+			Data:       map[string][]byte{"tls.crt": {1}, "tls.key": {2}},
+		},
+		&apiv1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "moved", Name: "sec-cert", Annotations: annotated, Labels: owned("production", "old-certs")},
+			Data:       map[string][]byte{"tls.crt": {1}, "tls.key": {2}},
+		},
+		&apiv1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "stale", Name: "sec-cert", Annotations: annotated, Labels: owned("production", "certs")},
+			Data:       map[string][]byte{"tls.crt": {1}, "tls.key": {2}},
+		},
+	)
+	options := KubernetesSyncOptions{Pipeline: "production", SourceNamespace: "certs", KeepLegacySecrets: true}
+	if err := NewKubernetesSyncer(clientset, nil, []string{"sec-cert"}, options).Sync(ctx, []byte{61, 62, 63, 64}, []byte{65, 66, 67, 68}); err != nil {
+		t.Fatal(err)
+	}
+	// A secret created before ownership labels is left as it is if kept.
+	secret, err := clientset.CoreV1().Secrets("legacy").Get(ctx, "sec-cert", metav1.GetOptions{})
+	if assert.NoError(t, err) {
+		assert.Equal(t, []byte{1}, secret.Data["tls.crt"])
+	}
+	options.KeepLegacySecrets = false
+	if err := NewKubernetesSyncer(clientset, nil, []string{"sec-cert"}, options).Sync(ctx, []byte{61, 62, 63, 64}, []byte{65, 66, 67, 68}); err != nil {
+		t.Fatal(err)
+	}
+
+	secret, err = clientset.CoreV1().Secrets("legacy").Get(ctx, "sec-cert", metav1.GetOptions{})
+	if assert.NoError(t, err) {
+		assert.Equal(t, []byte{61, 62, 63, 64}, secret.Data["tls.crt"])
+		assert.Equal(t, map[string]string{
+			managedByLabel:         managedByValue,
+			pipelineLabel:          "production",
+			sourceNamespaceLabel:   "certs",
+			sourceNameLabel:        sourceNameHash("sec-cert"),
+			sourceFingerprintLabel: sourceFingerprint([]byte{61, 62, 63, 64}),
+		}, secret.Labels)
+	}
+	// A secret of another pipeline is left as it is, even with the same annotation.
+	secret, err = clientset.CoreV1().Secrets("other-pipeline").Get(ctx, "sec-cert", metav1.GetOptions{})
+	if assert.NoError(t, err) {
+		assert.Equal(t, []byte{1}, secret.Data["tls.crt"])
+	}
+	// A secret synced from a previous source namespace is still owned, and records the new one.
+	secret, err = clientset.CoreV1().Secrets("moved").Get(ctx, "sec-cert", metav1.GetOptions{})
+	if assert.NoError(t, err) {
+		assert.Equal(t, []byte{61, 62, 63, 64}, secret.Data["tls.crt"])
+		assert.Equal(t, "certs", secret.Labels[sourceNamespaceLabel])
+	}
+	// An owned secret no longer requested is found by the labels and removed.
+	_, err = clientset.CoreV1().Secrets("stale").Get(ctx, "sec-cert", metav1.GetOptions{})
+	assert.True(t, errors.IsNotFound(err))
+}
+
+func Test_KubernetesSyncerLegacyUpgrade(t *testing.T) {
+	ctx := context.Background()
+	legacySecret := func(namespace string, name string, source string) *apiv1.Secret {
+		return &apiv1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, Annotations: map[string]string{annotationKey: source}},
+			Type:       apiv1.SecretTypeTLS,
+			Data:       map[string][]byte{"tls.crt": {1}, "tls.key": {2}},
+		}
+	}
+	clientset := fake.NewSimpleClientset(
+		&apiv1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "requested", Annotations: map[string]string{annotationKey: "sec-cert"}}},
+		&apiv1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "renamed", Annotations: map[string]string{annotationKey: "sec-cert=new-cert"}}},
+		&apiv1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "unrequested"}},
+		legacySecret("requested", "sec-cert", "sec-cert"),
+		legacySecret("renamed", "sec-cert", "sec-cert"),
+		legacySecret("unrequested", "sec-cert", "sec-cert"),
+		legacySecret("unrequested", "other-cert", "other-cert"),
+	)
+	// Secrets synced by versions without ownership labels are taken over with the default options.
+	syncer := NewKubernetesSyncer(clientset, nil, []string{"sec-cert"}, KubernetesSyncOptions{})
+	for i := 0; i < 2; i++ {
+		if err := syncer.Sync(ctx, []byte{61, 62, 63, 64}, []byte{65, 66, 67, 68}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	secret, err := clientset.CoreV1().Secrets("requested").Get(ctx, "sec-cert", metav1.GetOptions{})
+	if assert.NoError(t, err) {
+		assert.Equal(t, []byte{61, 62, 63, 64}, secret.Data["tls.crt"])
+		assert.Equal(t, defaultPipeline, secret.Labels[pipelineLabel])
+		assert.Equal(t, sourceNameHash("sec-cert"), secret.Labels[sourceNameLabel])
+	}
+	events, err := clientset.CoreV1().Events("requested").List(ctx, metav1.ListOptions{})
+	if assert.NoError(t, err) {
+		assert.Empty(t, events.Items)
+	}
+	// Legacy copies no longer requested are removed, including ones under a previous local name.
+	_, err = clientset.CoreV1().Secrets("renamed").Get(ctx, "sec-cert", metav1.GetOptions{})
+	assert.True(t, errors.IsNotFound(err))
+	_, err = clientset.CoreV1().Secrets("renamed").Get(ctx, "new-cert", metav1.GetOptions{})
+	assert.NoError(t, err)
+	_, err = clientset.CoreV1().Secrets("unrequested").Get(ctx, "sec-cert", metav1.GetOptions{})
+	assert.True(t, errors.IsNotFound(err))
+	// Legacy copies of other sources are left as they are.
+	_, err = clientset.CoreV1().Secrets("unrequested").Get(ctx, "other-cert", metav1.GetOptions{})
+	assert.NoError(t, err)
+}
+
+func Test_KubernetesSyncerAdoption(t *testing.T) {
+	ctx := context.Background()
+	newClientset := func() *fake.Clientset {
+		return fake.NewSimpleClientset(
+			&apiv1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "tls", Annotations: map[string]string{annotationKey: "sec-cert"}}},
+			&apiv1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "opaque", Annotations: map[string]string{annotationKey: "sec-cert"}}},
+			&apiv1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "tls", Name: "sec-cert"},
+				Type:       apiv1.SecretTypeTLS,
+				Data:       map[string][]byte{"tls.crt": {1}, "tls.key": {2}},
+			},
+			&apiv1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "opaque", Name: "sec-cert"},
+				Type:       apiv1.SecretTypeOpaque,
+				Data:       map[string][]byte{"password": {3}},
+			},
+		)
+	}
+	testCases := []struct {
+		Policy  string
+		Adopted []string
+		Blocked []string
+	}{
+		{Policy: AdoptNever, Blocked: []string{"tls", "opaque"}},
+		{Policy: AdoptTLS, Adopted: []string{"tls"}, Blocked: []string{"opaque"}},
+		{Policy: AdoptAlways, Adopted: []string{"tls", "opaque"}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.Policy, func(t *testing.T) {
+			kubernetesBlockedSecrets.Reset()
+			clientset := newClientset()
+			syncer := NewKubernetesSyncer(clientset, nil, []string{"sec-cert"}, KubernetesSyncOptions{AdoptionPolicy: tc.Policy})
+			for i := 0; i < 2; i++ {
+				if err := syncer.Sync(ctx, []byte{61, 62, 63, 64}, []byte{65, 66, 67, 68}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, ns := range tc.Adopted {
+				secret, err := clientset.CoreV1().Secrets(ns).Get(ctx, "sec-cert", metav1.GetOptions{})
+				if assert.NoError(t, err, ns) {
+					assert.Equal(t, apiv1.SecretTypeTLS, secret.Type, ns)
+					assert.Equal(t, []byte{61, 62, 63, 64}, secret.Data["tls.crt"], ns)
+					assert.True(t, syncer.owns(secret, "sec-cert"), ns)
+				}
+			}
+			assert.Equal(t, len(tc.Blocked), testutil.CollectAndCount(kubernetesBlockedSecrets))
+			for _, ns := range tc.Blocked {
+				secret, err := clientset.CoreV1().Secrets(ns).Get(ctx, "sec-cert", metav1.GetOptions{})
+				if assert.NoError(t, err, ns) {
+					assert.False(t, syncer.owns(secret, "sec-cert"), ns)
+				}
+				assert.Equal(t, 1.0, testutil.ToFloat64(kubernetesBlockedSecrets.WithLabelValues(ns, "sec-cert")), ns)
+				// The event is emitted once while the namespace stays blocked.
+				events, err := clientset.CoreV1().Events(ns).List(ctx, metav1.ListOptions{})
+				if assert.NoError(t, err, ns) && assert.Len(t, events.Items, 1, ns) {
+					assert.Equal(t, "SyncBlocked", events.Items[0].Reason)
+				}
+			}
+
+			// Removing the unmanaged secrets unblocks the namespaces.
+			for _, ns := range tc.Blocked {
+				assert.NoError(t, clientset.CoreV1().Secrets(ns).Delete(ctx, "sec-cert", metav1.DeleteOptions{}))
+			}
+			if err := syncer.Sync(ctx, []byte{61, 62, 63, 64}, []byte{65, 66, 67, 68}); err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, 0, testutil.CollectAndCount(kubernetesBlockedSecrets))
+		})
+	}
+}
+
+func Test_KubernetesSyncerAdoptionReplaceFailure(t *testing.T) {
+	ctx := context.Background()
+	original := &apiv1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "opaque", Name: "sec-cert", Labels: map[string]string{"app": "web"}},
+		Type:       apiv1.SecretTypeOpaque,
+		Data:       map[string][]byte{"password": {3}},
+	}
+	clientset := fake.NewSimpleClientset(
+		&apiv1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "opaque", Annotations: map[string]string{annotationKey: "sec-cert"}}},
+		original,
+	)
+	clientset.PrependReactor("create", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.(k8stesting.CreateAction).GetObject().(*apiv1.Secret).Type == apiv1.SecretTypeTLS {
+			return true, nil, fmt.Errorf("admission webhook denied")
+		}
+		return false, nil, nil
+	})
+	syncer := NewKubernetesSyncer(clientset, nil, []string{"sec-cert"}, KubernetesSyncOptions{AdoptionPolicy: AdoptAlways})
+	assert.Error(t, syncer.Sync(ctx, []byte{61, 62, 63, 64}, []byte{65, 66, 67, 68}))
+
+	// The original secret is restored as it was, and the backup is removed.
+	secrets, err := clientset.CoreV1().Secrets("opaque").List(ctx, metav1.ListOptions{})
+	if assert.NoError(t, err) && assert.Len(t, secrets.Items, 1) {
+		assert.Equal(t, original.Name, secrets.Items[0].Name)
+		assert.Equal(t, original.Type, secrets.Items[0].Type)
+		assert.Equal(t, original.Labels, secrets.Items[0].Labels)
+		assert.Empty(t, secrets.Items[0].Annotations)
+		assert.Equal(t, original.Data, secrets.Items[0].Data)
+	}
+
+	clientset.ReactionChain = clientset.ReactionChain[1:]
+	if err := syncer.Sync(ctx, []byte{61, 62, 63, 64}, []byte{65, 66, 67, 68}); err != nil {
+		t.Fatal(err)
+	}
+	secrets, err = clientset.CoreV1().Secrets("opaque").List(ctx, metav1.ListOptions{})
+	if assert.NoError(t, err) && assert.Len(t, secrets.Items, 1) {
+		assert.Equal(t, apiv1.SecretTypeTLS, secrets.Items[0].Type)
+		assert.True(t, syncer.owns(&secrets.Items[0], "sec-cert"))
+	}
+}
+
+func Test_KubernetesSyncerRestartWorkloads(t *testing.T) {
+	ctx := context.Background()
+	template := func(spec apiv1.PodSpec) apiv1.PodTemplateSpec {
+		return apiv1.PodTemplateSpec{Spec: spec}
+	}
+	volume := apiv1.PodSpec{Volumes: []apiv1.Volume{{Name: "tls", VolumeSource: apiv1.VolumeSource{Secret: &apiv1.SecretVolumeSource{SecretName: "sec-cert"}}}}}
+	env := apiv1.PodSpec{Containers: []apiv1.Container{{Name: "app", Env: []apiv1.EnvVar{{Name: "TLS_CERT", ValueFrom: &apiv1.EnvVarSource{SecretKeyRef: &apiv1.SecretKeySelector{LocalObjectReference: apiv1.LocalObjectReference{Name: "sec-cert"}, Key: "tls.crt"}}}}}}}
+	envFrom := apiv1.PodSpec{InitContainers: []apiv1.Container{{Name: "init", EnvFrom: []apiv1.EnvFromSource{{SecretRef: &apiv1.SecretEnvSource{LocalObjectReference: apiv1.LocalObjectReference{Name: "sec-cert"}}}}}}}
+	other := apiv1.PodSpec{Volumes: []apiv1.Volume{{Name: "tls", VolumeSource: apiv1.VolumeSource{Secret: &apiv1.SecretVolumeSource{SecretName: "other"}}}}}
+	meta := func(name string) metav1.ObjectMeta {
+		return metav1.ObjectMeta{Name: name, Namespace: "test-namespace"}
+	}
+	clientset := fake.NewSimpleClientset(
+		&apiv1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "test-namespace", Annotations: map[string]string{annotationKey: "sec-cert"}}},
+		&apiv1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "sec-cert", Namespace: "test-namespace", Labels: ownerTestLabels("sec-cert"), Annotations: map[string]string{annotationKey: "sec-cert"}}, Type: apiv1.SecretTypeTLS, Data: map[string][]byte{"tls.crt": {1}, "tls.key": {2}}},
+		&appsv1.Deployment{ObjectMeta: meta("volume"), Spec: appsv1.DeploymentSpec{Template: template(volume)}},
+		&appsv1.Deployment{ObjectMeta: meta("other"), Spec: appsv1.DeploymentSpec{Template: template(other)}},
+		&appsv1.StatefulSet{ObjectMeta: meta("env"), Spec: appsv1.StatefulSetSpec{Template: template(env)}},
+		&appsv1.DaemonSet{ObjectMeta: meta("env-from"), Spec: appsv1.DaemonSetSpec{Template: template(envFrom)}},
+	)
+	syncer := NewKubernetesSyncer(clientset, nil, []string{"sec-cert"}, KubernetesSyncOptions{RestartWorkloads: true})
+	if err := syncer.Sync(ctx, []byte{61, 62, 63, 64}, []byte{65, 66, 67, 68}); err != nil {
+		t.Fatal(err)
+	}
+	fingerprint := fmt.Sprintf("%x", sha256.Sum256([]byte{61, 62, 63, 64}))
+
+	deployment, err := clientset.AppsV1().Deployments("test-namespace").Get(ctx, "volume", metav1.GetOptions{})
+	if assert.NoError(t, err) {
+		assert.Equal(t, fingerprint, deployment.Spec.Template.Annotations[restartedFingerprintAnnotation])
+	}
+	deployment, err = clientset.AppsV1().Deployments("test-namespace").Get(ctx, "other", metav1.GetOptions{})
+	if assert.NoError(t, err) {
+		assert.Empty(t, deployment.Spec.Template.Annotations)
+	}
+	statefulSet, err := clientset.AppsV1().StatefulSets("test-namespace").Get(ctx, "env", metav1.GetOptions{})
+	if assert.NoError(t, err) {
+		assert.Equal(t, fingerprint, statefulSet.Spec.Template.Annotations[restartedFingerprintAnnotation])
+	}
+	daemonSet, err := clientset.AppsV1().DaemonSets("test-namespace").Get(ctx, "env-from", metav1.GetOptions{})
+	if assert.NoError(t, err) {
+		assert.Equal(t, fingerprint, daemonSet.Spec.Template.Annotations[restartedFingerprintAnnotation])
+	}
+
+	// Nothing is restarted while the secret is unchanged.
+	clientset.ClearActions()
+	if err := syncer.Sync(ctx, []byte{61, 62, 63, 64}, []byte{65, 66, 67, 68}); err != nil {
+		t.Fatal(err)
+	}
+	for _, action := range clientset.Actions() {
+		assert.NotEqual(t, "update", action.GetVerb())
+	}
+}
@@ -4,19 +4,38 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"net/smtp"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	certificatemanager "cloud.google.com/go/certificatemanager/apiv1"
+	compute "cloud.google.com/go/compute/apiv1"
 	secretmanager "cloud.google.com/go/secretmanager/apiv1"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/security/keyvault/azcertificates"
+	"github.com/Azure/azure-sdk-for-go/sdk/security/keyvault/azsecrets"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/acm"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/spf13/cobra"
+	"golang.org/x/crypto/acme"
+	dns "google.golang.org/api/dns/v1"
+	"google.golang.org/api/option"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
+	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 )
 
@@ -30,8 +49,32 @@ type Fetcher interface {
 	Fetch(ctx context.Context) ([]byte, []byte, error)
 }
 
+// TLSKeyPair is a certificate and its private key in PEM.
+type TLSKeyPair struct {
+	Cert []byte
+	Key  []byte
+}
+
+// MultiFetcher is implemented by a Fetcher which can fetch certificates of multiple secret names at once.
+type MultiFetcher interface {
+	FetchAll(ctx context.Context) (map[string]TLSKeyPair, error)
+}
+
+// MultiSyncer is implemented by a Syncer which can sync certificates of multiple secret names at once.
+type MultiSyncer interface {
+	SyncAll(ctx context.Context, certs map[string]TLSKeyPair) error
+}
+
+// Watcher is implemented by a Fetcher which can notify changes before the next sync interval.
+type Watcher interface {
+	Watch(ctx context.Context) (<-chan struct{}, error)
+}
+
 var clientset kubernetes.Interface
+var dynamicClient dynamic.Interface
 var secretManagerClient *secretmanager.Client
+var regionalSecretManagerClients = make(map[string]*secretmanager.Client)
+var vaultClient *VaultClient
 var version string
 var (
 	errorCount = promauto.NewCounter(prometheus.CounterOpts{
@@ -42,15 +85,31 @@ var (
 		Name: "tls_secret_sync_success_count",
 		Help: "The successfully sync count",
 	})
+	certificateManagerDrift = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tls_secret_sync_certificate_manager_drift",
+		Help: "1 if the certificate attached to the certificate map entry differs from the source",
+	}, []string{"certificate_map", "certificate_map_entry"})
+	certificateManagerExpiry = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tls_secret_sync_certificate_manager_expiry_timestamp_seconds",
+		Help: "The expiry of the certificate attached to the certificate map entry",
+	}, []string{"certificate_map", "certificate_map_entry"})
+	kubernetesBlockedSecrets = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tls_secret_sync_kubernetes_blocked_secrets",
+		Help: "1 if the namespace requests the secret but a secret of the name is not managed by tls-secrets-sync",
+	}, []string{"namespace", "name"})
 )
 
+func getKubernetesConfig() (*rest.Config, error) {
+	loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+
+	configOverrides := &clientcmd.ConfigOverrides{}
+	kubeConfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, configOverrides)
+	return kubeConfig.ClientConfig()
+}
+
 func getKubernetesClient() (kubernetes.Interface, error) {
 	if clientset == nil {
-		loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
-
-		configOverrides := &clientcmd.ConfigOverrides{}
-		kubeConfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, configOverrides)
-		clientConfig, err := kubeConfig.ClientConfig()
+		clientConfig, err := getKubernetesConfig()
 		if err != nil {
 			return nil, err
 		}
@@ -63,6 +122,21 @@ func getKubernetesClient() (kubernetes.Interface, error) {
 	return clientset, nil
 }
 
+func getDynamicClient() (dynamic.Interface, error) {
+	if dynamicClient == nil {
+		clientConfig, err := getKubernetesConfig()
+		if err != nil {
+			return nil, err
+		}
+		client, err := dynamic.NewForConfig(clientConfig)
+		if err != nil {
+			return nil, err
+		}
+		dynamicClient = client
+	}
+	return dynamicClient, nil
+}
+
 func getSecretManagerClient(ctx context.Context) (*secretmanager.Client, error) {
 	if secretManagerClient == nil {
 		c, err := secretmanager.NewClient(ctx)
@@ -74,19 +148,123 @@ func getSecretManagerClient(ctx context.Context) (*secretmanager.Client, error)
 	return secretManagerClient, nil
 }
 
+func getRegionalSecretManagerClient(ctx context.Context, location string) (*secretmanager.Client, error) {
+	if c, ok := regionalSecretManagerClients[location]; ok {
+		return c, nil
+	}
+	c, err := secretmanager.NewClient(ctx, option.WithEndpoint(fmt.Sprintf("secretmanager.%s.rep.googleapis.com:443", location)))
+	if err != nil {
+		return nil, err
+	}
+	regionalSecretManagerClients[location] = c
+	return c, nil
+}
+
+func getVaultClient(address string, auth VaultAuth) (*VaultClient, error) {
+	if vaultClient == nil {
+		c, err := NewVaultClient(address, auth)
+		if err != nil {
+			return nil, err
+		}
+		vaultClient = c
+	}
+	return vaultClient, nil
+}
+
+// loadAwsConfig loads the default aws config. An empty region uses AWS_REGION or the shared config.
+func loadAwsConfig(ctx context.Context, region string) (aws.Config, error) {
+	if region == "" {
+		return awsconfig.LoadDefaultConfig(ctx)
+	}
+	return awsconfig.LoadDefaultConfig(ctx, awsconfig.WithRegion(region))
+}
+
 func rootCmd() *cobra.Command {
 	var sourceType string
 	var sourceNamespace string
-	var secretName string
+	var secretNames []string
+	var sourceDir string
+	var sourceCertFile string
+	var sourceKeyFile string
+	var sourceCombinedFile string
 	var secretManagerProject string
 	var secretManagerTlsCertName string
 	var secretManagerTlsKeyName string
+	var secretManagerTargets []string
 	var certificateManagerHostName string
 	var certificateManagerProject string
 	var certificateManagerLocation string
 	var certificateManagerCertificateNamePrefix string
 	var certificateManagerCertificateMap string
 	var certificateManagerCertificateMapEntry string
+	var certificateManagerMapEntries []string
+	var certificateManagerDeleteGracePeriod time.Duration
+	var certificateManagerOrphanPolicy string
+	var computeProject string
+	var computeCertificateNamePrefix string
+	var computeTargetHttpsProxies []string
+	var computeTargetSslProxies []string
+	var filePaths FilePaths
+	var fileMode string
+	var fileKeyMode string
+	var fileOwner int
+	var fileGroup int
+	var fileReloadCommand string
+	var fileReloadPidFile string
+	var fileReloadSignal string
+	var vaultAddress string
+	var vaultAuth VaultAuth
+	var vaultKVMount string
+	var vaultKVVersion int
+	var vaultKVPath string
+	var vaultKVReadVersion int
+	var vaultCertField string
+	var vaultKeyField string
+	var vaultPKIMount string
+	var vaultPKIRole string
+	var vaultPKIRequest VaultPKIRequest
+	var vaultPKIRenewFraction float64
+	var awsAcmRegions []string
+	var awsAcmCertificateName string
+	var awsRegion string
+	var awsCertName string
+	var awsKeyName string
+	var awsKmsKeyId string
+	var azureKeyVaultURL string
+	var azureKeyVaultCertificateName string
+	var acmeDirectoryURL string
+	var acmeEmail string
+	var acmeDomains []string
+	var acmeChallenge string
+	var acmeHTTP01Listen string
+	var acmeDNSProvider string
+	var acmeDNSPropagationDelay time.Duration
+	var acmeCloudDNSProject string
+	var acmeCloudDNSZone string
+	var acmeDNSCommand string
+	var acmeStorage string
+	var acmeStorageNamespace string
+	var acmeStorageSecret string
+	var acmeRenewBefore time.Duration
+	var webhookURL string
+	var webhookFormat string
+	var webhookHMACSecretFile string
+	var webhookClientCertFile string
+	var webhookClientKeyFile string
+	var webhookCAFile string
+	var webhookTimeout time.Duration
+	var webhookRetries int
+	var notifySlackWebhookURL string
+	var notifyWebhookURL string
+	var notifySMTPAddr string
+	var notifySMTPUsername string
+	var notifySMTPPasswordFile string
+	var notifySMTPFrom string
+	var notifySMTPTo []string
+	var notifyFailureThreshold int
+	var notifyExpiryWarning time.Duration
+	var notifyRepeatInterval time.Duration
+	var kubernetesSyncOptions KubernetesSyncOptions
 	var metricsListen string
 	var syncTypes []string
 	rootCmd := &cobra.Command{
@@ -97,18 +275,26 @@ func rootCmd() *cobra.Command {
 		RunE: func(cmd *cobra.Command, args []string) error {
 			var source Fetcher
 			ctx := cmd.Context()
+			sourceSecretNames, destinationNames, err := ParseKubernetesSecretNames(secretNames)
+			if err != nil {
+				return err
+			}
+			kubernetesSyncOptions.DestinationNames = destinationNames
+			if sourceType == "kubernetes" {
+				kubernetesSyncOptions.SourceNamespace = sourceNamespace
+			}
 			if sourceType == "kubernetes" {
 				if sourceNamespace == "" {
 					return errors.New("source-namespace is required if source-type is kubernetes")
 				}
-				if secretName == "" {
+				if len(secretNames) == 0 {
 					return errors.New("secret-name is required if source-type is kubernetes")
 				}
 				c, err := getKubernetesClient()
 				if err != nil {
 					return errors.Wrap(err, "failed to create kubernetes client")
 				}
-				source = NewKubernetesFetcher(c, sourceNamespace, secretName)
+				source = NewKubernetesFetcher(c, sourceNamespace, sourceSecretNames...)
 			} else if sourceType == "secret-manager" {
 				if secretManagerProject == "" {
 					return errors.New("secret-manager-gcp-project is required if source / sync type has secret-manager")
@@ -124,20 +310,189 @@ func rootCmd() *cobra.Command {
 					return errors.Wrap(err, "failed to create secret-manager client")
 				}
 				source = NewSecretManagerFetcher(c, secretManagerProject, secretManagerTlsCertName, secretManagerTlsKeyName)
+			} else if sourceType == "file" {
+				if sourceDir == "" {
+					return errors.New("source-dir is required if source-type is file")
+				}
+				source = NewFileFetcher(sourceDir, sourceCertFile, sourceKeyFile, sourceCombinedFile)
+			} else if sourceType == "vault-kv" {
+				if vaultKVPath == "" {
+					return errors.New("vault-kv-path is required if source / sync type has vault-kv")
+				}
+				if vaultKVVersion != 1 && vaultKVVersion != 2 {
+					return fmt.Errorf("invalid value for vault-kv-version: %d", vaultKVVersion)
+				}
+				c, err := getVaultClient(vaultAddress, vaultAuth)
+				if err != nil {
+					return errors.Wrap(err, "failed to create vault client")
+				}
+				source = NewVaultKVFetcher(c, vaultKVVersion, vaultKVMount, vaultKVPath, vaultKVReadVersion, vaultCertField, vaultKeyField)
+			} else if sourceType == "vault-pki" {
+				if vaultPKIRole == "" {
+					return errors.New("vault-pki-role is required if source-type is vault-pki")
+				}
+				if vaultPKIRequest.CommonName == "" {
+					return errors.New("vault-pki-common-name is required if source-type is vault-pki")
+				}
+				if vaultPKIRenewFraction <= 0 || vaultPKIRenewFraction >= 1 {
+					return fmt.Errorf("invalid value for vault-pki-renew-fraction: %v", vaultPKIRenewFraction)
+				}
+				c, err := getVaultClient(vaultAddress, vaultAuth)
+				if err != nil {
+					return errors.Wrap(err, "failed to create vault client")
+				}
+				source = NewVaultPKIFetcher(c, vaultPKIMount, vaultPKIRole, vaultPKIRequest, vaultPKIRenewFraction)
+			} else if sourceType == "aws-secrets-manager" || sourceType == "aws-ssm-parameter" {
+				if awsCertName == "" {
+					return errors.New("aws-cert-name is required if source / sync type has " + sourceType)
+				}
+				if awsKeyName == "" {
+					return errors.New("aws-key-name is required if source / sync type has " + sourceType)
+				}
+				cfg, err := loadAwsConfig(ctx, awsRegion)
+				if err != nil {
+					return errors.Wrap(err, "failed to load aws config")
+				}
+				if sourceType == "aws-secrets-manager" {
+					source = NewAwsSecretsManagerFetcher(secretsmanager.NewFromConfig(cfg), awsCertName, awsKeyName)
+				} else {
+					source = NewAwsSsmParameterFetcher(ssm.NewFromConfig(cfg), awsCertName, awsKeyName)
+				}
+			} else if sourceType == "azure-key-vault" {
+				if azureKeyVaultURL == "" {
+					return errors.New("azure-key-vault-url is required if source / sync type has azure-key-vault")
+				}
+				if azureKeyVaultCertificateName == "" {
+					return errors.New("azure-key-vault-certificate-name is required if source / sync type has azure-key-vault")
+				}
+				cred, err := azidentity.NewDefaultAzureCredential(nil)
+				if err != nil {
+					return errors.Wrap(err, "failed to create azure credential")
+				}
+				c, err := azsecrets.NewClient(azureKeyVaultURL, cred, nil)
+				if err != nil {
+					return errors.Wrap(err, "failed to create key vault client")
+				}
+				source = NewAzureKeyVaultFetcher(c, azureKeyVaultCertificateName)
+			} else if sourceType == "acme" {
+				if len(acmeDomains) == 0 {
+					return errors.New("acme-domain is required if source-type is acme")
+				}
+				if acmeStorageSecret == "" {
+					return errors.New("acme-storage-secret is required if source-type is acme")
+				}
+				var store ACMEStore
+				if acmeStorage == "kubernetes" {
+					if acmeStorageNamespace == "" {
+						return errors.New("acme-storage-namespace is required if acme-storage is kubernetes")
+					}
+					c, err := getKubernetesClient()
+					if err != nil {
+						return errors.Wrap(err, "failed to create kubernetes client")
+					}
+					store = NewKubernetesACMEStore(c, acmeStorageNamespace, acmeStorageSecret)
+				} else if acmeStorage == "secret-manager" {
+					if secretManagerProject == "" {
+						return errors.New("secret-manager-gcp-project is required if acme-storage is secret-manager")
+					}
+					c, err := getSecretManagerClient(ctx)
+					if err != nil {
+						return errors.Wrap(err, "failed to create secret-manager client")
+					}
+					store = NewSecretManagerACMEStore(c, secretManagerProject, acmeStorageSecret)
+				} else {
+					return fmt.Errorf("invalid value for acme-storage: %s", acmeStorage)
+				}
+				var solver ACMESolver
+				if acmeChallenge == "http-01" {
+					http01Solver := NewHTTP01Solver()
+					srv := &http.Server{Addr: acmeHTTP01Listen, Handler: http01Solver}
+					go func() {
+						if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+							log.Fatal("failed to listen acme http-01 server", err)
+						}
+					}()
+					defer func() {
+						_ = srv.Shutdown(ctx)
+					}()
+					solver = http01Solver
+				} else if acmeChallenge == "dns-01" {
+					var provider DNS01Provider
+					if acmeDNSProvider == "cloud-dns" {
+						if acmeCloudDNSProject == "" {
+							return errors.New("acme-cloud-dns-gcp-project is required if acme-dns-provider is cloud-dns")
+						}
+						if acmeCloudDNSZone == "" {
+							return errors.New("acme-cloud-dns-managed-zone is required if acme-dns-provider is cloud-dns")
+						}
+						s, err := dns.NewService(ctx)
+						if err != nil {
+							return errors.Wrap(err, "failed to create cloud dns client")
+						}
+						provider = NewCloudDNSProvider(s, acmeCloudDNSProject, acmeCloudDNSZone)
+					} else if acmeDNSProvider == "exec" {
+						if acmeDNSCommand == "" {
+							return errors.New("acme-dns-command is required if acme-dns-provider is exec")
+						}
+						provider = NewExecDNSProvider(strings.Fields(acmeDNSCommand))
+					} else {
+						return fmt.Errorf("invalid value for acme-dns-provider: %s", acmeDNSProvider)
+					}
+					solver = NewDNS01Solver(provider, acmeDNSPropagationDelay)
+				} else {
+					return fmt.Errorf("invalid value for acme-challenge: %s", acmeChallenge)
+				}
+				source = NewACMEFetcher(acmeDirectoryURL, acmeEmail, acmeDomains, solver, store, acmeRenewBefore)
 			} else {
 				return fmt.Errorf("invalid value for source-type: %s", sourceType)
 			}
 			syncer := make([]Syncer, 0)
 			for _, s := range syncTypes {
 				if s == "kubernetes" {
-					if secretName == "" {
+					if len(secretNames) == 0 {
 						return errors.New("secret-name is required if source-type is kubernetes")
 					}
+					if msgs := validation.IsValidLabelValue(kubernetesSyncOptions.Pipeline); len(msgs) > 0 {
+						return fmt.Errorf("invalid value for pipeline: %s", strings.Join(msgs, ", "))
+					}
+					if p := kubernetesSyncOptions.AdoptionPolicy; p != AdoptNever && p != AdoptTLS && p != AdoptAlways {
+						return fmt.Errorf("invalid value for adoption-policy: %s", p)
+					}
+					if ns := kubernetesSyncOptions.ReferenceGrantNamespace; ns != "" && ns == kubernetesSyncOptions.SourceNamespace {
+						return errors.New("reference-grant-namespace must be different from source-namespace")
+					}
 					c, err := getKubernetesClient()
 					if err != nil {
 						return errors.Wrap(err, "failed to create kubernetes client")
 					}
-					syncer = append(syncer, NewKubernetesSyncer(c, secretName))
+					var d dynamic.Interface
+					if kubernetesSyncOptions.DiscoverReferences || kubernetesSyncOptions.ReferenceGrantNamespace != "" {
+						d, err = getDynamicClient()
+						if err != nil {
+							return errors.Wrap(err, "failed to create kubernetes dynamic client")
+						}
+					}
+					syncer = append(syncer, NewKubernetesSyncer(c, d, sourceSecretNames, kubernetesSyncOptions))
+				} else if s == "secret-manager" && len(secretManagerTargets) > 0 {
+					for _, v := range secretManagerTargets {
+						target, err := ParseSecretManagerTarget(v, secretManagerProject, secretManagerTlsCertName, secretManagerTlsKeyName)
+						if err != nil {
+							return err
+						}
+						if target.Location == "" {
+							c, err := getSecretManagerClient(ctx)
+							if err != nil {
+								return errors.Wrap(err, "failed to create secret-manager client")
+							}
+							syncer = append(syncer, NewSecretManagerSyncer(c, target.Project, target.CertName, target.KeyName))
+						} else {
+							c, err := getRegionalSecretManagerClient(ctx, target.Location)
+							if err != nil {
+								return errors.Wrap(err, "failed to create secret-manager client")
+							}
+							syncer = append(syncer, NewRegionalSecretManagerSyncer(c, target.Project, target.Location, target.CertName, target.KeyName))
+						}
+					}
 				} else if s == "secret-manager" {
 					if secretManagerProject == "" {
 						return errors.New("secret-manager-gcp-project is required if source / sync type has secret-manager")
@@ -154,20 +509,42 @@ func rootCmd() *cobra.Command {
 					}
 					syncer = append(syncer, NewSecretManagerSyncer(c, secretManagerProject, secretManagerTlsCertName, secretManagerTlsKeyName))
 				} else if s == "certificate-manager" {
-					if certificateManagerHostName == "" {
-						return errors.New("certificate-manager-host-name is required if sync type has certificate-manager")
-					}
 					if certificateManagerProject == "" {
 						return errors.New("certificate-manager-gcp-project is required if sync type has certificate-manager")
 					}
 					if certificateManagerCertificateNamePrefix == "" {
 						return errors.New("certificate-manager-name-prefix is required if sync type has certificate-manager")
 					}
-					if certificateManagerCertificateMap == "" {
-						return errors.New("certificate-manager-certificate-map is required if sync type has certificate-manager")
+					if len(certificateManagerCertificateNamePrefix) > maxCertificateNamePrefixLength {
+						return fmt.Errorf("certificate-manager-name-prefix must be at most %d characters", maxCertificateNamePrefixLength)
 					}
-					if certificateManagerCertificateMapEntry == "" {
-						return errors.New("certificate-manager-certificate-map-entry is required if sync type has certificate-manager")
+					var mapEntries []CertificateManagerMapEntry
+					for _, v := range certificateManagerMapEntries {
+						entry, err := ParseCertificateManagerMapEntry(v)
+						if err != nil {
+							return err
+						}
+						mapEntries = append(mapEntries, entry)
+					}
+					if len(mapEntries) == 0 || certificateManagerHostName != "" || certificateManagerCertificateMap != "" || certificateManagerCertificateMapEntry != "" {
+						if certificateManagerHostName == "" {
+							return errors.New("certificate-manager-host-name is required if sync type has certificate-manager")
+						}
+						if certificateManagerCertificateMap == "" {
+							return errors.New("certificate-manager-certificate-map is required if sync type has certificate-manager")
+						}
+						if certificateManagerCertificateMapEntry == "" {
+							return errors.New("certificate-manager-certificate-map-entry is required if sync type has certificate-manager")
+						}
+						mapEntries = append(mapEntries, CertificateManagerMapEntry{
+							CertificateMap: certificateManagerCertificateMap,
+							Name:           certificateManagerCertificateMapEntry,
+							HostName:       certificateManagerHostName,
+						})
+					}
+					orphanPolicy, err := ParseOrphanPolicy(certificateManagerOrphanPolicy)
+					if err != nil {
+						return err
 					}
 					c, err := certificatemanager.NewClient(ctx)
 					if err != nil {
@@ -175,23 +552,237 @@ func rootCmd() *cobra.Command {
 					}
 					syncer = append(syncer,
 						NewCertificateManagerSyncer(c,
-							certificateManagerHostName,
 							certificateManagerProject,
 							certificateManagerLocation,
 							certificateManagerCertificateNamePrefix,
-							certificateManagerCertificateMap,
-							certificateManagerCertificateMapEntry,
+							mapEntries,
+							certificateManagerDeleteGracePeriod,
+							orphanPolicy,
 						),
 					)
+				} else if s == "certificate-manager-observer" {
+					if certificateManagerProject == "" {
+						return errors.New("certificate-manager-gcp-project is required if sync type has certificate-manager-observer")
+					}
+					var mapEntries []CertificateManagerMapEntry
+					for _, v := range certificateManagerMapEntries {
+						entry, err := ParseCertificateManagerMapEntry(v)
+						if err != nil {
+							return err
+						}
+						mapEntries = append(mapEntries, entry)
+					}
+					if len(mapEntries) == 0 || certificateManagerCertificateMap != "" || certificateManagerCertificateMapEntry != "" {
+						if certificateManagerCertificateMap == "" {
+							return errors.New("certificate-manager-certificate-map is required if sync type has certificate-manager-observer")
+						}
+						if certificateManagerCertificateMapEntry == "" {
+							return errors.New("certificate-manager-certificate-map-entry is required if sync type has certificate-manager-observer")
+						}
+						mapEntries = append(mapEntries, CertificateManagerMapEntry{
+							CertificateMap: certificateManagerCertificateMap,
+							Name:           certificateManagerCertificateMapEntry,
+							HostName:       certificateManagerHostName,
+						})
+					}
+					c, err := certificatemanager.NewClient(ctx)
+					if err != nil {
+						return errors.Wrap(err, "failed to create certificate-manager client")
+					}
+					syncer = append(syncer, NewCertificateManagerObserver(c, certificateManagerProject, certificateManagerLocation, mapEntries))
+				} else if s == "compute-ssl-certificate" {
+					if computeProject == "" {
+						return errors.New("compute-gcp-project is required if sync type has compute-ssl-certificate")
+					}
+					if computeCertificateNamePrefix == "" {
+						return errors.New("compute-ssl-certificate-name-prefix is required if sync type has compute-ssl-certificate")
+					}
+					if len(computeCertificateNamePrefix) > maxCertificateNamePrefixLength {
+						return fmt.Errorf("compute-ssl-certificate-name-prefix must be at most %d characters", maxCertificateNamePrefixLength)
+					}
+					if len(computeTargetHttpsProxies) == 0 && len(computeTargetSslProxies) == 0 {
+						return errors.New("compute-target-https-proxy or compute-target-ssl-proxy is required if sync type has compute-ssl-certificate")
+					}
+					sslCertificates, err := compute.NewSslCertificatesRESTClient(ctx)
+					if err != nil {
+						return errors.Wrap(err, "failed to create compute ssl-certificates client")
+					}
+					targetHttpsProxies, err := compute.NewTargetHttpsProxiesRESTClient(ctx)
+					if err != nil {
+						return errors.Wrap(err, "failed to create compute target-https-proxies client")
+					}
+					targetSslProxies, err := compute.NewTargetSslProxiesRESTClient(ctx)
+					if err != nil {
+						return errors.Wrap(err, "failed to create compute target-ssl-proxies client")
+					}
+					syncer = append(syncer, NewComputeSslCertificateSyncer(sslCertificates, targetHttpsProxies, targetSslProxies, computeProject, computeCertificateNamePrefix, computeTargetHttpsProxies, computeTargetSslProxies))
+				} else if s == "file" {
+					if filePaths.Key == "" {
+						return errors.New("file-key-path is required if sync type has file")
+					}
+					if filePaths.Cert == "" && filePaths.FullChain == "" {
+						return errors.New("file-cert-path or file-fullchain-path is required if sync type has file")
+					}
+					mode, err := strconv.ParseUint(fileMode, 8, 32)
+					if err != nil {
+						return errors.Wrap(err, "invalid value for file-mode")
+					}
+					keyMode, err := strconv.ParseUint(fileKeyMode, 8, 32)
+					if err != nil {
+						return errors.Wrap(err, "invalid value for file-key-mode")
+					}
+					signal, err := ParseSignal(fileReloadSignal)
+					if err != nil {
+						return err
+					}
+					syncer = append(syncer, NewFileSyncer(filePaths, os.FileMode(mode), os.FileMode(keyMode), fileOwner, fileGroup, strings.Fields(fileReloadCommand), fileReloadPidFile, signal))
+				} else if s == "vault-kv" {
+					if vaultKVPath == "" {
+						return errors.New("vault-kv-path is required if source / sync type has vault-kv")
+					}
+					if vaultKVVersion != 1 && vaultKVVersion != 2 {
+						return fmt.Errorf("invalid value for vault-kv-version: %d", vaultKVVersion)
+					}
+					c, err := getVaultClient(vaultAddress, vaultAuth)
+					if err != nil {
+						return errors.Wrap(err, "failed to create vault client")
+					}
+					syncer = append(syncer, NewVaultKVSyncer(c, vaultKVVersion, vaultKVMount, vaultKVPath, vaultCertField, vaultKeyField))
+				} else if s == "aws-certificate-manager" {
+					if len(awsAcmRegions) == 0 {
+						return errors.New("aws-acm-region is required if sync type has aws-certificate-manager")
+					}
+					if awsAcmCertificateName == "" {
+						return errors.New("aws-acm-certificate-name is required if sync type has aws-certificate-manager")
+					}
+					for _, region := range awsAcmRegions {
+						cfg, err := loadAwsConfig(ctx, region)
+						if err != nil {
+							return errors.Wrap(err, "failed to load aws config")
+						}
+						syncer = append(syncer, NewAwsCertificateManagerSyncer(acm.NewFromConfig(cfg), region, awsAcmCertificateName))
+					}
+				} else if s == "aws-secrets-manager" || s == "aws-ssm-parameter" {
+					if awsCertName == "" {
+						return errors.New("aws-cert-name is required if source / sync type has " + s)
+					}
+					if awsKeyName == "" {
+						return errors.New("aws-key-name is required if source / sync type has " + s)
+					}
+					cfg, err := loadAwsConfig(ctx, awsRegion)
+					if err != nil {
+						return errors.Wrap(err, "failed to load aws config")
+					}
+					if s == "aws-secrets-manager" {
+						syncer = append(syncer, NewAwsSecretsManagerSyncer(secretsmanager.NewFromConfig(cfg), awsCertName, awsKeyName, awsKmsKeyId))
+					} else {
+						syncer = append(syncer, NewAwsSsmParameterSyncer(ssm.NewFromConfig(cfg), awsCertName, awsKeyName, awsKmsKeyId))
+					}
+				} else if s == "azure-key-vault" {
+					if azureKeyVaultURL == "" {
+						return errors.New("azure-key-vault-url is required if source / sync type has azure-key-vault")
+					}
+					if azureKeyVaultCertificateName == "" {
+						return errors.New("azure-key-vault-certificate-name is required if source / sync type has azure-key-vault")
+					}
+					cred, err := azidentity.NewDefaultAzureCredential(nil)
+					if err != nil {
+						return errors.Wrap(err, "failed to create azure credential")
+					}
+					c, err := azcertificates.NewClient(azureKeyVaultURL, cred, nil)
+					if err != nil {
+						return errors.Wrap(err, "failed to create key vault client")
+					}
+					syncer = append(syncer, NewAzureKeyVaultSyncer(c, azureKeyVaultCertificateName))
+				} else if s == "webhook" {
+					if webhookURL == "" {
+						return errors.New("webhook-url is required if sync type has webhook")
+					}
+					if webhookFormat != "json" && webhookFormat != "multipart" {
+						return fmt.Errorf("invalid value for webhook-format: %s", webhookFormat)
+					}
+					if (webhookClientCertFile == "") != (webhookClientKeyFile == "") {
+						return errors.New("webhook-client-cert-file and webhook-client-key-file must be set together")
+					}
+					var hmacKey []byte
+					if webhookHMACSecretFile != "" {
+						data, err := os.ReadFile(webhookHMACSecretFile)
+						if err != nil {
+							return errors.Wrap(err, "failed to read webhook-hmac-secret-file")
+						}
+						hmacKey = []byte(strings.TrimSpace(string(data)))
+					}
+					c, err := NewWebhookHTTPClient(webhookTimeout, webhookClientCertFile, webhookClientKeyFile, webhookCAFile)
+					if err != nil {
+						return errors.Wrap(err, "failed to create webhook client")
+					}
+					syncer = append(syncer, NewWebhookSyncer(c, webhookURL, webhookFormat, hmacKey, webhookRetries))
 				} else {
 					return fmt.Errorf("invalid value for sync-type: %s", s)
 				}
 			}
+			multiSource, multi := source.(MultiFetcher)
+			multi = multi && len(secretNames) > 1
+			if len(secretNames) > 1 && !multi {
+				return errors.New("multiple secret-name is supported only by source-type kubernetes")
+			}
+			if multi {
+				for _, s := range syncer {
+					if _, ok := s.(MultiSyncer); !ok {
+						return errors.New("multiple secret-name is supported only by sync-types kubernetes")
+					}
+				}
+			}
+			var notifiers []Notifier
+			notifyClient := &http.Client{Timeout: 30 * time.Second}
+			if notifySlackWebhookURL != "" {
+				notifiers = append(notifiers, NewSlackNotifier(notifyClient, notifySlackWebhookURL))
+			}
+			if notifyWebhookURL != "" {
+				notifiers = append(notifiers, NewWebhookNotifier(notifyClient, notifyWebhookURL))
+			}
+			if notifySMTPAddr != "" {
+				if notifySMTPFrom == "" {
+					return errors.New("notify-smtp-from is required if notify-smtp-addr is set")
+				}
+				if len(notifySMTPTo) == 0 {
+					return errors.New("notify-smtp-to is required if notify-smtp-addr is set")
+				}
+				var auth smtp.Auth
+				if notifySMTPUsername != "" {
+					password, err := os.ReadFile(notifySMTPPasswordFile)
+					if err != nil {
+						return errors.Wrap(err, "failed to read notify-smtp-password-file")
+					}
+					host, _, err := net.SplitHostPort(notifySMTPAddr)
+					if err != nil {
+						return errors.Wrap(err, "invalid value for notify-smtp-addr")
+					}
+					auth = smtp.PlainAuth("", notifySMTPUsername, strings.TrimSpace(string(password)), host)
+				}
+				notifiers = append(notifiers, NewSMTPNotifier(notifySMTPAddr, auth, notifySMTPFrom, notifySMTPTo))
+			}
+			var notifications *Notifications
+			if len(notifiers) > 0 {
+				if notifyFailureThreshold < 1 {
+					return fmt.Errorf("invalid value for notify-failure-threshold: %d", notifyFailureThreshold)
+				}
+				notifications = NewNotifications(notifiers, notifyFailureThreshold, notifyExpiryWarning, notifyRepeatInterval)
+			}
+			var sourceChanges <-chan struct{}
+			if w, ok := source.(Watcher); ok {
+				c, err := w.Watch(ctx)
+				if err != nil {
+					return errors.Wrap(err, "failed to watch source")
+				}
+				sourceChanges = c
+			}
 			t := time.NewTicker(60 * time.Minute)
 			errorCount.Add(0)
 			successCount.Add(0)
-			srv := &http.Server{Addr: metricsListen}
-			http.Handle("/metrics", promhttp.Handler())
+			mux := http.NewServeMux()
+			mux.Handle("/metrics", promhttp.Handler())
+			srv := &http.Server{Addr: metricsListen, Handler: mux}
 			go func() {
 				if err := srv.ListenAndServe(); err == http.ErrServerClosed {
 					log.Print("Server closed")
@@ -206,20 +797,52 @@ func rootCmd() *cobra.Command {
 		L:
 			for {
 				log.Print("Start Sync")
-				tlsCert, tlsKey, err := source.Fetch(ctx)
+				var tlsCert, tlsKey []byte
+				var certs map[string]TLSKeyPair
+				var err error
+				if multi {
+					certs, err = multiSource.FetchAll(ctx)
+				} else {
+					tlsCert, tlsKey, err = source.Fetch(ctx)
+				}
 				succses := true
+				var syncErr error
 				if err != nil {
 					log.Print("failed to get secret: ", err)
 					succses = false
-				} else {
+					syncErr = err
+				}
+				if multi {
+					// Secrets fetched successfully are synced even if others failed.
+					for _, s := range syncer {
+						err := s.(MultiSyncer).SyncAll(ctx, certs)
+						if err != nil {
+							log.Print("failed to sync secret: ", err)
+							succses = false
+							if syncErr == nil {
+								syncErr = err
+							}
+						}
+					}
+				} else if err == nil {
 					for _, s := range syncer {
 						err := s.Sync(ctx, tlsCert, tlsKey)
 						if err != nil {
 							log.Print("failed to sync secret: ", err)
 							succses = false
+							if syncErr == nil {
+								syncErr = err
+							}
 						}
 					}
 				}
+				if notifications != nil {
+					if multi {
+						notifications.ObserveAll(ctx, certs, syncErr)
+					} else {
+						notifications.Observe(ctx, tlsCert, syncErr)
+					}
+				}
 				if succses {
 					log.Print("Success")
 					successCount.Inc()
@@ -231,24 +854,115 @@ func rootCmd() *cobra.Command {
 				case <-ctx.Done():
 					break L
 				case <-t.C:
+				case <-sourceChanges:
+					log.Print("Source changed")
 				}
 			}
 			return nil
 		},
 	}
-	rootCmd.Flags().StringVar(&sourceType, "source-type", "", "kubernetes/secret-manager")
+	rootCmd.Flags().StringVar(&sourceType, "source-type", "", "kubernetes/secret-manager/file/vault-kv/vault-pki/aws-secrets-manager/aws-ssm-parameter/azure-key-vault/acme")
 	rootCmd.Flags().StringVar(&sourceNamespace, "source-namespace", "", "namespace to get tls secret")
-	rootCmd.Flags().StringVar(&secretName, "secret-name", "", "secret name to sync")
+	rootCmd.Flags().StringVar(&sourceDir, "source-dir", "", "directory to read tls files from for file source")
+	rootCmd.Flags().StringVar(&sourceCertFile, "source-cert-file", "tls.crt", "cert file name in source-dir for file source")
+	rootCmd.Flags().StringVar(&sourceKeyFile, "source-key-file", "tls.key", "key file name in source-dir for file source")
+	rootCmd.Flags().StringVar(&sourceCombinedFile, "source-combined-file", "", "file name in source-dir containing both cert and key for file source, instead of source-cert-file and source-key-file")
+	rootCmd.Flags().StringArrayVar(&secretNames, "secret-name", nil, "secret name to sync, or source=destination to rename the secret for sync-types kubernetes. can be repeated to sync multiple secrets from source-type kubernetes to sync-types kubernetes")
+	rootCmd.Flags().BoolVar(&kubernetesSyncOptions.DiscoverReferences, "discover-references", false, "create the secret also in namespaces where ingress spec.tls or gateway listener certificateRefs reference it for kubernetes")
+	rootCmd.Flags().StringVar(&kubernetesSyncOptions.ReferenceGrantNamespace, "reference-grant-namespace", "", "namespace to keep the only copy of the secret for kubernetes. gateway api referencegrants from the annotated namespaces are created instead of copying the secret, except to namespaces discovered by ingresses")
+	rootCmd.Flags().StringVar(&kubernetesSyncOptions.Pipeline, "pipeline", defaultPipeline, "name recorded in the labels of synced secrets for kubernetes. secrets labeled by other pipelines are never modified")
+	rootCmd.Flags().BoolVar(&kubernetesSyncOptions.KeepLegacySecrets, "keep-legacy-secrets", false, "leave secrets synced by versions without ownership labels as they are for kubernetes. by default they are labeled if still requested and removed otherwise")
+	rootCmd.Flags().StringVar(&kubernetesSyncOptions.AdoptionPolicy, "adoption-policy", AdoptNever, "never/tls/always. adopt an existing secret not managed by tls-secrets-sync in a requesting namespace for kubernetes. tls adopts only kubernetes.io/tls secrets")
+	rootCmd.Flags().BoolVar(&kubernetesSyncOptions.RestartWorkloads, "restart-workloads", false, "rollout restart deployments/statefulsets/daemonsets referencing the secret by volumes or env when it is updated for kubernetes")
 	rootCmd.Flags().StringVar(&secretManagerProject, "secret-manager-gcp-project", "", "gcp project for secret-manager")
 	rootCmd.Flags().StringVar(&secretManagerTlsCertName, "cert-secret", "", "cert secret name for secret-manager")
 	rootCmd.Flags().StringVar(&secretManagerTlsKeyName, "key-secret", "", "key secret name for secret-namager")
-	rootCmd.Flags().StringArrayVar(&syncTypes, "sync-types", nil, "kubernetes/secret-manager/certificate-manager")
+	rootCmd.Flags().StringArrayVar(&secretManagerTargets, "secret-manager-sync-target", nil, "sync destination for secret-manager. project, cert-secret and key-secret default to secret-manager-gcp-project, cert-secret and key-secret. ex: project=my-project,location=asia-northeast1,cert-secret=tls-crt,key-secret=tls-key")
+	rootCmd.Flags().StringArrayVar(&syncTypes, "sync-types", nil, "kubernetes/secret-manager/certificate-manager/certificate-manager-observer/compute-ssl-certificate/file/vault-kv/aws-certificate-manager/aws-secrets-manager/aws-ssm-parameter/azure-key-vault/webhook")
 	rootCmd.Flags().StringVar(&certificateManagerHostName, "certificate-manager-host-name", "", "host name for certifiacate-manager. ex: *.example.com")
 	rootCmd.Flags().StringVar(&certificateManagerProject, "certificate-manager-gcp-project", "", "gcp project for certifiacate-manager")
 	rootCmd.Flags().StringVar(&certificateManagerLocation, "certificate-manager-location", "global", "location for certifiacate-manager")
 	rootCmd.Flags().StringVar(&certificateManagerCertificateNamePrefix, "certificate-manager-name-prefix", "", "certificate name prefix for certifiacate-manager")
 	rootCmd.Flags().StringVar(&certificateManagerCertificateMap, "certificate-manager-certificate-map", "", "certificate map name for certifiacate-manager")
 	rootCmd.Flags().StringVar(&certificateManagerCertificateMapEntry, "certificate-manager-certificate-map-entry", "", "certificate map entry name for certifiacate-manager")
+	rootCmd.Flags().StringArrayVar(&certificateManagerMapEntries, "certificate-manager-map-entry", nil, "additional certificate map entry for certifiacate-manager. ex: map=my-map,entry=wildcard,hostname=*.example.com or map=my-map,entry=primary,matcher=primary")
+	rootCmd.Flags().DurationVar(&certificateManagerDeleteGracePeriod, "certificate-manager-delete-grace-period", 0, "period to keep certificates detached from the certificate map entry before deleting them for certifiacate-manager")
+	rootCmd.Flags().StringVar(&certificateManagerOrphanPolicy, "certificate-manager-orphan-policy", string(OrphanPolicyKeep), "keep/dry-run/delete certificates with the name prefix created by this tool but not attached for certifiacate-manager")
+	rootCmd.Flags().StringVar(&computeProject, "compute-gcp-project", "", "gcp project for compute-ssl-certificate")
+	rootCmd.Flags().StringVar(&computeCertificateNamePrefix, "compute-ssl-certificate-name-prefix", "", "ssl certificate name prefix for compute-ssl-certificate")
+	rootCmd.Flags().StringArrayVar(&computeTargetHttpsProxies, "compute-target-https-proxy", nil, "global target https proxy name to attach the ssl certificate for compute-ssl-certificate")
+	rootCmd.Flags().StringArrayVar(&computeTargetSslProxies, "compute-target-ssl-proxy", nil, "global target ssl proxy name to attach the ssl certificate for compute-ssl-certificate")
+	rootCmd.Flags().StringVar(&filePaths.Cert, "file-cert-path", "", "path to write the leaf certificate for file")
+	rootCmd.Flags().StringVar(&filePaths.Key, "file-key-path", "", "path to write the private key for file")
+	rootCmd.Flags().StringVar(&filePaths.Chain, "file-chain-path", "", "path to write the intermediate certificates for file")
+	rootCmd.Flags().StringVar(&filePaths.FullChain, "file-fullchain-path", "", "path to write the leaf and intermediate certificates for file")
+	rootCmd.Flags().StringVar(&fileMode, "file-mode", "0644", "file mode of certificate files for file")
+	rootCmd.Flags().StringVar(&fileKeyMode, "file-key-mode", "0600", "file mode of the private key file for file")
+	rootCmd.Flags().IntVar(&fileOwner, "file-owner", -1, "uid of written files for file. -1 to keep the default")
+	rootCmd.Flags().IntVar(&fileGroup, "file-group", -1, "gid of written files for file. -1 to keep the default")
+	rootCmd.Flags().StringVar(&fileReloadCommand, "file-reload-command", "", "command to run after files are changed for file. executed without shell")
+	rootCmd.Flags().StringVar(&fileReloadPidFile, "file-reload-pid-file", "", "pid file of the process to signal after files are changed for file")
+	rootCmd.Flags().StringVar(&fileReloadSignal, "file-reload-signal", "HUP", "signal to send to the process in file-reload-pid-file for file")
+	rootCmd.Flags().StringVar(&vaultAddress, "vault-address", "", "vault address for vault-kv. VAULT_ADDR is used if empty")
+	rootCmd.Flags().StringVar(&vaultAuth.Method, "vault-auth-method", "token", "token/approle/kubernetes auth for vault-kv. the token is read from VAULT_TOKEN for token auth")
+	rootCmd.Flags().StringVar(&vaultAuth.Mount, "vault-auth-mount", "", "mount path of the auth method for vault-kv. defaults to vault-auth-method")
+	rootCmd.Flags().StringVar(&vaultAuth.RoleID, "vault-approle-role-id", "", "role id for approle auth of vault-kv")
+	rootCmd.Flags().StringVar(&vaultAuth.SecretIDFile, "vault-approle-secret-id-file", "", "file containing the secret id for approle auth of vault-kv")
+	rootCmd.Flags().StringVar(&vaultAuth.KubernetesRole, "vault-kubernetes-role", "", "role for kubernetes auth of vault-kv")
+	rootCmd.Flags().StringVar(&vaultAuth.KubernetesTokenFile, "vault-kubernetes-token-file", defaultKubernetesServiceAccountTokenPath, "service account token file for kubernetes auth of vault-kv")
+	rootCmd.Flags().StringVar(&vaultKVMount, "vault-kv-mount", "secret", "mount path of the kv secrets engine for vault-kv")
+	rootCmd.Flags().IntVar(&vaultKVVersion, "vault-kv-version", 2, "version of the kv secrets engine (1/2) for vault-kv")
+	rootCmd.Flags().StringVar(&vaultKVPath, "vault-kv-path", "", "secret path in vault-kv-mount for vault-kv")
+	rootCmd.Flags().IntVar(&vaultKVReadVersion, "vault-kv-read-version", 0, "secret version to read for vault-kv source with kv v2. 0 for the latest")
+	rootCmd.Flags().StringVar(&vaultCertField, "vault-cert-field", "tls.crt", "field name of the certificate for vault-kv")
+	rootCmd.Flags().StringVar(&vaultKeyField, "vault-key-field", "tls.key", "field name of the private key for vault-kv")
+	rootCmd.Flags().StringVar(&vaultPKIMount, "vault-pki-mount", "pki", "mount path of the pki secrets engine for vault-pki")
+	rootCmd.Flags().StringVar(&vaultPKIRole, "vault-pki-role", "", "role to issue the certificate for vault-pki")
+	rootCmd.Flags().StringVar(&vaultPKIRequest.CommonName, "vault-pki-common-name", "", "common name of the certificate for vault-pki")
+	rootCmd.Flags().StringArrayVar(&vaultPKIRequest.AltNames, "vault-pki-alt-name", nil, "dns subject alternative name of the certificate for vault-pki")
+	rootCmd.Flags().StringArrayVar(&vaultPKIRequest.IPSANs, "vault-pki-ip-san", nil, "ip subject alternative name of the certificate for vault-pki")
+	rootCmd.Flags().DurationVar(&vaultPKIRequest.TTL, "vault-pki-ttl", 0, "ttl of the certificate for vault-pki. 0 for the default of the role")
+	rootCmd.Flags().Float64Var(&vaultPKIRenewFraction, "vault-pki-renew-fraction", 2.0/3, "fraction of the certificate lifetime after which a new certificate is issued for vault-pki")
+	rootCmd.Flags().StringArrayVar(&awsAcmRegions, "aws-acm-region", nil, "aws region to import the certificate for aws-certificate-manager")
+	rootCmd.Flags().StringVar(&awsAcmCertificateName, "aws-acm-certificate-name", "", "Name tag to find the imported certificate for aws-certificate-manager")
+	rootCmd.Flags().StringVar(&awsRegion, "aws-region", "", "aws region for aws-secrets-manager / aws-ssm-parameter. AWS_REGION is used if empty")
+	rootCmd.Flags().StringVar(&awsCertName, "aws-cert-name", "", "cert secret / parameter name for aws-secrets-manager / aws-ssm-parameter")
+	rootCmd.Flags().StringVar(&awsKeyName, "aws-key-name", "", "key secret / parameter name for aws-secrets-manager / aws-ssm-parameter")
+	rootCmd.Flags().StringVar(&awsKmsKeyId, "aws-kms-key-id", "", "kms key to encrypt secrets / parameters written by aws-secrets-manager / aws-ssm-parameter. the aws managed key is used if empty")
+	rootCmd.Flags().StringVar(&azureKeyVaultURL, "azure-key-vault-url", "", "vault url for azure-key-vault. ex: https://my-vault.vault.azure.net/")
+	rootCmd.Flags().StringVar(&azureKeyVaultCertificateName, "azure-key-vault-certificate-name", "", "certificate name for azure-key-vault")
+	rootCmd.Flags().StringVar(&acmeDirectoryURL, "acme-directory-url", acme.LetsEncryptURL, "directory url of the acme server for acme")
+	rootCmd.Flags().StringVar(&acmeEmail, "acme-email", "", "contact email of the acme account for acme")
+	rootCmd.Flags().StringArrayVar(&acmeDomains, "acme-domain", nil, "domain of the certificate for acme. the first one is used as the common name")
+	rootCmd.Flags().StringVar(&acmeChallenge, "acme-challenge", "http-01", "http-01/dns-01 challenge to solve for acme")
+	rootCmd.Flags().StringVar(&acmeHTTP01Listen, "acme-http01-listen", ":8089", "listen address:port to answer http-01 challenges for acme. port 80 of the domains must be routed here")
+	rootCmd.Flags().StringVar(&acmeDNSProvider, "acme-dns-provider", "cloud-dns", "cloud-dns/exec provider to present dns-01 records for acme")
+	rootCmd.Flags().DurationVar(&acmeDNSPropagationDelay, "acme-dns-propagation-delay", 30*time.Second, "period to wait after presenting dns-01 records for acme")
+	rootCmd.Flags().StringVar(&acmeCloudDNSProject, "acme-cloud-dns-gcp-project", "", "gcp project of the managed zone for acme with cloud-dns")
+	rootCmd.Flags().StringVar(&acmeCloudDNSZone, "acme-cloud-dns-managed-zone", "", "managed zone name for acme with cloud-dns")
+	rootCmd.Flags().StringVar(&acmeDNSCommand, "acme-dns-command", "", "command run as \"<command> present|cleanup <fqdn> <value>\" for acme with exec. executed without shell")
+	rootCmd.Flags().StringVar(&acmeStorage, "acme-storage", "kubernetes", "kubernetes/secret-manager to store the acme account and certificate for acme")
+	rootCmd.Flags().StringVar(&acmeStorageNamespace, "acme-storage-namespace", "", "namespace of the storage secret for acme with kubernetes")
+	rootCmd.Flags().StringVar(&acmeStorageSecret, "acme-storage-secret", "", "storage secret name for acme. the project of secret-manager is secret-manager-gcp-project")
+	rootCmd.Flags().DurationVar(&acmeRenewBefore, "acme-renew-before", 30*24*time.Hour, "period before expiry to renew the certificate for acme")
+	rootCmd.Flags().StringVar(&webhookURL, "webhook-url", "", "url to post the certificate for webhook")
+	rootCmd.Flags().StringVar(&webhookFormat, "webhook-format", "json", "json/multipart body format for webhook")
+	rootCmd.Flags().StringVar(&webhookHMACSecretFile, "webhook-hmac-secret-file", "", "file containing the key to sign bodies for webhook. the signature is sent as \"sha256=<hex hmac of timestamp.body>\" in X-Tls-Secrets-Sync-Signature")
+	rootCmd.Flags().StringVar(&webhookClientCertFile, "webhook-client-cert-file", "", "client certificate file for mtls of webhook")
+	rootCmd.Flags().StringVar(&webhookClientKeyFile, "webhook-client-key-file", "", "client key file for mtls of webhook")
+	rootCmd.Flags().StringVar(&webhookCAFile, "webhook-ca-file", "", "additional ca certificates file to verify the server for webhook")
+	rootCmd.Flags().DurationVar(&webhookTimeout, "webhook-timeout", 30*time.Second, "timeout of each request for webhook")
+	rootCmd.Flags().IntVar(&webhookRetries, "webhook-retries", 3, "number of retries on network errors and 5xx / 429 responses for webhook")
+	rootCmd.Flags().StringVar(&notifySlackWebhookURL, "notify-slack-webhook-url", "", "slack compatible incoming webhook url for notifications")
+	rootCmd.Flags().StringVar(&notifyWebhookURL, "notify-webhook-url", "", "url to post notifications as json")
+	rootCmd.Flags().StringVar(&notifySMTPAddr, "notify-smtp-addr", "", "smtp server host:port to mail notifications")
+	rootCmd.Flags().StringVar(&notifySMTPUsername, "notify-smtp-username", "", "username for plain auth of notify-smtp-addr")
+	rootCmd.Flags().StringVar(&notifySMTPPasswordFile, "notify-smtp-password-file", "", "file containing the password for plain auth of notify-smtp-addr")
+	rootCmd.Flags().StringVar(&notifySMTPFrom, "notify-smtp-from", "", "from address of notification mails")
+	rootCmd.Flags().StringArrayVar(&notifySMTPTo, "notify-smtp-to", nil, "recipient of notification mails")
+	rootCmd.Flags().IntVar(&notifyFailureThreshold, "notify-failure-threshold", 3, "number of consecutive failed syncs to notify")
+	rootCmd.Flags().DurationVar(&notifyExpiryWarning, "notify-expiry-warning", 14*24*time.Hour, "period before expiry of the certificate to notify")
+	rootCmd.Flags().DurationVar(&notifyRepeatInterval, "notify-repeat-interval", 24*time.Hour, "period to suppress the same notification")
 	rootCmd.Flags().StringVar(&metricsListen, "metrics-listen", ":9090", "listen address:port for metrics-server")
 
 	if err := rootCmd.MarkFlagRequired("source-type"); err != nil {
@@ -2,9 +2,17 @@ package main
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
 	"testing"
 	"time"
 
+	secretmanager "cloud.google.com/go/secretmanager/apiv1"
 	"github.com/stretchr/testify/assert"
 	"k8s.io/client-go/kubernetes/fake"
 )
@@ -12,11 +20,43 @@ import (
 func prepareFake(t *testing.T) *fakeSecretManagerServer {
 	s, f := fakeServerForSecretManager(t)
 	secretManagerClient = s
+	regionalSecretManagerClients = map[string]*secretmanager.Client{"asia-northeast1": s}
 
 	clientset = fake.NewSimpleClientset()
+	dynamicClient = newFakeDynamicClient(t)
+	vaultClient = nil
 	return f
 }
 
+// newTestCertificate returns a self-signed certificate and its private key in PEM.
+func newTestCertificate(t *testing.T, commonName string, notAfter time.Time) ([]byte, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{commonName},
+		NotBefore:    notAfter.Add(-90 * 24 * time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer})
+}
+
 func TestRootCmd(t *testing.T) {
 	validSourceK8sArgs := []string{"--source-type", "kubernetes", "--source-namespace", "certs", "--secret-name", "piyo"}
 	validSourceSecretManagerArgs := []string{"--source-type", "secret-manager", "--secret-manager-gcp-project", "test-project", "--cert-secret", "cert-secret", "--key-secret", "key-secret"}
@@ -44,6 +84,11 @@ func TestRootCmd(t *testing.T) {
 			Args:          []string{"--source-type", "kubernetes", "--source-namespace", "certs"},
 			ExpectedError: "secret-name is required",
 		},
+		{
+			Name:          "No Source Dir Argument",
+			Args:          []string{"--source-type", "file"},
+			ExpectedError: "source-dir is required",
+		},
 		{
 			Name:          "No Gcp Project Argument",
 			Args:          []string{"--source-type", "secret-manager", "--cert-secret", "cert-secret", "--key-secret", "key-secret"},
@@ -74,6 +119,131 @@ func TestRootCmd(t *testing.T) {
 			Args:          append(validSourceK8sArgs, "--sync-types", "secret-manager", "--secret-manager-gcp-project", "test-project", "--cert-secret", "cert-secret"),
 			ExpectedError: "key-secret is required",
 		},
+		{
+			Name:          "Secret Manager Sync Invalid Target",
+			Args:          append(validSourceK8sArgs, "--sync-types", "secret-manager", "--secret-manager-sync-target", "cert-secret=cert-secret"),
+			ExpectedError: "project is required",
+		},
+		{
+			Name:          "Secret Manager Sync Targets",
+			Args:          append(validSourceK8sArgs, "--sync-types", "secret-manager", "--cert-secret", "cert-secret", "--key-secret", "key-secret", "--secret-manager-sync-target", "project=p1", "--secret-manager-sync-target", "project=p2,location=asia-northeast1"),
+			ExpectedError: "",
+		},
+		{
+			Name:          "Certificate Manager Invalid Orphan Policy",
+			Args:          append(validSourceK8sArgs, "--sync-types", "certificate-manager", "--certificate-manager-host-name", "*.example.com", "--certificate-manager-gcp-project", "test-project", "--certificate-manager-name-prefix", "test-", "--certificate-manager-certificate-map", "test-map", "--certificate-manager-certificate-map-entry", "test-entry", "--certificate-manager-orphan-policy", "remove"),
+			ExpectedError: "invalid orphan policy",
+		},
+		{
+			Name:          "Certificate Manager Too Long Prefix",
+			Args:          append(validSourceK8sArgs, "--sync-types", "certificate-manager", "--certificate-manager-host-name", "*.example.com", "--certificate-manager-gcp-project", "test-project", "--certificate-manager-name-prefix", "a-very-long-certificate-name-prefix-for-test-", "--certificate-manager-certificate-map", "test-map", "--certificate-manager-certificate-map-entry", "test-entry"),
+			ExpectedError: "certificate-manager-name-prefix must be at most",
+		},
+		{
+			Name:          "Compute SSL Certificate Too Long Prefix",
+			Args:          append(validSourceK8sArgs, "--sync-types", "compute-ssl-certificate", "--compute-gcp-project", "test-project", "--compute-ssl-certificate-name-prefix", "a-very-long-certificate-name-prefix-for-test-", "--compute-target-https-proxy", "test-proxy"),
+			ExpectedError: "compute-ssl-certificate-name-prefix must be at most",
+		},
+		{
+			Name:          "File Sync No Key Path",
+			Args:          append(validSourceK8sArgs, "--sync-types", "file", "--file-cert-path", "/tmp/tls.crt"),
+			ExpectedError: "file-key-path is required",
+		},
+		{
+			Name:          "File Sync Invalid Mode",
+			Args:          append(validSourceK8sArgs, "--sync-types", "file", "--file-cert-path", "/tmp/tls.crt", "--file-key-path", "/tmp/tls.key", "--file-mode", "0999"),
+			ExpectedError: "invalid value for file-mode",
+		},
+		{
+			Name:          "Vault KV No Path",
+			Args:          []string{"--source-type", "vault-kv"},
+			ExpectedError: "vault-kv-path is required",
+		},
+		{
+			Name:          "Vault KV Invalid Auth Method",
+			Args:          append(validSourceK8sArgs, "--sync-types", "vault-kv", "--vault-kv-path", "tls", "--vault-auth-method", "userpass"),
+			ExpectedError: "invalid vault auth method",
+		},
+		{
+			Name:          "Vault PKI No Common Name",
+			Args:          []string{"--source-type", "vault-pki", "--vault-pki-role", "web"},
+			ExpectedError: "vault-pki-common-name is required",
+		},
+		{
+			Name:          "Vault PKI Invalid Renew Fraction",
+			Args:          []string{"--source-type", "vault-pki", "--vault-pki-role", "web", "--vault-pki-common-name", "example.com", "--vault-pki-renew-fraction", "1.5"},
+			ExpectedError: "invalid value for vault-pki-renew-fraction",
+		},
+		{
+			Name:          "AWS Certificate Manager Sync No Region",
+			Args:          append(validSourceK8sArgs, "--sync-types", "aws-certificate-manager", "--aws-acm-certificate-name", "example"),
+			ExpectedError: "aws-acm-region is required",
+		},
+		{
+			Name:          "AWS Secrets Manager No Key Name",
+			Args:          []string{"--source-type", "aws-secrets-manager", "--aws-cert-name", "tls-crt"},
+			ExpectedError: "aws-key-name is required",
+		},
+		{
+			Name:          "AWS SSM Parameter Sync No Cert Name",
+			Args:          append(validSourceK8sArgs, "--sync-types", "aws-ssm-parameter", "--aws-key-name", "/tls/key"),
+			ExpectedError: "aws-cert-name is required",
+		},
+		{
+			Name:          "Azure Key Vault Sync No Certificate Name",
+			Args:          append(validSourceK8sArgs, "--sync-types", "azure-key-vault", "--azure-key-vault-url", "https://test.vault.azure.net/"),
+			ExpectedError: "azure-key-vault-certificate-name is required",
+		},
+		{
+			Name:          "ACME No Domain",
+			Args:          []string{"--source-type", "acme", "--acme-storage-namespace", "certs", "--acme-storage-secret", "acme"},
+			ExpectedError: "acme-domain is required",
+		},
+		{
+			Name:          "ACME Exec DNS Provider No Command",
+			Args:          []string{"--source-type", "acme", "--acme-domain", "example.com", "--acme-storage-namespace", "certs", "--acme-storage-secret", "acme", "--acme-challenge", "dns-01", "--acme-dns-provider", "exec"},
+			ExpectedError: "acme-dns-command is required",
+		},
+		{
+			Name:          "Webhook Sync Invalid Format",
+			Args:          append(validSourceK8sArgs, "--sync-types", "webhook", "--webhook-url", "https://example.com/hook", "--webhook-format", "xml"),
+			ExpectedError: "invalid value for webhook-format",
+		},
+		{
+			Name:          "Notify SMTP No Recipient",
+			Args:          append(validSourceK8sArgs, "--sync-types", "kubernetes", "--notify-smtp-addr", "smtp.example.com:587", "--notify-smtp-from", "sync@example.com"),
+			ExpectedError: "notify-smtp-to is required",
+		},
+		{
+			Name:          "Multiple Secret Names Unsupported Sync",
+			Args:          append(validSourceK8sArgs, "--secret-name", "fuga", "--sync-types", "file", "--file-cert-path", "/tmp/tls.crt", "--file-key-path", "/tmp/tls.key"),
+			ExpectedError: "multiple secret-name is supported only by sync-types kubernetes",
+		},
+		{
+			Name:          "Multiple Secret Names Unsupported Source",
+			Args:          append(validSourceSecretManagerArgs, "--secret-name", "piyo", "--secret-name", "fuga", "--sync-types", "kubernetes"),
+			ExpectedError: "multiple secret-name is supported only by source-type kubernetes",
+		},
+		{
+			Name:          "Invalid Secret Name Mapping",
+			Args:          []string{"--source-type", "kubernetes", "--source-namespace", "certs", "--secret-name", "piyo=", "--sync-types", "kubernetes"},
+			ExpectedError: "invalid secret name",
+		},
+		{
+			Name:          "Kubernetes Sync Invalid Pipeline",
+			Args:          append(validSourceK8sArgs, "--sync-types", "kubernetes", "--pipeline", "not a label"),
+			ExpectedError: "invalid value for pipeline",
+		},
+		{
+			Name:          "Kubernetes Sync Invalid Adoption Policy",
+			Args:          append(validSourceK8sArgs, "--sync-types", "kubernetes", "--adoption-policy", "opaque"),
+			ExpectedError: "invalid value for adoption-policy",
+		},
+		{
+			Name:          "Kubernetes Sync Reference Grant In Source Namespace",
+			Args:          append(validSourceK8sArgs, "--sync-types", "kubernetes", "--reference-grant-namespace", "certs"),
+			ExpectedError: "reference-grant-namespace must be different from source-namespace",
+		},
 		{
 			Name:          "Kubernetes Sync No SecretName",
 			Args:          append(validSourceSecretManagerArgs, "--sync-types", "kubernetes"),
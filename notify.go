@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/smtp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	NotificationRotation = "rotation"
+	NotificationFailure  = "failure"
+	NotificationExpiry   = "expiry"
+)
+
+// Notification is an event delivered through Notifiers.
+type Notification struct {
+	Kind        string     `json:"kind"`
+	Subject     string     `json:"subject"`
+	Message     string     `json:"message"`
+	Fingerprint string     `json:"fingerprint,omitempty"`
+	NotAfter    *time.Time `json:"notAfter,omitempty"`
+	Time        time.Time  `json:"time"`
+}
+
+// Notifier delivers a Notification to a channel.
+type Notifier interface {
+	Notify(ctx context.Context, n Notification) error
+}
+
+// Notifications decides what to notify from the result of every sync.
+// It notifies when the certificate is rotated, when syncs fail failureThreshold times in a row,
+// and when the certificate expires within expiryWarning.
+// The same notification is not sent again within repeatInterval, and a failure streak is notified once.
+type Notifications struct {
+	notifiers        []Notifier
+	failureThreshold int
+	expiryWarning    time.Duration
+	repeatInterval   time.Duration
+	failures         int
+	lastFingerprints map[string]string
+	sent             map[string]time.Time
+	now              func() time.Time
+}
+
+func NewNotifications(notifiers []Notifier, failureThreshold int, expiryWarning time.Duration, repeatInterval time.Duration) *Notifications {
+	return &Notifications{
+		notifiers:        notifiers,
+		failureThreshold: failureThreshold,
+		expiryWarning:    expiryWarning,
+		repeatInterval:   repeatInterval,
+		lastFingerprints: make(map[string]string),
+		sent:             make(map[string]time.Time),
+		now:              time.Now,
+	}
+}
+
+// Observe is called after every sync with the fetched certificate, nil if fetching failed,
+// and the first error of the sync.
+func (n *Notifications) Observe(ctx context.Context, tlsCert []byte, syncErr error) {
+	n.observeFailure(ctx, syncErr)
+	if tlsCert != nil {
+		n.observeCertificate(ctx, "", tlsCert, syncErr)
+	}
+}
+
+// ObserveAll is Observe for multiple secrets, called with the certificates fetched successfully keyed by secret name.
+// Rotations are tracked per secret name.
+func (n *Notifications) ObserveAll(ctx context.Context, certs map[string]TLSKeyPair, syncErr error) {
+	n.observeFailure(ctx, syncErr)
+	names := make([]string, 0, len(certs))
+	for name := range certs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		n.observeCertificate(ctx, name, certs[name].Cert, syncErr)
+	}
+}
+
+func (n *Notifications) observeFailure(ctx context.Context, syncErr error) {
+	if syncErr != nil {
+		n.failures++
+		if n.failures >= n.failureThreshold {
+			n.send(ctx, NotificationFailure, Notification{
+				Kind:    NotificationFailure,
+				Subject: fmt.Sprintf("tls-secrets-sync failed %d times in a row", n.failures),
+				Message: syncErr.Error(),
+			})
+		}
+	} else {
+		n.failures = 0
+		delete(n.sent, NotificationFailure)
+	}
+}
+
+// observeCertificate sends rotation and expiry notifications for tlsCert of the secret name.
+func (n *Notifications) observeCertificate(ctx context.Context, name string, tlsCert []byte, syncErr error) {
+	leaf, err := parseLeafCertificate(tlsCert)
+	if err != nil {
+		log.Print("failed to parse certificate for notifications: ", err)
+		return
+	}
+	sum := sha256.Sum256(leaf.Raw)
+	fingerprint := hex.EncodeToString(sum[:])
+	names := strings.Join(leaf.DNSNames, ",")
+	if syncErr == nil && fingerprint != n.lastFingerprints[name] {
+		// The certificate found at startup is not a rotation.
+		if n.lastFingerprints[name] != "" {
+			n.send(ctx, NotificationRotation+":"+fingerprint, Notification{
+				Kind:        NotificationRotation,
+				Subject:     fmt.Sprintf("certificate for %s is rotated", names),
+				Message:     fmt.Sprintf("the new certificate expires at %s", leaf.NotAfter.Format(time.RFC3339)),
+				Fingerprint: fingerprint,
+				NotAfter:    &leaf.NotAfter,
+			})
+		}
+		n.lastFingerprints[name] = fingerprint
+	}
+	if remaining := leaf.NotAfter.Sub(n.now()); remaining < n.expiryWarning {
+		n.send(ctx, NotificationExpiry+":"+fingerprint, Notification{
+			Kind:        NotificationExpiry,
+			Subject:     fmt.Sprintf("certificate for %s expires in %s", names, remaining.Truncate(time.Minute)),
+			Message:     fmt.Sprintf("the certificate expires at %s", leaf.NotAfter.Format(time.RFC3339)),
+			Fingerprint: fingerprint,
+			NotAfter:    &leaf.NotAfter,
+		})
+	}
+}
+
+// send delivers notification unless key was sent within repeatInterval.
+// key is recorded only when every notifier succeeds, so failed deliveries are retried on the next sync.
+func (n *Notifications) send(ctx context.Context, key string, notification Notification) {
+	now := n.now()
+	if sent, ok := n.sent[key]; ok && (key == NotificationFailure || now.Sub(sent) < n.repeatInterval) {
+		return
+	}
+	notification.Time = now
+	ok := true
+	for _, notifier := range n.notifiers {
+		if err := notifier.Notify(ctx, notification); err != nil {
+			log.Printf("failed to send %s notification: %v", notification.Kind, err)
+			ok = false
+		}
+	}
+	if ok {
+		log.Printf("sent %s notification: %s", notification.Kind, notification.Subject)
+		n.sent[key] = now
+	}
+}
+
+func postNotificationJSON(ctx context.Context, client *http.Client, url string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("%s returned %s: %s", url, res.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// SlackNotifier posts notifications to a Slack incoming webhook or a compatible endpoint.
+type SlackNotifier struct {
+	client *http.Client
+	url    string
+}
+
+func NewSlackNotifier(client *http.Client, url string) *SlackNotifier {
+	return &SlackNotifier{client: client, url: url}
+}
+
+func (s *SlackNotifier) Notify(ctx context.Context, n Notification) error {
+	return postNotificationJSON(ctx, s.client, s.url, map[string]string{
+		"text": fmt.Sprintf("*%s*\n%s", n.Subject, n.Message),
+	})
+}
+
+// WebhookNotifier posts notifications as Notification JSON.
+type WebhookNotifier struct {
+	client *http.Client
+	url    string
+}
+
+func NewWebhookNotifier(client *http.Client, url string) *WebhookNotifier {
+	return &WebhookNotifier{client: client, url: url}
+}
+
+func (s *WebhookNotifier) Notify(ctx context.Context, n Notification) error {
+	return postNotificationJSON(ctx, s.client, s.url, n)
+}
+
+// smtpTimeout bounds a delivery, as notifications are sent synchronously in the sync loop.
+const smtpTimeout = 30 * time.Second
+
+// SMTPNotifier mails notifications. auth is nil for servers without authentication.
+type SMTPNotifier struct {
+	addr     string
+	auth     smtp.Auth
+	from     string
+	to       []string
+	sendMail func(ctx context.Context, addr string, a smtp.Auth, from string, to []string, msg []byte) error
+}
+
+func NewSMTPNotifier(addr string, auth smtp.Auth, from string, to []string) *SMTPNotifier {
+	return &SMTPNotifier{
+		addr:     addr,
+		auth:     auth,
+		from:     from,
+		to:       to,
+		sendMail: sendMail,
+	}
+}
+
+func (s *SMTPNotifier) Notify(ctx context.Context, n Notification) error {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", s.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(s.to, ", "))
+	fmt.Fprintf(&msg, "Subject: [tls-secrets-sync] %s\r\n", n.Subject)
+	fmt.Fprintf(&msg, "Date: %s\r\n", n.Time.Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	fmt.Fprintf(&msg, "%s\r\n", n.Message)
+	ctx, cancel := context.WithTimeout(ctx, smtpTimeout)
+	defer cancel()
+	if err := s.sendMail(ctx, s.addr, s.auth, s.from, s.to, msg.Bytes()); err != nil {
+		return fmt.Errorf("send mail: %w", err)
+	}
+	return nil
+}
+
+// sendMail is smtp.SendMail honoring the deadline of ctx.
+func sendMail(ctx context.Context, addr string, a smtp.Auth, from string, to []string, msg []byte) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			return err
+		}
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if a != nil {
+		if err := c.Auth(a); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(from); err != nil {
+		return err
+	}
+	for _, addr := range to {
+		if err := c.Rcpt(addr); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
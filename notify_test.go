@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/smtp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeNotifier struct {
+	notifications []Notification
+	err           error
+}
+
+func (n *fakeNotifier) Notify(_ context.Context, notification Notification) error {
+	if n.err != nil {
+		return n.err
+	}
+	n.notifications = append(n.notifications, notification)
+	return nil
+}
+
+func (n *fakeNotifier) kinds() []string {
+	var kinds []string
+	for _, notification := range n.notifications {
+		kinds = append(kinds, notification.Kind)
+	}
+	return kinds
+}
+
+func TestNotificationsRotation(t *testing.T) {
+	ctx := context.Background()
+	notifier := &fakeNotifier{}
+	n := NewNotifications([]Notifier{notifier}, 3, 14*24*time.Hour, 24*time.Hour)
+	tlsCert, _ := newTestCertificate(t, "www.example.com", time.Now().Add(60*24*time.Hour))
+	renewed, _ := newTestCertificate(t, "www.example.com", time.Now().Add(90*24*time.Hour))
+
+	n.Observe(ctx, tlsCert, nil)
+	n.Observe(ctx, tlsCert, nil)
+	assert.Empty(t, notifier.notifications)
+	// A rotation is notified only after every destination is synced.
+	n.Observe(ctx, renewed, errors.New("failed"))
+	assert.Empty(t, notifier.notifications)
+	n.Observe(ctx, renewed, nil)
+	n.Observe(ctx, renewed, nil)
+	if assert.Equal(t, []string{NotificationRotation}, notifier.kinds()) {
+		assert.Equal(t, "certificate for www.example.com is rotated", notifier.notifications[0].Subject)
+		assert.Len(t, notifier.notifications[0].Fingerprint, 64)
+	}
+}
+
+func TestNotificationsObserveAll(t *testing.T) {
+	ctx := context.Background()
+	notifier := &fakeNotifier{}
+	n := NewNotifications([]Notifier{notifier}, 3, 14*24*time.Hour, 24*time.Hour)
+	www, _ := newTestCertificate(t, "www.example.com", time.Now().Add(60*24*time.Hour))
+	api, _ := newTestCertificate(t, "api.example.com", time.Now().Add(60*24*time.Hour))
+	renewed, _ := newTestCertificate(t, "api.example.com", time.Now().Add(90*24*time.Hour))
+	expiring, _ := newTestCertificate(t, "mail.example.com", time.Now().Add(24*time.Hour))
+
+	// Different certificates of each secret are not rotations of each other.
+	n.ObserveAll(ctx, map[string]TLSKeyPair{"www": {Cert: www}, "api": {Cert: api}}, nil)
+	n.ObserveAll(ctx, map[string]TLSKeyPair{"www": {Cert: www}, "api": {Cert: api}}, nil)
+	assert.Empty(t, notifier.notifications)
+	n.ObserveAll(ctx, map[string]TLSKeyPair{"www": {Cert: www}, "api": {Cert: renewed}, "mail": {Cert: expiring}}, nil)
+	if assert.Equal(t, []string{NotificationRotation, NotificationExpiry}, notifier.kinds()) {
+		assert.Equal(t, "certificate for api.example.com is rotated", notifier.notifications[0].Subject)
+	}
+}
+
+func TestNotificationsFailure(t *testing.T) {
+	ctx := context.Background()
+	notifier := &fakeNotifier{}
+	n := NewNotifications([]Notifier{notifier}, 2, 0, time.Hour)
+	for i := 0; i < 4; i++ {
+		n.Observe(ctx, nil, errors.New("connection refused"))
+	}
+	if assert.Equal(t, []string{NotificationFailure}, notifier.kinds()) {
+		assert.Equal(t, "tls-secrets-sync failed 2 times in a row", notifier.notifications[0].Subject)
+		assert.Equal(t, "connection refused", notifier.notifications[0].Message)
+	}
+
+	// A new streak after a success is notified again.
+	n.Observe(ctx, nil, nil)
+	n.Observe(ctx, nil, errors.New("connection refused"))
+	assert.Len(t, notifier.notifications, 1)
+	n.Observe(ctx, nil, errors.New("connection refused"))
+	assert.Len(t, notifier.notifications, 2)
+}
+
+func TestNotificationsExpiry(t *testing.T) {
+	ctx := context.Background()
+	notifier := &fakeNotifier{err: errors.New("unavailable")}
+	n := NewNotifications([]Notifier{notifier}, 3, 14*24*time.Hour, 24*time.Hour)
+	now := time.Now()
+	n.now = func() time.Time { return now }
+	tlsCert, _ := newTestCertificate(t, "www.example.com", now.Add(7*24*time.Hour))
+
+	// Undelivered notifications are retried.
+	n.Observe(ctx, tlsCert, nil)
+	notifier.err = nil
+	n.Observe(ctx, tlsCert, nil)
+	n.Observe(ctx, tlsCert, nil)
+	assert.Equal(t, []string{NotificationExpiry}, notifier.kinds())
+
+	now = now.Add(25 * time.Hour)
+	n.Observe(ctx, tlsCert, nil)
+	assert.Equal(t, []string{NotificationExpiry, NotificationExpiry}, notifier.kinds())
+}
+
+func TestSlackAndWebhookNotifier(t *testing.T) {
+	ctx := context.Background()
+	var bodies []map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		bodies = append(bodies, body)
+	}))
+	t.Cleanup(srv.Close)
+	notification := Notification{Kind: NotificationFailure, Subject: "subject", Message: "message"}
+
+	assert.NoError(t, NewSlackNotifier(srv.Client(), srv.URL).Notify(ctx, notification))
+	assert.NoError(t, NewWebhookNotifier(srv.Client(), srv.URL).Notify(ctx, notification))
+	if assert.Len(t, bodies, 2) {
+		assert.Equal(t, "*subject*\nmessage", bodies[0]["text"])
+		assert.Equal(t, NotificationFailure, bodies[1]["kind"])
+		assert.NotContains(t, bodies[1], "notAfter")
+		assert.Equal(t, "subject", bodies[1]["subject"])
+	}
+}
+
+func TestSMTPNotifier(t *testing.T) {
+	notifier := NewSMTPNotifier("smtp.example.com:587", nil, "sync@example.com", []string{"a@example.com", "b@example.com"})
+	var addr string
+	var to []string
+	var msg []byte
+	var deadline bool
+	notifier.sendMail = func(ctx context.Context, a string, _ smtp.Auth, _ string, t []string, m []byte) error {
+		addr, to, msg = a, t, m
+		_, deadline = ctx.Deadline()
+		return nil
+	}
+	err := notifier.Notify(context.Background(), Notification{Kind: NotificationExpiry, Subject: "subject", Message: "message", Time: time.Now()})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "smtp.example.com:587", addr)
+		assert.Equal(t, []string{"a@example.com", "b@example.com"}, to)
+		assert.Contains(t, string(msg), "Subject: [tls-secrets-sync] subject\r\n")
+		assert.Contains(t, string(msg), "To: a@example.com, b@example.com\r\n")
+		assert.True(t, deadline)
+	}
+}
+
+func TestSendMailTimeout(t *testing.T) {
+	// A server accepting the connection but never greeting must not block the sync loop.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	t.Cleanup(func() {
+		close(done)
+		_ = l.Close()
+	})
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		<-done
+		_ = conn.Close()
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err = sendMail(ctx, l.Addr().String(), nil, "sync@example.com", []string{"a@example.com"}, []byte("message"))
+	assert.Error(t, err)
+}
@@ -3,13 +3,22 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"fmt"
 	"log"
+	"strings"
 
 	secretmanager "cloud.google.com/go/secretmanager/apiv1"
 	"cloud.google.com/go/secretmanager/apiv1/secretmanagerpb"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+)
+
+// Secret Manager annotation keys may not contain "/", so the annotationKey prefix cannot be used here.
+const (
+	secretManagerFingerprintAnnotation = "tls-secrets-sync-sha256"
+	secretManagerVersionAnnotation     = "tls-secrets-sync-version"
 )
 
 type SecretManagerFetcher struct {
@@ -43,11 +52,18 @@ func (f *SecretManagerFetcher) Fetch(ctx context.Context) ([]byte, []byte, error
 	return cv.Payload.Data, kv.Payload.Data, nil
 }
 
+// SecretManagerSyncer adds secret versions when the certificate changes.
+// Besides secretmanager.versions.add and secretmanager.versions.access, it needs secretmanager.secrets.get,
+// secretmanager.versions.get and secretmanager.secrets.update to record the fingerprint in the secret annotations.
+// Without them, it falls back to comparing the payload of the latest version on every sync.
 type SecretManagerSyncer struct {
 	k         *secretmanager.Client
 	certName  string
 	keyName   string
 	projectId string
+	location  string
+	// fingerprintDenied is set once recording the fingerprint is denied.
+	fingerprintDenied bool
 }
 
 func NewSecretManagerSyncer(client *secretmanager.Client, projectId string, certName string, keyName string) *SecretManagerSyncer {
@@ -59,28 +75,132 @@ func NewSecretManagerSyncer(client *secretmanager.Client, projectId string, cert
 	}
 }
 
+// NewRegionalSecretManagerSyncer creates a syncer for regional secrets.
+// The client must be connected to the regional endpoint of location.
+func NewRegionalSecretManagerSyncer(client *secretmanager.Client, projectId string, location string, certName string, keyName string) *SecretManagerSyncer {
+	return &SecretManagerSyncer{
+		k:         client,
+		certName:  certName,
+		keyName:   keyName,
+		projectId: projectId,
+		location:  location,
+	}
+}
+
+func (s *SecretManagerSyncer) secretFullName(secretName string) string {
+	if s.location == "" {
+		return fmt.Sprintf("projects/%s/secrets/%s", s.projectId, secretName)
+	}
+	return fmt.Sprintf("projects/%s/locations/%s/secrets/%s", s.projectId, s.location, secretName)
+}
+
+// reconcileSecret adds a new version when data differs from the latest one.
 func (s *SecretManagerSyncer) reconcileSecret(ctx context.Context, secretName string, data []byte) error {
+	if !s.fingerprintDenied {
+		err := s.reconcileSecretFingerprint(ctx, secretName, data)
+		if status.Code(err) != codes.PermissionDenied {
+			return err
+		}
+		log.Printf("failed to record fingerprint of %s, comparing payloads instead: %v", secretName, err)
+		s.fingerprintDenied = true
+	}
+	return s.reconcileSecretPayload(ctx, secretName, data)
+}
+
+// reconcileSecretPayload compares data with the payload of the latest version.
+func (s *SecretManagerSyncer) reconcileSecretPayload(ctx context.Context, secretName string, data []byte) error {
+	secretFullName := s.secretFullName(secretName)
 	v, err := s.k.AccessSecretVersion(ctx, &secretmanagerpb.AccessSecretVersionRequest{
-		Name: fmt.Sprintf("projects/%s/secrets/%s/versions/latest", s.projectId, secretName),
+		Name: secretFullName + "/versions/latest",
 	})
-	createNewVersion := false
-	if err != nil && status.Code(err) == codes.NotFound {
-		createNewVersion = true
-	} else if err != nil {
+	if err != nil && status.Code(err) != codes.NotFound {
 		return err
+	} else if err == nil && bytes.Equal(v.Payload.Data, data) {
+		return nil
 	}
-	if createNewVersion || !bytes.Equal(v.Payload.Data, data) {
-		log.Printf("add secret version to %s", secretName)
-		_, err := s.k.AddSecretVersion(ctx, &secretmanagerpb.AddSecretVersionRequest{
-			Parent: fmt.Sprintf("projects/%s/secrets/%s", s.projectId, secretName),
-			Payload: &secretmanagerpb.SecretPayload{
-				Data: data,
-			},
-		})
-		if err != nil {
-			return err
+	log.Printf("add secret version to %s", secretName)
+	_, err = s.k.AddSecretVersion(ctx, &secretmanagerpb.AddSecretVersionRequest{
+		Parent: secretFullName,
+		Payload: &secretmanagerpb.SecretPayload{
+			Data: data,
+		},
+	})
+	return err
+}
+
+// reconcileSecretFingerprint compares data with the fingerprint of the latest version recorded in the secret annotations,
+// so the payload is only accessed when that record is missing or stale.
+func (s *SecretManagerSyncer) reconcileSecretFingerprint(ctx context.Context, secretName string, data []byte) error {
+	secretFullName := s.secretFullName(secretName)
+	fingerprint := fmt.Sprintf("%x", sha256.Sum256(data))
+
+	secret, err := s.k.GetSecret(ctx, &secretmanagerpb.GetSecretRequest{
+		Name: secretFullName,
+	})
+	if err != nil {
+		return err
+	}
+	latestVersion := ""
+	v, err := s.k.GetSecretVersion(ctx, &secretmanagerpb.GetSecretVersionRequest{
+		Name: secretFullName + "/versions/latest",
+	})
+	if err != nil && status.Code(err) != codes.NotFound {
+		return err
+	} else if err == nil {
+		latestVersion = v.Name
+	}
+
+	if latestVersion != "" {
+		annotations := secret.GetAnnotations()
+		if annotations[secretManagerVersionAnnotation] == latestVersion && annotations[secretManagerFingerprintAnnotation] != "" {
+			if annotations[secretManagerFingerprintAnnotation] == fingerprint {
+				return nil
+			}
+		} else {
+			pv, err := s.k.AccessSecretVersion(ctx, &secretmanagerpb.AccessSecretVersionRequest{
+				Name: latestVersion,
+			})
+			if err != nil {
+				return err
+			}
+			if bytes.Equal(pv.Payload.Data, data) {
+				return s.recordFingerprint(ctx, secret, latestVersion, fingerprint)
+			}
 		}
 	}
+
+	log.Printf("add secret version to %s", secretName)
+	added, err := s.k.AddSecretVersion(ctx, &secretmanagerpb.AddSecretVersionRequest{
+		Parent: secretFullName,
+		Payload: &secretmanagerpb.SecretPayload{
+			Data: data,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	return s.recordFingerprint(ctx, secret, added.Name, fingerprint)
+}
+
+func (s *SecretManagerSyncer) recordFingerprint(ctx context.Context, secret *secretmanagerpb.Secret, version string, fingerprint string) error {
+	annotations := make(map[string]string, len(secret.GetAnnotations())+2)
+	for k, v := range secret.GetAnnotations() {
+		annotations[k] = v
+	}
+	annotations[secretManagerVersionAnnotation] = version
+	annotations[secretManagerFingerprintAnnotation] = fingerprint
+	_, err := s.k.UpdateSecret(ctx, &secretmanagerpb.UpdateSecretRequest{
+		Secret: &secretmanagerpb.Secret{
+			Name:        secret.Name,
+			Annotations: annotations,
+		},
+		UpdateMask: &fieldmaskpb.FieldMask{
+			Paths: []string{"annotations"},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("record fingerprint of %s: %w", secret.Name, err)
+	}
 	return nil
 }
 
@@ -94,3 +214,51 @@ func (s *SecretManagerSyncer) Sync(ctx context.Context, tlsCert []byte, tlsKey [
 
 	return nil
 }
+
+// SecretManagerTarget is a destination of SecretManagerSyncer.
+// An empty Location means global secrets.
+type SecretManagerTarget struct {
+	Project  string
+	Location string
+	CertName string
+	KeyName  string
+}
+
+// ParseSecretManagerTarget parses a target such as
+// "project=my-project,location=asia-northeast1,cert-secret=tls-crt,key-secret=tls-key".
+// project, cert-secret and key-secret fall back to defaultProject, defaultCertName and defaultKeyName.
+func ParseSecretManagerTarget(value string, defaultProject string, defaultCertName string, defaultKeyName string) (SecretManagerTarget, error) {
+	target := SecretManagerTarget{
+		Project:  defaultProject,
+		CertName: defaultCertName,
+		KeyName:  defaultKeyName,
+	}
+	for _, field := range strings.Split(value, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(field), "=")
+		if !ok {
+			return target, fmt.Errorf("invalid secret-manager target %q: %q is not key=value", value, field)
+		}
+		switch k {
+		case "project":
+			target.Project = v
+		case "location":
+			target.Location = v
+		case "cert-secret":
+			target.CertName = v
+		case "key-secret":
+			target.KeyName = v
+		default:
+			return target, fmt.Errorf("invalid secret-manager target %q: unknown key %q", value, k)
+		}
+	}
+	if target.Project == "" {
+		return target, fmt.Errorf("invalid secret-manager target %q: project is required", value)
+	}
+	if target.CertName == "" {
+		return target, fmt.Errorf("invalid secret-manager target %q: cert-secret is required", value)
+	}
+	if target.KeyName == "" {
+		return target, fmt.Errorf("invalid secret-manager target %q: key-secret is required", value)
+	}
+	return target, nil
+}
@@ -2,7 +2,9 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"net"
+	"strings"
 	"testing"
 
 	secretmanager "cloud.google.com/go/secretmanager/apiv1"
@@ -17,16 +19,25 @@ import (
 
 type fakeSecretManagerServer struct {
 	secretmanagerpb.UnimplementedSecretManagerServiceServer
-	secretData map[string][]byte
+	secretData  map[string][]byte
+	annotations map[string]map[string]string
+	versions    map[string]int
+	accessCount int
+	addCount    int
+	// denyUpdate denies UpdateSecret like a service account without secretmanager.secrets.update.
+	denyUpdate bool
 }
 
 func newFakeSecretManagerServer() *fakeSecretManagerServer {
 	return &fakeSecretManagerServer{
-		secretData: make(map[string][]byte),
+		secretData:  make(map[string][]byte),
+		annotations: make(map[string]map[string]string),
+		versions:    make(map[string]int),
 	}
 }
 
 func (s *fakeSecretManagerServer) AccessSecretVersion(_ context.Context, req *secretmanagerpb.AccessSecretVersionRequest) (*secretmanagerpb.AccessSecretVersionResponse, error) {
+	s.accessCount++
 	if data, ok := s.secretData[req.Name]; ok {
 		return &secretmanagerpb.AccessSecretVersionResponse{
 			Name:    req.Name,
@@ -36,9 +47,38 @@ func (s *fakeSecretManagerServer) AccessSecretVersion(_ context.Context, req *se
 	return nil, status.Errorf(codes.NotFound, "Not Found")
 }
 
+func (s *fakeSecretManagerServer) GetSecret(_ context.Context, req *secretmanagerpb.GetSecretRequest) (*secretmanagerpb.Secret, error) {
+	return &secretmanagerpb.Secret{
+		Name:        req.Name,
+		Annotations: s.annotations[req.Name],
+	}, nil
+}
+
+func (s *fakeSecretManagerServer) UpdateSecret(_ context.Context, req *secretmanagerpb.UpdateSecretRequest) (*secretmanagerpb.Secret, error) {
+	if s.denyUpdate {
+		return nil, status.Errorf(codes.PermissionDenied, "Permission denied")
+	}
+	s.annotations[req.Secret.Name] = req.Secret.Annotations
+	return req.Secret, nil
+}
+
+func (s *fakeSecretManagerServer) GetSecretVersion(_ context.Context, req *secretmanagerpb.GetSecretVersionRequest) (*secretmanagerpb.SecretVersion, error) {
+	parent := strings.TrimSuffix(req.Name, "/versions/latest")
+	if _, ok := s.secretData[req.Name]; !ok {
+		return nil, status.Errorf(codes.NotFound, "Not Found")
+	}
+	return &secretmanagerpb.SecretVersion{
+		Name: fmt.Sprintf("%s/versions/%d", parent, s.versions[parent]),
+	}, nil
+}
+
 func (s *fakeSecretManagerServer) AddSecretVersion(_ context.Context, req *secretmanagerpb.AddSecretVersionRequest) (*secretmanagerpb.SecretVersion, error) {
+	s.addCount++
+	s.versions[req.GetParent()]++
+	name := fmt.Sprintf("%s/versions/%d", req.GetParent(), s.versions[req.GetParent()])
 	s.secretData[req.GetParent()+"/versions/latest"] = req.Payload.Data
-	return &secretmanagerpb.SecretVersion{}, nil
+	s.secretData[name] = req.Payload.Data
+	return &secretmanagerpb.SecretVersion{Name: name}, nil
 }
 
 func fakeServerForSecretManager(t *testing.T) (*secretmanager.Client, *fakeSecretManagerServer) {
@@ -139,3 +179,142 @@ func TestSecretManagerSyncer(t *testing.T) {
 		t.Errorf("unexpected error in sync: %+v", err)
 	}
 }
+
+func TestSecretManagerSyncerFingerprint(t *testing.T) {
+	ctx := context.Background()
+	client, fs := fakeServerForSecretManager(t)
+	syncer := NewSecretManagerSyncer(client, "test-project", "cert-secret", "key-secret")
+
+	if err := syncer.Sync(ctx, []byte("tlsCert"), []byte("tlsKey")); err != nil {
+		t.Fatalf("unexpected error in sync: %+v", err)
+	}
+	assert.Equal(t, 2, fs.addCount)
+	assert.Equal(t, "projects/test-project/secrets/cert-secret/versions/1", fs.annotations["projects/test-project/secrets/cert-secret"][secretManagerVersionAnnotation])
+
+	// The recorded fingerprint matches, so the payload must not be accessed.
+	fs.accessCount = 0
+	if err := syncer.Sync(ctx, []byte("tlsCert"), []byte("tlsKey")); err != nil {
+		t.Fatalf("unexpected error in sync: %+v", err)
+	}
+	assert.Equal(t, 0, fs.accessCount)
+	assert.Equal(t, 2, fs.addCount)
+
+	if err := syncer.Sync(ctx, []byte("tlsCert2"), []byte("tlsKey")); err != nil {
+		t.Fatalf("unexpected error in sync: %+v", err)
+	}
+	assert.Equal(t, 0, fs.accessCount)
+	assert.Equal(t, 3, fs.addCount)
+	assert.Equal(t, []byte("tlsCert2"), fs.secretData["projects/test-project/secrets/cert-secret/versions/latest"])
+	assert.Equal(t, "projects/test-project/secrets/cert-secret/versions/2", fs.annotations["projects/test-project/secrets/cert-secret"][secretManagerVersionAnnotation])
+}
+
+func TestSecretManagerSyncerWithoutFingerprint(t *testing.T) {
+	ctx := context.Background()
+	client, fs := fakeServerForSecretManager(t)
+	// Versions added by an older release or by someone else carry no fingerprint.
+	for _, name := range []string{"cert-secret", "key-secret"} {
+		if _, err := client.AddSecretVersion(ctx, &secretmanagerpb.AddSecretVersionRequest{
+			Parent:  "projects/test-project/secrets/" + name,
+			Payload: &secretmanagerpb.SecretPayload{Data: []byte(name)},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	syncer := NewSecretManagerSyncer(client, "test-project", "cert-secret", "key-secret")
+	if err := syncer.Sync(ctx, []byte("cert-secret"), []byte("tlsKey")); err != nil {
+		t.Fatalf("unexpected error in sync: %+v", err)
+	}
+	assert.Equal(t, 2, fs.accessCount)
+	assert.Equal(t, 3, fs.addCount)
+	assert.Equal(t, "projects/test-project/secrets/cert-secret/versions/1", fs.annotations["projects/test-project/secrets/cert-secret"][secretManagerVersionAnnotation])
+	assert.Equal(t, "projects/test-project/secrets/key-secret/versions/2", fs.annotations["projects/test-project/secrets/key-secret"][secretManagerVersionAnnotation])
+}
+
+func TestSecretManagerSyncerFingerprintDenied(t *testing.T) {
+	ctx := context.Background()
+	client, fs := fakeServerForSecretManager(t)
+	fs.denyUpdate = true
+	syncer := NewSecretManagerSyncer(client, "test-project", "cert-secret", "key-secret")
+	for i := 0; i < 2; i++ {
+		if err := syncer.Sync(ctx, []byte("tlsCert"), []byte("tlsKey")); err != nil {
+			t.Fatalf("unexpected error in sync: %+v", err)
+		}
+	}
+	// Versions are added once, and then compared by the payloads.
+	assert.True(t, syncer.fingerprintDenied)
+	assert.Equal(t, 2, fs.addCount)
+	assert.Empty(t, fs.annotations)
+}
+
+func TestRegionalSecretManagerSyncer(t *testing.T) {
+	ctx := context.Background()
+	client, fs := fakeServerForSecretManager(t)
+	syncer := NewRegionalSecretManagerSyncer(client, "test-project", "asia-northeast1", "cert-secret", "key-secret")
+	if err := syncer.Sync(ctx, []byte("tlsCert"), []byte("tlsKey")); err != nil {
+		t.Fatalf("unexpected error in sync: %+v", err)
+	}
+	assert.Equal(t, []byte("tlsCert"), fs.secretData["projects/test-project/locations/asia-northeast1/secrets/cert-secret/versions/latest"])
+	assert.Equal(t, []byte("tlsKey"), fs.secretData["projects/test-project/locations/asia-northeast1/secrets/key-secret/versions/latest"])
+}
+
+func TestParseSecretManagerTarget(t *testing.T) {
+	testCases := []struct {
+		Name           string
+		Value          string
+		DefaultProject string
+		Expected       SecretManagerTarget
+		Error          string
+	}{
+		{
+			Name:     "Defaults",
+			Value:    "project=p1",
+			Expected: SecretManagerTarget{Project: "p1", CertName: "cert", KeyName: "key"},
+		},
+		{
+			Name:     "All Fields",
+			Value:    "project=p1, location=asia-northeast1, cert-secret=c, key-secret=k",
+			Expected: SecretManagerTarget{Project: "p1", Location: "asia-northeast1", CertName: "c", KeyName: "k"},
+		},
+		{
+			Name:           "Default Project",
+			Value:          "location=asia-northeast1",
+			DefaultProject: "p0",
+			Expected:       SecretManagerTarget{Project: "p0", Location: "asia-northeast1", CertName: "cert", KeyName: "key"},
+		},
+		{
+			Name:           "Project Overrides Default",
+			Value:          "project=p1",
+			DefaultProject: "p0",
+			Expected:       SecretManagerTarget{Project: "p1", CertName: "cert", KeyName: "key"},
+		},
+		{
+			Name:  "No Project",
+			Value: "location=asia-northeast1",
+			Error: "project is required",
+		},
+		{
+			Name:  "Unknown Key",
+			Value: "project=p1,region=asia-northeast1",
+			Error: "unknown key",
+		},
+		{
+			Name:  "Not Key Value",
+			Value: "p1",
+			Error: "not key=value",
+		},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			target, err := ParseSecretManagerTarget(tc.Value, tc.DefaultProject, "cert", "key")
+			if tc.Error != "" {
+				if assert.Error(t, err) {
+					assert.Contains(t, err.Error(), tc.Error)
+				}
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, tc.Expected, target)
+		})
+	}
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	vault "github.com/hashicorp/vault/api"
+)
+
+const defaultKubernetesServiceAccountTokenPath = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+// VaultAuth is how VaultClient logs in to Vault.
+// Method is one of "token", "approle" and "kubernetes". Mount defaults to Method.
+type VaultAuth struct {
+	Method              string
+	Mount               string
+	RoleID              string
+	SecretIDFile        string
+	KubernetesRole      string
+	KubernetesTokenFile string
+}
+
+// VaultClient is a Vault client which logs in again before the token expires.
+type VaultClient struct {
+	client   *vault.Client
+	auth     VaultAuth
+	mu       sync.Mutex
+	loggedIn bool
+	// expiry is when to log in again. Zero means the token never expires.
+	expiry time.Time
+	now    func() time.Time
+}
+
+// NewVaultClient creates a client for address. With the token method, the token is read from VAULT_TOKEN.
+func NewVaultClient(address string, auth VaultAuth) (*VaultClient, error) {
+	switch auth.Method {
+	case "token":
+	case "approle":
+		if auth.RoleID == "" {
+			return nil, fmt.Errorf("role id is required for approle auth")
+		}
+	case "kubernetes":
+		if auth.KubernetesRole == "" {
+			return nil, fmt.Errorf("role is required for kubernetes auth")
+		}
+		if auth.KubernetesTokenFile == "" {
+			auth.KubernetesTokenFile = defaultKubernetesServiceAccountTokenPath
+		}
+	default:
+		return nil, fmt.Errorf("invalid vault auth method: %s", auth.Method)
+	}
+	if auth.Mount == "" {
+		auth.Mount = auth.Method
+	}
+	config := vault.DefaultConfig()
+	if address != "" {
+		config.Address = address
+	}
+	client, err := vault.NewClient(config)
+	if err != nil {
+		return nil, err
+	}
+	return &VaultClient{
+		client: client,
+		auth:   auth,
+		now:    time.Now,
+	}, nil
+}
+
+// Client returns the client after logging in if the token is missing or about to expire.
+func (c *VaultClient) Client(ctx context.Context) (*vault.Client, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.auth.Method == "token" || (c.loggedIn && (c.expiry.IsZero() || c.now().Before(c.expiry))) {
+		return c.client, nil
+	}
+	data := make(map[string]interface{})
+	switch c.auth.Method {
+	case "approle":
+		data["role_id"] = c.auth.RoleID
+		if c.auth.SecretIDFile != "" {
+			secretID, err := os.ReadFile(c.auth.SecretIDFile)
+			if err != nil {
+				return nil, err
+			}
+			data["secret_id"] = strings.TrimSpace(string(secretID))
+		}
+	case "kubernetes":
+		jwt, err := os.ReadFile(c.auth.KubernetesTokenFile)
+		if err != nil {
+			return nil, err
+		}
+		data["role"] = c.auth.KubernetesRole
+		data["jwt"] = strings.TrimSpace(string(jwt))
+	}
+	log.Printf("Start logging in to vault with %s auth", c.auth.Method)
+	secret, err := c.client.Logical().WriteWithContext(ctx, fmt.Sprintf("auth/%s/login", c.auth.Mount), data)
+	if err != nil {
+		return nil, fmt.Errorf("vault login: %w", err)
+	}
+	if secret == nil || secret.Auth == nil || secret.Auth.ClientToken == "" {
+		return nil, fmt.Errorf("vault login: no token returned")
+	}
+	c.client.SetToken(secret.Auth.ClientToken)
+	log.Printf("Complete logging in to vault with %s auth", c.auth.Method)
+	// Log in again at 2/3 of the lease so that requests never use an expired token.
+	// A lease of 0 is a token without expiry.
+	lease := time.Duration(secret.Auth.LeaseDuration) * time.Second
+	c.loggedIn = true
+	c.expiry = time.Time{}
+	if lease > 0 {
+		c.expiry = c.now().Add(lease * 2 / 3)
+	}
+	return c.client, nil
+}
+
+// readVaultKV reads the secret data and its version. version 0 means the latest one, and is ignored by KV v1.
+// A missing secret is returned as nil data without error.
+func readVaultKV(ctx context.Context, client *vault.Client, kvVersion int, mount string, path string, version int) (map[string]interface{}, int, error) {
+	var secret *vault.KVSecret
+	var err error
+	if kvVersion == 1 {
+		secret, err = client.KVv1(mount).Get(ctx, path)
+	} else if version > 0 {
+		secret, err = client.KVv2(mount).GetVersion(ctx, path, version)
+	} else {
+		secret, err = client.KVv2(mount).Get(ctx, path)
+	}
+	if errors.Is(err, vault.ErrSecretNotFound) {
+		return nil, 0, nil
+	} else if err != nil {
+		return nil, 0, err
+	}
+	currentVersion := 0
+	if secret.VersionMetadata != nil {
+		currentVersion = secret.VersionMetadata.Version
+	}
+	return secret.Data, currentVersion, nil
+}
+
+// currentVaultKVVersion returns the latest version of the KV v2 secret including deleted ones, or 0 if it has none.
+func currentVaultKVVersion(ctx context.Context, client *vault.Client, mount string, path string) (int, error) {
+	metadata, err := client.KVv2(mount).GetMetadata(ctx, path)
+	if errors.Is(err, vault.ErrSecretNotFound) {
+		return 0, nil
+	} else if err != nil {
+		return 0, fmt.Errorf("read vault secret metadata: %w", err)
+	}
+	return metadata.CurrentVersion, nil
+}
+
+type VaultKVFetcher struct {
+	client    *VaultClient
+	kvVersion int
+	mount     string
+	path      string
+	version   int
+	certField string
+	keyField  string
+}
+
+// NewVaultKVFetcher creates a fetcher for KV v1 or v2 secret engine mounted at mount.
+// With KV v2, version pins the secret version to read; 0 means the latest one.
+func NewVaultKVFetcher(client *VaultClient, kvVersion int, mount string, path string, version int, certField string, keyField string) *VaultKVFetcher {
+	return &VaultKVFetcher{
+		client:    client,
+		kvVersion: kvVersion,
+		mount:     mount,
+		path:      path,
+		version:   version,
+		certField: certField,
+		keyField:  keyField,
+	}
+}
+
+func (f *VaultKVFetcher) Fetch(ctx context.Context) ([]byte, []byte, error) {
+	client, err := f.client.Client(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, _, err := readVaultKV(ctx, client, f.kvVersion, f.mount, f.path, f.version)
+	if err != nil {
+		return nil, nil, err
+	}
+	if data == nil {
+		return nil, nil, fmt.Errorf("vault secret %s/%s not found", f.mount, f.path)
+	}
+	tlsCert, ok := data[f.certField].(string)
+	if !ok {
+		return nil, nil, fmt.Errorf("field %s is not found in vault secret %s/%s", f.certField, f.mount, f.path)
+	}
+	tlsKey, ok := data[f.keyField].(string)
+	if !ok {
+		return nil, nil, fmt.Errorf("field %s is not found in vault secret %s/%s", f.keyField, f.mount, f.path)
+	}
+	return []byte(tlsCert), []byte(tlsKey), nil
+}
+
+type VaultKVSyncer struct {
+	client    *VaultClient
+	kvVersion int
+	mount     string
+	path      string
+	certField string
+	keyField  string
+}
+
+func NewVaultKVSyncer(client *VaultClient, kvVersion int, mount string, path string, certField string, keyField string) *VaultKVSyncer {
+	return &VaultKVSyncer{
+		client:    client,
+		kvVersion: kvVersion,
+		mount:     mount,
+		path:      path,
+		certField: certField,
+		keyField:  keyField,
+	}
+}
+
+// Sync writes the certificate and the key keeping the other fields of the secret.
+// With KV v2, the write uses check-and-set so that a concurrent update is not overwritten.
+func (s *VaultKVSyncer) Sync(ctx context.Context, tlsCert []byte, tlsKey []byte) error {
+	client, err := s.client.Client(ctx)
+	if err != nil {
+		return err
+	}
+	current, version, err := readVaultKV(ctx, client, s.kvVersion, s.mount, s.path, 0)
+	if err != nil {
+		return err
+	}
+	if s.kvVersion == 2 && current == nil {
+		// A deleted secret still has versions, and check-and-set requires the latest one.
+		version, err = currentVaultKVVersion(ctx, client, s.mount, s.path)
+		if err != nil {
+			return err
+		}
+	}
+	currentCert, _ := current[s.certField].(string)
+	currentKey, _ := current[s.keyField].(string)
+	if current != nil && bytes.Equal([]byte(currentCert), tlsCert) && bytes.Equal([]byte(currentKey), tlsKey) {
+		return nil
+	}
+	data := make(map[string]interface{}, len(current)+2)
+	for k, v := range current {
+		data[k] = v
+	}
+	data[s.certField] = string(tlsCert)
+	data[s.keyField] = string(tlsKey)
+	log.Printf("Start writing vault secret \"%s/%s\"", s.mount, s.path)
+	if s.kvVersion == 1 {
+		err = client.KVv1(s.mount).Put(ctx, s.path, data)
+	} else {
+		_, err = client.KVv2(s.mount).Put(ctx, s.path, data, vault.WithCheckAndSet(version))
+	}
+	if err != nil {
+		return fmt.Errorf("write vault secret: %w", err)
+	}
+	log.Printf("Complete writing vault secret \"%s/%s\"", s.mount, s.path)
+	return nil
+}
+
+// VaultPKIRequest is the certificate requested to the PKI secrets engine. TTL 0 uses the default of the role.
+type VaultPKIRequest struct {
+	CommonName string
+	AltNames   []string
+	IPSANs     []string
+	TTL        time.Duration
+}
+
+// VaultPKIFetcher issues a certificate from the PKI secrets engine, and issues a new one
+// when renewFraction of the lifetime of the cached certificate has elapsed.
+type VaultPKIFetcher struct {
+	client        *VaultClient
+	mount         string
+	role          string
+	request       VaultPKIRequest
+	renewFraction float64
+	now           func() time.Time
+
+	mu      sync.Mutex
+	tlsCert []byte
+	tlsKey  []byte
+	renewAt time.Time
+	issued  chan struct{}
+}
+
+func NewVaultPKIFetcher(client *VaultClient, mount string, role string, request VaultPKIRequest, renewFraction float64) *VaultPKIFetcher {
+	return &VaultPKIFetcher{
+		client:        client,
+		mount:         mount,
+		role:          role,
+		request:       request,
+		renewFraction: renewFraction,
+		now:           time.Now,
+		issued:        make(chan struct{}, 1),
+	}
+}
+
+func (f *VaultPKIFetcher) Fetch(ctx context.Context) ([]byte, []byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.tlsCert != nil && f.now().Before(f.renewAt) {
+		return f.tlsCert, f.tlsKey, nil
+	}
+	client, err := f.client.Client(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	data := map[string]interface{}{
+		"common_name": f.request.CommonName,
+	}
+	if len(f.request.AltNames) > 0 {
+		data["alt_names"] = strings.Join(f.request.AltNames, ",")
+	}
+	if len(f.request.IPSANs) > 0 {
+		data["ip_sans"] = strings.Join(f.request.IPSANs, ",")
+	}
+	if f.request.TTL > 0 {
+		data["ttl"] = f.request.TTL.String()
+	}
+	log.Printf("Start issuing certificate \"%s\" from vault pki \"%s\"", f.request.CommonName, f.mount)
+	secret, err := client.Logical().WriteWithContext(ctx, fmt.Sprintf("%s/issue/%s", f.mount, f.role), data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("issue vault pki certificate: %w", err)
+	}
+	if secret == nil {
+		return nil, nil, fmt.Errorf("issue vault pki certificate: empty response")
+	}
+	certificate, _ := secret.Data["certificate"].(string)
+	privateKey, _ := secret.Data["private_key"].(string)
+	if certificate == "" || privateKey == "" {
+		return nil, nil, fmt.Errorf("issue vault pki certificate: certificate or private key is missing")
+	}
+	chain := []string{strings.TrimSpace(certificate)}
+	if caChain, ok := secret.Data["ca_chain"].([]interface{}); ok && len(caChain) > 0 {
+		for _, c := range caChain {
+			if s, ok := c.(string); ok {
+				chain = append(chain, strings.TrimSpace(s))
+			}
+		}
+	} else if issuingCA, ok := secret.Data["issuing_ca"].(string); ok && issuingCA != "" {
+		chain = append(chain, strings.TrimSpace(issuingCA))
+	}
+	tlsCert := []byte(strings.Join(chain, "\n") + "\n")
+	leaf, err := parseLeafCertificate(tlsCert)
+	if err != nil {
+		return nil, nil, fmt.Errorf("parse issued certificate: %w", err)
+	}
+	lifetime := leaf.NotAfter.Sub(leaf.NotBefore)
+	f.tlsCert = tlsCert
+	f.tlsKey = []byte(strings.TrimSpace(privateKey) + "\n")
+	f.renewAt = leaf.NotBefore.Add(time.Duration(float64(lifetime) * f.renewFraction))
+	log.Printf("Complete issuing certificate \"%s\" (serial %v), renew at %s", f.request.CommonName, secret.Data["serial_number"], f.renewAt.Format(time.RFC3339))
+	select {
+	case f.issued <- struct{}{}:
+	default:
+	}
+	return f.tlsCert, f.tlsKey, nil
+}
+
+// Watch notifies when the cached certificate should be renewed, so that short-lived certificates
+// are renewed even if the sync interval is longer than their lifetime.
+func (f *VaultPKIFetcher) Watch(ctx context.Context) (<-chan struct{}, error) {
+	changes := make(chan struct{}, 1)
+	go func() {
+		timer := time.NewTimer(0)
+		if !timer.Stop() {
+			<-timer.C
+		}
+		defer timer.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-f.issued:
+				f.mu.Lock()
+				d := f.renewAt.Sub(f.now())
+				f.mu.Unlock()
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+				timer.Reset(d)
+			case <-timer.C:
+				select {
+				case changes <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+	return changes, nil
+}
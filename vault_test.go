@@ -0,0 +1,394 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeVaultServer struct {
+	token     string
+	kvVersion int
+	versions  map[string][]map[string]interface{}
+	// deleted is the set of keys whose latest version is deleted, keeping the version numbers.
+	deleted     map[string]bool
+	logins      []map[string]interface{}
+	writeCount  int
+	leaseSecond int
+	issues      []map[string]interface{}
+	issue       func(request map[string]interface{}) map[string]interface{}
+}
+
+func (s *fakeVaultServer) writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func (s *fakeVaultServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p := strings.TrimPrefix(r.URL.Path, "/v1/")
+	var body map[string]interface{}
+	if r.Body != nil {
+		_ = json.NewDecoder(r.Body).Decode(&body)
+	}
+	if strings.HasPrefix(p, "auth/") && strings.HasSuffix(p, "/login") {
+		s.logins = append(s.logins, body)
+		s.writeJSON(w, http.StatusOK, map[string]interface{}{
+			"auth": map[string]interface{}{"client_token": s.token, "lease_duration": s.leaseSecond},
+		})
+		return
+	}
+	if r.Header.Get("X-Vault-Token") != s.token {
+		s.writeJSON(w, http.StatusForbidden, map[string]interface{}{"errors": []string{"permission denied"}})
+		return
+	}
+	if strings.Contains(p, "/issue/") {
+		s.issues = append(s.issues, body)
+		s.writeJSON(w, http.StatusOK, map[string]interface{}{"data": s.issue(body)})
+		return
+	}
+	// KV v2 paths are {mount}/data/{path} or {mount}/metadata/{path}, and KV v1 paths are {mount}/{path}.
+	key := p
+	if s.kvVersion == 2 {
+		parts := strings.SplitN(p, "/", 3)
+		if len(parts) != 3 || (parts[1] != "data" && parts[1] != "metadata") {
+			s.writeJSON(w, http.StatusBadRequest, map[string]interface{}{"errors": []string{"unexpected path " + p}})
+			return
+		}
+		key = parts[0] + "/" + parts[2]
+		if parts[1] == "metadata" {
+			if len(s.versions[key]) == 0 {
+				s.writeJSON(w, http.StatusNotFound, map[string]interface{}{"errors": []string{}})
+				return
+			}
+			s.writeJSON(w, http.StatusOK, map[string]interface{}{
+				"data": map[string]interface{}{"current_version": len(s.versions[key])},
+			})
+			return
+		}
+	}
+	versions := s.versions[key]
+	switch r.Method {
+	case http.MethodGet:
+		version := len(versions)
+		if v := r.URL.Query().Get("version"); v != "" {
+			version, _ = strconv.Atoi(v)
+		}
+		if version == 0 || version > len(versions) || (version == len(versions) && s.deleted[key]) {
+			s.writeJSON(w, http.StatusNotFound, map[string]interface{}{"errors": []string{}})
+			return
+		}
+		data := versions[version-1]
+		if s.kvVersion == 1 {
+			s.writeJSON(w, http.StatusOK, map[string]interface{}{"data": data})
+			return
+		}
+		s.writeJSON(w, http.StatusOK, map[string]interface{}{
+			"data": map[string]interface{}{
+				"data":     data,
+				"metadata": map[string]interface{}{"version": version, "created_time": time.Now().Format(time.RFC3339), "deletion_time": ""},
+			},
+		})
+	case http.MethodPut, http.MethodPost:
+		s.writeCount++
+		if s.kvVersion == 1 {
+			s.versions[key] = []map[string]interface{}{body}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if options, ok := body["options"].(map[string]interface{}); ok {
+			if cas, ok := options["cas"].(float64); ok && int(cas) != len(versions) {
+				s.writeJSON(w, http.StatusBadRequest, map[string]interface{}{"errors": []string{"check-and-set parameter did not match the current version"}})
+				return
+			}
+		}
+		data, _ := body["data"].(map[string]interface{})
+		s.versions[key] = append(versions, data)
+		delete(s.deleted, key)
+		s.writeJSON(w, http.StatusOK, map[string]interface{}{
+			"data": map[string]interface{}{"version": len(s.versions[key]), "created_time": time.Now().Format(time.RFC3339), "deletion_time": ""},
+		})
+	default:
+		s.writeJSON(w, http.StatusMethodNotAllowed, map[string]interface{}{"errors": []string{"unexpected method"}})
+	}
+}
+
+func fakeServerForVault(t *testing.T, kvVersion int, auth VaultAuth) (*VaultClient, *fakeVaultServer) {
+	fakeServer := &fakeVaultServer{
+		token:       "test-token",
+		kvVersion:   kvVersion,
+		versions:    make(map[string][]map[string]interface{}),
+		deleted:     make(map[string]bool),
+		leaseSecond: 3600,
+	}
+	srv := httptest.NewServer(fakeServer)
+	t.Cleanup(srv.Close)
+	client, err := NewVaultClient(srv.URL, auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if auth.Method == "token" {
+		client.client.SetToken(fakeServer.token)
+	}
+	return client, fakeServer
+}
+
+func TestVaultKV(t *testing.T) {
+	testCases := []struct {
+		Name      string
+		KVVersion int
+	}{
+		{Name: "KV v1", KVVersion: 1},
+		{Name: "KV v2", KVVersion: 2},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			ctx := context.Background()
+			client, fs := fakeServerForVault(t, tc.KVVersion, VaultAuth{Method: "token"})
+			fs.versions["secret/tls/example"] = []map[string]interface{}{{"other": "value"}}
+			syncer := NewVaultKVSyncer(client, tc.KVVersion, "secret", "tls/example", "certificate", "private_key")
+			fetcher := NewVaultKVFetcher(client, tc.KVVersion, "secret", "tls/example", 0, "certificate", "private_key")
+
+			for i := 0; i < 2; i++ {
+				if err := syncer.Sync(ctx, []byte("cert"), []byte("key")); err != nil {
+					t.Fatalf("unexpected error in sync: %+v", err)
+				}
+			}
+			assert.Equal(t, 1, fs.writeCount)
+			tlsCert, tlsKey, err := fetcher.Fetch(ctx)
+			if assert.NoError(t, err) {
+				assert.Equal(t, []byte("cert"), tlsCert)
+				assert.Equal(t, []byte("key"), tlsKey)
+			}
+			versions := fs.versions["secret/tls/example"]
+			assert.Equal(t, "value", versions[len(versions)-1]["other"])
+		})
+	}
+}
+
+func TestVaultKVFetcherVersion(t *testing.T) {
+	ctx := context.Background()
+	client, fs := fakeServerForVault(t, 2, VaultAuth{Method: "token"})
+	fs.versions["secret/tls"] = []map[string]interface{}{
+		{"tls.crt": "cert-1", "tls.key": "key-1"},
+		{"tls.crt": "cert-2", "tls.key": "key-2"},
+	}
+	tlsCert, _, err := NewVaultKVFetcher(client, 2, "secret", "tls", 1, "tls.crt", "tls.key").Fetch(ctx)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []byte("cert-1"), tlsCert)
+	}
+	tlsCert, _, err = NewVaultKVFetcher(client, 2, "secret", "tls", 0, "tls.crt", "tls.key").Fetch(ctx)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []byte("cert-2"), tlsCert)
+	}
+	_, _, err = NewVaultKVFetcher(client, 2, "secret", "missing", 0, "tls.crt", "tls.key").Fetch(ctx)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "not found")
+	}
+	_, _, err = NewVaultKVFetcher(client, 2, "secret", "tls", 0, "certificate", "tls.key").Fetch(ctx)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "field certificate is not found")
+	}
+}
+
+func TestVaultKVSyncerCheckAndSet(t *testing.T) {
+	ctx := context.Background()
+	client, fs := fakeServerForVault(t, 2, VaultAuth{Method: "token"})
+	syncer := NewVaultKVSyncer(client, 2, "secret", "tls", "tls.crt", "tls.key")
+	if err := syncer.Sync(ctx, []byte("cert"), []byte("key")); err != nil {
+		t.Fatalf("unexpected error in sync: %+v", err)
+	}
+	if err := syncer.Sync(ctx, []byte("new-cert"), []byte("new-key")); err != nil {
+		t.Fatalf("unexpected error in sync: %+v", err)
+	}
+	assert.Len(t, fs.versions["secret/tls"], 2)
+	assert.Equal(t, "new-cert", fs.versions["secret/tls"][1]["tls.crt"])
+
+	// A deleted secret is written with the version from the metadata.
+	fs.deleted["secret/tls"] = true
+	if err := syncer.Sync(ctx, []byte("new-cert"), []byte("new-key")); err != nil {
+		t.Fatalf("unexpected error in sync: %+v", err)
+	}
+	assert.Len(t, fs.versions["secret/tls"], 3)
+}
+
+func TestVaultClientLogin(t *testing.T) {
+	dir := t.TempDir()
+	secretIDFile := filepath.Join(dir, "secret-id")
+	if err := os.WriteFile(secretIDFile, []byte("test-secret-id\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tokenFile := filepath.Join(dir, "token")
+	if err := os.WriteFile(tokenFile, []byte("test-jwt"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		Name          string
+		Auth          VaultAuth
+		ExpectedLogin map[string]interface{}
+	}{
+		{
+			Name:          "AppRole",
+			Auth:          VaultAuth{Method: "approle", RoleID: "test-role-id", SecretIDFile: secretIDFile},
+			ExpectedLogin: map[string]interface{}{"role_id": "test-role-id", "secret_id": "test-secret-id"},
+		},
+		{
+			Name:          "Kubernetes",
+			Auth:          VaultAuth{Method: "kubernetes", KubernetesRole: "test-role", KubernetesTokenFile: tokenFile},
+			ExpectedLogin: map[string]interface{}{"role": "test-role", "jwt": "test-jwt"},
+		},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			ctx := context.Background()
+			client, fs := fakeServerForVault(t, 2, tc.Auth)
+			now := time.Now()
+			client.now = func() time.Time { return now }
+			fetcher := NewVaultKVFetcher(client, 2, "secret", "tls", 0, "tls.crt", "tls.key")
+			fs.versions["secret/tls"] = []map[string]interface{}{{"tls.crt": "cert", "tls.key": "key"}}
+
+			for i := 0; i < 2; i++ {
+				if _, _, err := fetcher.Fetch(ctx); err != nil {
+					t.Fatalf("unexpected error in fetch: %+v", err)
+				}
+			}
+			assert.Equal(t, []map[string]interface{}{tc.ExpectedLogin}, fs.logins)
+
+			// The token is renewed before the lease expires.
+			now = now.Add(time.Duration(fs.leaseSecond) * time.Second * 3 / 4)
+			if _, _, err := fetcher.Fetch(ctx); err != nil {
+				t.Fatalf("unexpected error in fetch: %+v", err)
+			}
+			assert.Len(t, fs.logins, 2)
+		})
+	}
+}
+
+func TestVaultClientLoginWithoutExpiry(t *testing.T) {
+	ctx := context.Background()
+	client, fs := fakeServerForVault(t, 2, VaultAuth{Method: "approle", RoleID: "test-role-id"})
+	fs.leaseSecond = 0
+	now := time.Now()
+	client.now = func() time.Time { return now }
+	fetcher := NewVaultKVFetcher(client, 2, "secret", "tls", 0, "tls.crt", "tls.key")
+	fs.versions["secret/tls"] = []map[string]interface{}{{"tls.crt": "cert", "tls.key": "key"}}
+
+	for i := 0; i < 2; i++ {
+		if _, _, err := fetcher.Fetch(ctx); err != nil {
+			t.Fatalf("unexpected error in fetch: %+v", err)
+		}
+		now = now.Add(24 * time.Hour)
+	}
+	assert.Len(t, fs.logins, 1)
+}
+
+func TestNewVaultClient(t *testing.T) {
+	testCases := []struct {
+		Name  string
+		Auth  VaultAuth
+		Error string
+	}{
+		{Name: "Token", Auth: VaultAuth{Method: "token"}},
+		{Name: "Invalid Method", Auth: VaultAuth{Method: "userpass"}, Error: "invalid vault auth method"},
+		{Name: "AppRole No Role ID", Auth: VaultAuth{Method: "approle"}, Error: "role id is required"},
+		{Name: "Kubernetes No Role", Auth: VaultAuth{Method: "kubernetes"}, Error: "role is required"},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			_, err := NewVaultClient("http://127.0.0.1:8200", tc.Auth)
+			if tc.Error == "" {
+				assert.NoError(t, err)
+			} else if assert.Error(t, err) {
+				assert.Contains(t, err.Error(), tc.Error)
+			}
+		})
+	}
+}
+
+func TestVaultPKIFetcher(t *testing.T) {
+	ctx := context.Background()
+	client, fs := fakeServerForVault(t, 2, VaultAuth{Method: "token"})
+	now := time.Now()
+	fs.issue = func(request map[string]interface{}) map[string]interface{} {
+		tlsCert, tlsKey := newTestCertificate(t, request["common_name"].(string), now.Add(90*24*time.Hour))
+		caCert, _ := newTestCertificate(t, "Test CA", now.Add(365*24*time.Hour))
+		return map[string]interface{}{
+			"certificate":   string(tlsCert),
+			"private_key":   string(tlsKey),
+			"issuing_ca":    string(caCert),
+			"ca_chain":      []string{string(caCert)},
+			"serial_number": "01:02",
+		}
+	}
+	fetcher := NewVaultPKIFetcher(client, "pki", "web", VaultPKIRequest{
+		CommonName: "example.com",
+		AltNames:   []string{"www.example.com", "api.example.com"},
+		TTL:        90 * 24 * time.Hour,
+	}, 2.0/3)
+	fetcher.now = func() time.Time { return now }
+
+	tlsCert, tlsKey, err := fetcher.Fetch(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error in fetch: %+v", err)
+	}
+	leaf, chain := splitCertificateChain(tlsCert)
+	assert.NotEmpty(t, leaf)
+	assert.NotEmpty(t, chain)
+	assert.Contains(t, string(tlsKey), "PRIVATE KEY")
+	assert.Equal(t, []map[string]interface{}{{
+		"common_name": "example.com",
+		"alt_names":   "www.example.com,api.example.com",
+		"ttl":         "2160h0m0s",
+	}}, fs.issues)
+
+	// The cached certificate is used until 2/3 of the lifetime has elapsed.
+	now = now.Add(30 * 24 * time.Hour)
+	cached, _, err := fetcher.Fetch(ctx)
+	if assert.NoError(t, err) {
+		assert.Equal(t, tlsCert, cached)
+	}
+	assert.Len(t, fs.issues, 1)
+
+	now = now.Add(31 * 24 * time.Hour)
+	renewed, _, err := fetcher.Fetch(ctx)
+	if assert.NoError(t, err) {
+		assert.NotEqual(t, tlsCert, renewed)
+	}
+	assert.Len(t, fs.issues, 2)
+}
+
+func TestVaultPKIFetcherWatch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client, fs := fakeServerForVault(t, 2, VaultAuth{Method: "token"})
+	fs.issue = func(request map[string]interface{}) map[string]interface{} {
+		tlsCert, tlsKey := newTestCertificate(t, "example.com", time.Now().Add(300*time.Millisecond))
+		return map[string]interface{}{"certificate": string(tlsCert), "private_key": string(tlsKey)}
+	}
+	// newTestCertificate starts the lifetime 90 days before NotAfter, so renew just before the end.
+	fetcher := NewVaultPKIFetcher(client, "pki", "web", VaultPKIRequest{CommonName: "example.com"}, 1-float64(100*time.Millisecond)/float64(90*24*time.Hour))
+	changes, err := fetcher.Watch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := fetcher.Fetch(ctx); err != nil {
+		t.Fatalf("unexpected error in fetch: %+v", err)
+	}
+	select {
+	case <-changes:
+	case <-time.After(5 * time.Second):
+		t.Fatal("renewal is not notified")
+	}
+}
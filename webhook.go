@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	webhookSignatureHeader = "X-Tls-Secrets-Sync-Signature"
+	webhookTimestampHeader = "X-Tls-Secrets-Sync-Timestamp"
+)
+
+// WebhookPayload is the body posted by WebhookSyncer in the json format.
+type WebhookPayload struct {
+	Certificate string    `json:"certificate"`
+	PrivateKey  string    `json:"privateKey"`
+	Fingerprint string    `json:"fingerprint"`
+	NotAfter    time.Time `json:"notAfter"`
+	DNSNames    []string  `json:"dnsNames"`
+	IPAddresses []string  `json:"ipAddresses"`
+}
+
+// WebhookSyncer posts the certificate, the key and their metadata to url as json or multipart.
+// It posts again only when the fingerprint of the leaf certificate changes,
+// so every certificate is posted once per process.
+type WebhookSyncer struct {
+	client          *http.Client
+	url             string
+	format          string
+	hmacKey         []byte
+	retries         int
+	retryInterval   time.Duration
+	lastFingerprint string
+	now             func() time.Time
+}
+
+func NewWebhookSyncer(client *http.Client, url string, format string, hmacKey []byte, retries int) *WebhookSyncer {
+	return &WebhookSyncer{
+		client:        client,
+		url:           url,
+		format:        format,
+		hmacKey:       hmacKey,
+		retries:       retries,
+		retryInterval: time.Second,
+		now:           time.Now,
+	}
+}
+
+// NewWebhookHTTPClient returns a client with timeout, which authenticates with the client certificate
+// if certFile is set and trusts the certificates in caFile in addition to the system ones if caFile is set.
+func NewWebhookHTTPClient(timeout time.Duration, certFile string, keyFile string, caFile string) (*http.Client, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if caFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		data, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificate found in %s", caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &http.Client{Timeout: timeout, Transport: transport}, nil
+}
+
+func (s *WebhookSyncer) payload(tlsCert []byte, tlsKey []byte) (*WebhookPayload, error) {
+	leaf, err := parseLeafCertificate(tlsCert)
+	if err != nil {
+		return nil, fmt.Errorf("parse certificate: %w", err)
+	}
+	fingerprint := sha256.Sum256(leaf.Raw)
+	payload := &WebhookPayload{
+		Certificate: string(tlsCert),
+		PrivateKey:  string(tlsKey),
+		Fingerprint: hex.EncodeToString(fingerprint[:]),
+		NotAfter:    leaf.NotAfter,
+		DNSNames:    leaf.DNSNames,
+	}
+	for _, ip := range leaf.IPAddresses {
+		payload.IPAddresses = append(payload.IPAddresses, ip.String())
+	}
+	return payload, nil
+}
+
+// encode returns the body and its content type for format.
+func (s *WebhookSyncer) encode(payload *WebhookPayload) ([]byte, string, error) {
+	if s.format == "json" {
+		body, err := json.Marshal(payload)
+		return body, "application/json", err
+	}
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	fields := [][2]string{
+		{"fingerprint", payload.Fingerprint},
+		{"notAfter", payload.NotAfter.Format(time.RFC3339)},
+	}
+	for _, name := range payload.DNSNames {
+		fields = append(fields, [2]string{"dnsName", name})
+	}
+	for _, ip := range payload.IPAddresses {
+		fields = append(fields, [2]string{"ipAddress", ip})
+	}
+	for _, f := range fields {
+		if err := w.WriteField(f[0], f[1]); err != nil {
+			return nil, "", err
+		}
+	}
+	for _, f := range [][2]string{{"tls.crt", payload.Certificate}, {"tls.key", payload.PrivateKey}} {
+		part, err := w.CreateFormFile(f[0], f[0])
+		if err != nil {
+			return nil, "", err
+		}
+		if _, err := part.Write([]byte(f[1])); err != nil {
+			return nil, "", err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), w.FormDataContentType(), nil
+}
+
+// webhookSignature returns the hex HMAC-SHA256 of "<timestamp>.<body>".
+func webhookSignature(key []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// post sends body once. The returned bool reports whether the failure is worth retrying.
+func (s *WebhookSyncer) post(ctx context.Context, body []byte, contentType string) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("User-Agent", "tls-secrets-sync")
+	if s.hmacKey != nil {
+		timestamp := strconv.FormatInt(s.now().Unix(), 10)
+		req.Header.Set(webhookTimestampHeader, timestamp)
+		req.Header.Set(webhookSignatureHeader, "sha256="+webhookSignature(s.hmacKey, timestamp, body))
+	}
+	res, err := s.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		_, _ = io.Copy(io.Discard, res.Body)
+		return false, nil
+	}
+	msg, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+	err = fmt.Errorf("webhook returned %s: %s", res.Status, bytes.TrimSpace(msg))
+	return res.StatusCode >= 500 || res.StatusCode == http.StatusTooManyRequests, err
+}
+
+func (s *WebhookSyncer) Sync(ctx context.Context, tlsCert []byte, tlsKey []byte) error {
+	payload, err := s.payload(tlsCert, tlsKey)
+	if err != nil {
+		return err
+	}
+	if payload.Fingerprint == s.lastFingerprint {
+		return nil
+	}
+	body, contentType, err := s.encode(payload)
+	if err != nil {
+		return fmt.Errorf("encode webhook payload: %w", err)
+	}
+
+	log.Printf("Start posting certificate %s to webhook", payload.Fingerprint)
+	interval := s.retryInterval
+	for attempt := 0; ; attempt++ {
+		retry, err := s.post(ctx, body, contentType)
+		if err == nil {
+			break
+		}
+		if !retry || attempt >= s.retries {
+			return fmt.Errorf("post webhook: %w", err)
+		}
+		log.Printf("failed to post webhook, retrying in %s: %v", interval, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+		interval *= 2
+	}
+	s.lastFingerprint = payload.Fingerprint
+	log.Printf("Complete posting certificate %s to webhook", payload.Fingerprint)
+	return nil
+}
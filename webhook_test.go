@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeWebhookServer struct {
+	requests []*http.Request
+	bodies   [][]byte
+	failures int
+}
+
+func (s *fakeWebhookServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	s.requests = append(s.requests, r)
+	s.bodies = append(s.bodies, body)
+	if s.failures > 0 {
+		s.failures--
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func TestWebhookSyncerJSON(t *testing.T) {
+	ctx := context.Background()
+	fs := &fakeWebhookServer{failures: 1}
+	srv := httptest.NewServer(fs)
+	t.Cleanup(srv.Close)
+	syncer := NewWebhookSyncer(srv.Client(), srv.URL, "json", []byte("secret"), 1)
+	syncer.retryInterval = time.Millisecond
+	syncer.now = func() time.Time { return time.Unix(1700000000, 0) }
+	notAfter := time.Now().Add(time.Hour).Truncate(time.Second)
+	tlsCert, tlsKey := newTestCertificate(t, "www.example.com", notAfter)
+
+	for i := 0; i < 2; i++ {
+		if err := syncer.Sync(ctx, tlsCert, tlsKey); err != nil {
+			t.Fatalf("unexpected error in sync: %+v", err)
+		}
+	}
+	// The first request fails with 503 and is retried, then the same fingerprint is not posted again.
+	if !assert.Len(t, fs.requests, 2) {
+		return
+	}
+	r := fs.requests[1]
+	assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+	assert.Equal(t, "1700000000", r.Header.Get(webhookTimestampHeader))
+	assert.Equal(t, "sha256="+webhookSignature([]byte("secret"), "1700000000", fs.bodies[1]), r.Header.Get(webhookSignatureHeader))
+	var payload WebhookPayload
+	if assert.NoError(t, json.Unmarshal(fs.bodies[1], &payload)) {
+		assert.Equal(t, string(tlsCert), payload.Certificate)
+		assert.Equal(t, string(tlsKey), payload.PrivateKey)
+		assert.Equal(t, []string{"www.example.com"}, payload.DNSNames)
+		assert.True(t, notAfter.Equal(payload.NotAfter))
+		assert.Len(t, payload.Fingerprint, 64)
+	}
+
+	renewed, renewedKey := newTestCertificate(t, "www.example.com", notAfter.Add(time.Hour))
+	if err := syncer.Sync(ctx, renewed, renewedKey); err != nil {
+		t.Fatalf("unexpected error in sync: %+v", err)
+	}
+	assert.Len(t, fs.requests, 3)
+}
+
+func TestWebhookSyncerMultipart(t *testing.T) {
+	ctx := context.Background()
+	var form map[string][]string
+	var files map[string]string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		form = r.MultipartForm.Value
+		files = make(map[string]string)
+		for name, headers := range r.MultipartForm.File {
+			f, _ := headers[0].Open()
+			data, _ := io.ReadAll(f)
+			files[name] = string(data)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	tlsCert, tlsKey := newTestCertificate(t, "www.example.com", time.Now().Add(time.Hour))
+	if err := NewWebhookSyncer(srv.Client(), srv.URL, "multipart", nil, 0).Sync(ctx, tlsCert, tlsKey); err != nil {
+		t.Fatalf("unexpected error in sync: %+v", err)
+	}
+	assert.Equal(t, []string{"www.example.com"}, form["dnsName"])
+	assert.Len(t, form["fingerprint"], 1)
+	assert.Equal(t, map[string]string{"tls.crt": string(tlsCert), "tls.key": string(tlsKey)}, files)
+}
+
+func TestWebhookSyncerClientError(t *testing.T) {
+	ctx := context.Background()
+	count := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		count++
+		http.Error(w, "bad signature", http.StatusUnauthorized)
+	}))
+	t.Cleanup(srv.Close)
+	tlsCert, tlsKey := newTestCertificate(t, "www.example.com", time.Now().Add(time.Hour))
+	err := NewWebhookSyncer(srv.Client(), srv.URL, "json", nil, 3).Sync(ctx, tlsCert, tlsKey)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "bad signature")
+	}
+	assert.Equal(t, 1, count)
+}
+
+func TestNewWebhookHTTPClient(t *testing.T) {
+	dir := t.TempDir()
+	clientCert, clientKey := newTestCertificate(t, "client", time.Now().Add(time.Hour))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "client.crt"), clientCert, 0600))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "client.key"), clientKey, 0600))
+
+	var peerCommonName string
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		peerCommonName = r.TLS.PeerCertificates[0].Subject.CommonName
+	}))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "ca.crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0600))
+
+	client, err := NewWebhookHTTPClient(time.Second, filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key"), filepath.Join(dir, "ca.crt"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	res, err := client.Get(srv.URL)
+	if assert.NoError(t, err) {
+		_ = res.Body.Close()
+		assert.Equal(t, "client", peerCommonName)
+	}
+}